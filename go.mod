@@ -10,4 +10,5 @@ require (
 	github.com/google/uuid v1.1.1 // indirect
 	github.com/leodido/go-urn v1.2.0 // indirect
 	gopkg.in/go-playground/validator.v9 v9.30.0
+	gopkg.in/yaml.v2 v2.2.2
 )
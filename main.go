@@ -1,68 +1,243 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"flag"
 	"github.com/gin-contrib/static"
 	_ "github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"gopkg.in/go-playground/validator.v9"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"reserve/reserve"
 	"reserve/reserve/allocator"
+	"reserve/reserve/async"
+	"reserve/reserve/auth"
+	"reserve/reserve/balance"
+	"reserve/reserve/cluster"
 	"reserve/reserve/concurrency"
+	"reserve/reserve/health"
+	"reserve/reserve/logger"
+	"reserve/reserve/metrics"
+	"reserve/reserve/openapi"
+	"reserve/reserve/override"
+	"reserve/reserve/ratelimit"
+	"reserve/reserve/reload"
+	"reserve/reserve/tracing"
+	"syscall"
 	"time"
 )
 
 func main() {
-	router := buildRouter()
-	err := router.Run(":8080")
+	loadConfig := func() (reserve.Config, error) {
+		return reserve.LoadConfig(os.Args[1:], os.Environ())
+	}
+
+	config, err := loadConfig()
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
 	if err != nil {
+		log.Fatal(err)
+	}
+
+	router, stop := buildRouter(config, loadConfig)
+	server := &http.Server{
+		Addr:    config.Server.Address,
+		Handler: router,
+	}
+
+	// the health service reports the instance as draining on the same
+	// signals, giving the orchestrator DrainDelay to stop routing to it
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		<-signals
+		time.Sleep(config.Health.DrainDelay)
+		server.Shutdown(context.Background())
+		stop()
+		close(stopped)
+	}()
+
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Panic(err)
 	}
+	<-stopped
 }
 
-func buildRouter() *gin.Engine {
+// buildRouter wires the services and their routes. stop ends the background
+// work of the services once the server is shut down.
+func buildRouter(config reserve.Config, loadConfig func() (reserve.Config, error)) (router *gin.Engine, stop func()) {
 	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
 		v.RegisterStructValidation(reserve.BodyStructValidation, reserve.Body{})
 	}
 
-	config := reserve.NewConfig()
+	appLogger, err := logger.New(os.Stdout, config.Logging.Level, config.Logging.Format)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var tracer *tracing.Tracer
+	if config.Tracing.Enabled {
+		exporter, err := tracing.NewExporter(config.Tracing.Exporter, config.Tracing.Path)
+		if err != nil {
+			log.Panic(err)
+		}
+		tracer = tracing.NewTracer(exporter, config.Tracing.SampleRate)
+	}
+
+	balanceProvider, err := balance.NewProvider(config.Balance)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	allocatorService := allocator.NewService(config.Allocator, config.Upstream, balanceProvider, appLogger)
 
-	concurrencyService := concurrency.NewService(config.Concurrency)
-	allocatorService := allocator.NewService(config.Allocator)
+	concurrencyService, err := concurrency.NewService(config.Concurrency, allocatorService.Prewarm, appLogger)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	overrideService := override.NewService()
+
+	clusterService, err := cluster.NewService(config.Cluster, allocatorService.Handoff)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	authService, err := auth.NewService(config.Auth, appLogger)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	rateLimitService, err := ratelimit.NewService(config.RateLimit)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	asyncService := async.NewService(
+		config.Async,
+		allocatorService.AllocateReserve,
+		func(request reserve.ReserveRequest, allocated reserve.Reserve, err error) {
+			rateLimitService.Settle(request, allocated.Amount, err)
+		},
+	)
+
+	allocatorService.RegisterMetrics(metrics.Default)
+	concurrencyService.RegisterMetrics(metrics.Default)
+
+	reloadService := reload.NewService(
+		config,
+		loadConfig,
+		appLogger,
+		reload.Applier{
+			Apply: func(config reserve.Config) error {
+				allocatorService.Reload(config.Allocator)
+				return nil
+			},
+		},
+		reload.Applier{
+			Check: func(config reserve.Config) error {
+				return concurrencyService.Check(config.Concurrency)
+			},
+			Apply: func(config reserve.Config) error {
+				return concurrencyService.Reload(config.Concurrency)
+			},
+		},
+		reload.Applier{
+			Check: func(config reserve.Config) error {
+				return authService.Check(config.Auth)
+			},
+			Apply: func(config reserve.Config) error {
+				return authService.Reload(config.Auth)
+			},
+		},
+		reload.Applier{
+			Check: func(config reserve.Config) error {
+				return rateLimitService.Check(config.RateLimit)
+			},
+			Apply: func(config reserve.Config) error {
+				return rateLimitService.Reload(config.RateLimit)
+			},
+		},
+	)
+	reloadService.WatchSignals()
+
+	healthService := health.NewService(
+		config.Health,
+		allocatorService.UpstreamErrorRate,
+		allocatorService.BalanceErrorRate,
+		func() (int, int) {
+			stats := allocatorService.RegistryStats()
+			return stats.Size, stats.Capacity
+		},
+		concurrencyService.SnapshotError,
+	)
+	healthService.WatchSignals()
 
 	reserveService := reserve.NewService(
+		overrideService.Lookup,
 		concurrencyService.CheckConcurrency,
+		allocatorService.BucketModePaused,
 		allocatorService.AllocateReserve,
+		asyncService.Submit,
+		asyncService.Load,
 		allocatorService.ListFromDB,
 		allocatorService.ListFromRegistry,
+		appLogger,
 	)
 
-	router := gin.New()
-	router.Use(loggerMiddleware)
-	router.Use(concurrencyService.RegisterEntryMiddleware)
-	router.Use(allocatorService.RegisterBucketExpirationMiddleware)
+	accessLog := logger.NewAccessLog(appLogger, config.Logging.AccessLogSampleRate)
+
+	document := openapi.NewDocument()
+
+	router = gin.New()
+	router.Use(logger.RegisterRequestIDMiddleware)
+	if validate := config.OpenAPI.Validate; validate == "always" || (validate == "test_mode" && gin.Mode() == gin.TestMode) {
+		validator := openapi.NewValidator(document, appLogger)
+		router.Use(validator.RegisterMiddleware)
+	}
+	router.Use(accessLog.RegisterMiddleware)
+	router.Use(tracer.RegisterMiddleware)
 	router.Use(gin.Recovery())
 
 	router.Use(static.Serve("/", static.LocalFile("./static", true)))
-	router.POST("/api/users/:user_id/reserve", reserveService.HandleCreation)
+	router.GET("/openapi.json", document.Handle)
+	router.GET("/metrics", metrics.Default.Handle)
+	router.GET("/health", healthService.HandleLiveness)
+	router.GET("/ready", healthService.HandleReadiness)
+	// requests are authenticated by the owner of their user, which remembers
+	// the nonces of its users
+	router.POST("/api/users/:user_id/reserve", clusterService.RegisterForwardMiddleware, allocatorService.RegisterBucketExpirationMiddleware, authService.RegisterMiddleware, rateLimitService.RegisterMiddleware, concurrencyService.RegisterEntryMiddleware, reserveService.HandleCreation)
+	router.GET("/api/users/:user_id/reserve/:reserve_id", clusterService.RegisterForwardMiddleware, reserveService.HandlePendingRequest)
 	router.GET("/db/:user_id", reserveService.HandleDBRequest)
-	router.GET("/registry/:user_id", reserveService.HandleRegistryRequest)
+	router.GET("/registry/:user_id", clusterService.RegisterForwardMiddleware, reserveService.HandleRegistryRequest)
+	admin := router.Group("/admin", reloadService.RegisterAuthMiddleware)
+	admin.GET("/heat", concurrencyService.HandleHottestRequest)
+	admin.GET("/heat/:user_id", concurrencyService.HandleUserRequest)
+	admin.GET("/exposure", allocatorService.HandleExposureRequest)
+	admin.GET("/stats/registry", allocatorService.HandleStatsRequest)
+	admin.GET("/stats/heat", concurrencyService.HandleStatsRequest)
+	admin.GET("/overrides", overrideService.HandleList)
+	admin.GET("/overrides/:user_id", clusterService.RegisterForwardMiddleware, overrideService.HandleGet)
+	admin.PUT("/overrides/:user_id", clusterService.RegisterForwardMiddleware, overrideService.HandleSet)
+	admin.DELETE("/overrides/:user_id", clusterService.RegisterForwardMiddleware, overrideService.HandleClear)
+	admin.GET("/usage", rateLimitService.HandleList)
+	admin.GET("/usage/:client_id", rateLimitService.HandleGet)
+	admin.GET("/cluster", clusterService.HandleMembershipRequest)
+	admin.PUT("/cluster/peers", clusterService.HandleSetPeers)
+	admin.POST("/config/reload", reloadService.HandleReload)
+	admin.PUT("/bucket-mode", allocatorService.HandleBucketMode)
+	admin.GET("/registry", allocatorService.HandleRegistryStateRequest)
+	admin.DELETE("/registry", allocatorService.HandleFlush)
+	admin.GET("/registry/:user_id", clusterService.RegisterForwardMiddleware, allocatorService.HandleUserStateRequest)
+	admin.DELETE("/registry/:user_id", clusterService.RegisterForwardMiddleware, allocatorService.HandleReleaseUser)
+	admin.DELETE("/registry/:user_id/buckets/:reserve_id", clusterService.RegisterForwardMiddleware, allocatorService.HandleReleaseBucket)
 
-	return router
+	return router, concurrencyService.Stop
 }
-
-var loggerMiddleware = gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
-	return fmt.Sprintf("%s - [%s] \"%s %s %s %d %s \"%s\" %s\"\n",
-		param.ClientIP,
-		param.TimeStamp.Format(time.RFC1123),
-		param.Method,
-		param.Path,
-		param.Request.Proto,
-		param.StatusCode,
-		param.Latency,
-		param.Request.UserAgent(),
-		param.ErrorMessage,
-	)
-})
@@ -2,18 +2,44 @@ package main
 
 import (
 	"bytes"
+	"encoding/hex"
 	"encoding/json"
 	"github.com/gin-gonic/gin"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reserve/reserve"
+	"reserve/reserve/auth"
+	"reserve/reserve/cluster"
+	"reserve/reserve/openapi"
+	"reserve/reserve/tracing"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
+// TestMain runs the tests in gin test mode, so that every request and
+// response goes through the OpenAPI validator.
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+func staticConfig(config reserve.Config) func() (reserve.Config, error) {
+	return func() (reserve.Config, error) {
+		return config, nil
+	}
+}
+
 func Reserve(router *gin.Engine, writer http.ResponseWriter, req *http.Request) {
 	router.ServeHTTP(writer, req)
 }
 
 func BenchmarkTestReserve(b *testing.B) {
-	router := buildRouter()
+	router, _ := buildRouter(reserve.NewConfig(), staticConfig(reserve.NewConfig()))
 
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
@@ -57,3 +83,711 @@ func (m *mockWriter) WriteString(s string) (n int, err error) {
 }
 
 func (m *mockWriter) WriteHeader(code int) {}
+
+func TestAsyncReserve(t *testing.T) {
+	router, _ := buildRouter(reserve.NewConfig(), staticConfig(reserve.NewConfig()))
+
+	bodyBytes, _ := json.Marshal(gin.H{
+		"external_reference": "1234",
+		"mode":               "total",
+		"reason":             "reserve_for_payment",
+		"amount":             25,
+	})
+	req, _ := http.NewRequest("POST", "/api/users/1/reserve", bytes.NewReader(bodyBytes))
+	req.Header = map[string][]string{
+		"X-Client-Id":       {"1234"},
+		"X-Idempotency-Key": {"1234"},
+		"Prefer":            {"respond-async"},
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body.String())
+	}
+
+	location := w.Header().Get("Location")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", location, nil)
+		router.ServeHTTP(w, req)
+
+		var pending struct {
+			Status  string `json:"status"`
+			Reserve *struct {
+				Amount int64 `json:"amount"`
+			} `json:"reserve"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &pending); err != nil {
+			t.Fatal(err)
+		}
+
+		switch pending.Status {
+		case "pending":
+			time.Sleep(10 * time.Millisecond)
+			continue
+		case "reserved":
+			if pending.Reserve == nil || pending.Reserve.Amount != 2500 {
+				t.Fatalf("unexpected reserve: %s", w.Body.String())
+			}
+			return
+		default:
+			t.Fatalf("unexpected status: %s", w.Body.String())
+		}
+	}
+
+	t.Fatal("reserve did not complete in time")
+}
+
+func TestOverrideForcesAllocationMode(t *testing.T) {
+	config := reserve.NewConfig()
+	config.Admin.Token = "admin-secret"
+	router, _ := buildRouter(config, staticConfig(config))
+
+	overrideBytes, _ := json.Marshal(gin.H{
+		"mode":   "bucket",
+		"reason": "batch payments merchant",
+	})
+	req, _ := http.NewRequest("PUT", "/admin/overrides/3", bytes.NewReader(overrideBytes))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 setting an override without the admin token, got %d", w.Code)
+	}
+
+	req, _ = http.NewRequest("PUT", "/admin/overrides/3", bytes.NewReader(overrideBytes))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 setting the override, got %d: %s", w.Code, w.Body.String())
+	}
+
+	bodyBytes, _ := json.Marshal(gin.H{
+		"external_reference": "1234",
+		"mode":               "total",
+		"reason":             "reserve_for_payment",
+		"amount":             25,
+	})
+	req, _ = http.NewRequest("POST", "/api/users/3/reserve", bytes.NewReader(bodyBytes))
+	req.Header = map[string][]string{
+		"X-Client-Id":       {"1234"},
+		"X-Idempotency-Key": {"1234"},
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var allocated struct {
+		Version     string `json:"version"`
+		Diagnostics struct {
+			AllocationMode string `json:"allocation_mode"`
+			Source         string `json:"source"`
+			Override       struct {
+				Reason string `json:"reason"`
+			} `json:"override"`
+		} `json:"diagnostics"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &allocated); err != nil {
+		t.Fatal(err)
+	}
+	if allocated.Version != "splitted" ||
+		allocated.Diagnostics.AllocationMode != "bucket" ||
+		allocated.Diagnostics.Source != "override" ||
+		allocated.Diagnostics.Override.Reason != "batch payments merchant" {
+		t.Fatalf("unexpected reserve: %s", w.Body.String())
+	}
+}
+
+func TestClusterForwardsToOwnerAndHandsOff(t *testing.T) {
+	servers := make([]*httptest.Server, 3)
+	peers := make([]string, len(servers))
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		peers[i] = "http://" + servers[i].Listener.Addr().String()
+	}
+	for i, server := range servers {
+		config := reserve.NewConfig()
+		config.Concurrency.SnapshotEnabled = false
+		config.Cluster.Enabled = true
+		config.Cluster.Self = peers[i]
+		config.Cluster.Peers = peers
+		config.Cluster.Secret = "cluster-secret"
+		config.Admin.Token = "admin-secret"
+
+		server.Config.Handler, _ = buildRouter(config, staticConfig(config))
+		server.Start()
+		defer server.Close()
+	}
+
+	const userID = "7"
+	reserveOn := func(peer string) *http.Response {
+		bodyBytes, _ := json.Marshal(gin.H{
+			"external_reference": "1234",
+			"mode":               "total",
+			"reason":             "reserve_for_payment",
+			"amount":             25,
+		})
+		req, _ := http.NewRequest("POST", peer+"/api/users/"+userID+"/reserve", bytes.NewReader(bodyBytes))
+		req.Header.Set("X-Client-Id", "1234")
+		req.Header.Set("X-Idempotency-Key", "1234")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(res.Body)
+			t.Fatalf("expected 200 from %s, got %d: %s", peer, res.StatusCode, body)
+		}
+
+		return res
+	}
+
+	owner := ""
+	for _, peer := range peers {
+		served := reserveOn(peer).Header.Get("X-Reserve-Owner")
+		if owner != "" && served != owner {
+			t.Fatalf("expected every request to be served by %s, %s served one", owner, served)
+		}
+		owner = served
+	}
+
+	// force the owner into bucket mode and fill its registry, both through
+	// a peer
+	var peer string
+	for _, peer = range peers {
+		if peer != owner {
+			break
+		}
+	}
+	overrideBytes, _ := json.Marshal(gin.H{"mode": "bucket", "reason": "cluster test"})
+	req, _ := http.NewRequest("PUT", peer+"/admin/overrides/"+userID, bytes.NewReader(overrideBytes))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if served := res.Header.Get("X-Reserve-Owner"); res.StatusCode != http.StatusOK || served != owner {
+		t.Fatalf("expected the override to be set on %s, got %d from %s", owner, res.StatusCode, served)
+	}
+	reserveOn(peer)
+
+	// reads the registry of an instance whether it owns the user or not,
+	// as a request forwarded by peer
+	registryOf := func(instance string) []json.RawMessage {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		signature := cluster.Sign([]byte("cluster-secret"), peer, instance, "GET", "/registry/"+userID, "", timestamp, nil)
+		req, _ := http.NewRequest("GET", instance+"/registry/"+userID, nil)
+		req.Header.Set("X-Reserve-Forwarded-By", peer)
+		req.Header.Set("X-Reserve-Forwarded-At", timestamp)
+		req.Header.Set("X-Reserve-Forward-Signature", hex.EncodeToString(signature))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if served := res.Header.Get("X-Reserve-Owner"); served != instance {
+			t.Fatalf("expected %s to serve a signed forwarded request, %s did", instance, served)
+		}
+
+		var buckets []json.RawMessage
+		if err := json.NewDecoder(res.Body).Decode(&buckets); err != nil {
+			t.Fatal(err)
+		}
+
+		return buckets
+	}
+	if buckets := registryOf(owner); len(buckets) == 0 {
+		t.Fatal("expected the owner to hold a bucket")
+	}
+
+	// a request that only claims to be forwarded goes to the owner
+	req, _ = http.NewRequest("GET", peer+"/registry/"+userID, nil)
+	req.Header.Set("X-Reserve-Forwarded-By", owner)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if served := res.Header.Get("X-Reserve-Owner"); served != owner {
+		t.Fatalf("expected an unsigned forwarded request to be served by %s, %s did", owner, served)
+	}
+
+	var remaining []string
+	for _, peer := range peers {
+		if peer != owner {
+			remaining = append(remaining, peer)
+		}
+	}
+	for _, peer := range peers {
+		peersBytes, _ := json.Marshal(gin.H{"peers": remaining})
+		req, _ := http.NewRequest("PUT", peer+"/admin/cluster/peers", bytes.NewReader(peersBytes))
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var handoff struct {
+			HandedOff int `json:"handed_off"`
+		}
+		json.NewDecoder(res.Body).Decode(&handoff)
+		res.Body.Close()
+		if peer == owner && handoff.HandedOff != 1 {
+			t.Fatalf("expected the old owner to hand off one user, got %d", handoff.HandedOff)
+		}
+	}
+
+	if buckets := registryOf(owner); len(buckets) != 0 {
+		t.Fatalf("expected the old owner to release its buckets, %d left", len(buckets))
+	}
+	if served := reserveOn(owner).Header.Get("X-Reserve-Owner"); served == owner || served == "" {
+		t.Fatalf("expected the old owner to forward to a new one, served by %q", served)
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	config := reserve.NewConfig()
+	config.Concurrency.SnapshotEnabled = false
+	config.Admin.Token = "admin-secret"
+
+	reloaded := config
+	reloaded.Allocator.OvershootFactor = 20
+	reloaded.Concurrency.ConcurrrentThresshold = 3
+	reloaded.Allocator.LockShards = 32
+
+	router, _ := buildRouter(config, staticConfig(reloaded))
+
+	req, _ := http.NewRequest("POST", "/admin/config/reload", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the admin token, got %d", w.Code)
+	}
+
+	req, _ = http.NewRequest("POST", "/admin/config/reload", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var result struct {
+		Changes []reserve.ConfigChange `json:"changes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []reserve.ConfigChange{
+		{Key: "allocator.overshoot_factor", From: "10", To: "20", Live: true},
+		{Key: "allocator.lock_shards", From: "64", To: "32", Live: false},
+		{Key: "concurrency.concurrent_threshold", From: "10", To: "3", Live: true},
+	}
+	if len(result.Changes) != len(expected) {
+		t.Fatalf("unexpected changes %+v", result.Changes)
+	}
+	for i := range expected {
+		if result.Changes[i] != expected[i] {
+			t.Fatalf("expected %+v, got %+v", expected[i], result.Changes[i])
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	config := reserve.NewConfig()
+	config.Concurrency.SnapshotEnabled = false
+	router, _ := buildRouter(config, staticConfig(config))
+
+	bodyBytes, _ := json.Marshal(gin.H{
+		"external_reference": "1234",
+		"mode":               "total",
+		"reason":             "reserve_for_payment",
+		"amount":             25,
+	})
+	req, _ := http.NewRequest("POST", "/api/users/4/reserve", bytes.NewReader(bodyBytes))
+	req.Header = map[string][]string{
+		"X-Client-Id":       {"1234"},
+		"X-Idempotency-Key": {"1234"},
+	}
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	for _, line := range []string{
+		`reserve_allocations_total{path="standalone",result="ok"}`,
+		`reserve_allocation_duration_seconds_bucket{path="standalone",le="+Inf"}`,
+		`reserve_upstream_request_duration_seconds_count{operation="post"}`,
+		`reserve_concurrency_checks_total{mode="standalone"}`,
+		`# TYPE reserve_registry_buckets gauge`,
+		`# TYPE reserve_heat_map_keys gauge`,
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("expected %s in:\n%s", line, w.Body.String())
+		}
+	}
+}
+
+func TestRequestIDAndTracing(t *testing.T) {
+	config := reserve.NewConfig()
+	config.Concurrency.SnapshotEnabled = false
+	config.Tracing.Enabled = true
+	config.Tracing.Exporter = "file"
+	config.Tracing.Path = filepath.Join(t.TempDir(), "traces.jsonl")
+	router, _ := buildRouter(config, staticConfig(config))
+
+	bodyBytes, _ := json.Marshal(gin.H{
+		"external_reference": "1234",
+		"mode":               "total",
+		"reason":             "reserve_for_payment",
+		"amount":             25,
+	})
+	req, _ := http.NewRequest("POST", "/api/users/5/reserve", bytes.NewReader(bodyBytes))
+	req.Header = map[string][]string{
+		"X-Client-Id":       {"1234"},
+		"X-Idempotency-Key": {"1234"},
+		"X-Request-Id":      {"req-1234"},
+		"Traceparent":       {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if requestID := w.Header().Get("X-Request-Id"); requestID != "req-1234" {
+		t.Errorf("expected the request ID to be echoed, got %q", requestID)
+	}
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Header().Get("X-Request-Id") == "" {
+		t.Error("expected a generated request ID")
+	}
+
+	traces, err := ioutil.ReadFile(config.Tracing.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]tracing.Record{}
+	for _, line := range strings.Split(strings.TrimSpace(string(traces)), "\n") {
+		var record tracing.Record
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		spans[record.Name] = record
+	}
+
+	parents := map[string]string{
+		"POST /api/users/:user_id/reserve": "",
+		"reserve.create":                   "POST /api/users/:user_id/reserve",
+		"reserve.allocation_mode":          "reserve.create",
+		"allocator.allocate":               "reserve.create",
+		"upstream.post":                    "allocator.allocate",
+	}
+	for name, parent := range parents {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("expected a %s span in:\n%s", name, traces)
+			continue
+		}
+		if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("expected %s to continue the caller's trace, got %s", name, span.TraceID)
+		}
+
+		parentID := "00f067aa0ba902b7"
+		if parent != "" {
+			parentID = spans[parent].SpanID
+		}
+		if span.ParentID != parentID {
+			t.Errorf("expected %s to be a child of %q", name, parent)
+		}
+	}
+	if spans["POST /api/users/:user_id/reserve"].Attributes["request_id"] != "req-1234" {
+		t.Errorf("expected the request ID on the root span, got %v", spans["POST /api/users/:user_id/reserve"].Attributes)
+	}
+}
+
+func TestRegistryAdmin(t *testing.T) {
+	config := reserve.NewConfig()
+	config.Concurrency.SnapshotEnabled = false
+	config.Admin.Token = "admin-secret"
+	router, _ := buildRouter(config, staticConfig(config))
+
+	req, _ := http.NewRequest("PUT", "/admin/bucket-mode", strings.NewReader(`{"paused": true}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the admin token, got %d", w.Code)
+	}
+
+	req, _ = http.NewRequest("PUT", "/admin/bucket-mode", strings.NewReader(`{"paused": true}`))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	bodyBytes, _ := json.Marshal(gin.H{
+		"external_reference": "1234",
+		"mode":               "total",
+		"reason":             "reserve_for_payment",
+		"amount":             25,
+	})
+	req, _ = http.NewRequest("POST", "/api/users/6/reserve", bytes.NewReader(bodyBytes))
+	req.Header = map[string][]string{
+		"X-Client-Id":       {"1234"},
+		"X-Idempotency-Key": {"1234"},
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var created reserve.Reserve
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if created.Diagnostics == nil || created.Diagnostics.Source != reserve.DiagnosticSources.Paused {
+		t.Errorf("expected the pause to be reported, got %s", w.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/admin/registry", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"bucket_mode_paused":true`) {
+		t.Errorf("expected the registry state, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req, _ = http.NewRequest("DELETE", "/admin/registry/6/buckets/1", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown bucket, got %d", w.Code)
+	}
+}
+
+func TestClientAuthentication(t *testing.T) {
+	config := reserve.NewConfig()
+	config.Concurrency.SnapshotEnabled = false
+	config.Auth.Enabled = true
+	config.Auth.Clients = []string{"1234:first-client-secret"}
+	router, _ := buildRouter(config, staticConfig(config))
+
+	bodyBytes, _ := json.Marshal(gin.H{
+		"external_reference": "1234",
+		"mode":               "total",
+		"reason":             "reserve_for_payment",
+		"amount":             25,
+	})
+
+	req, _ := http.NewRequest("POST", "/api/users/7/reserve", bytes.NewReader(bodyBytes))
+	req.Header = map[string][]string{
+		"X-Client-Id":       {"1234"},
+		"X-Idempotency-Key": {"1234"},
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an unauthenticated client, got %d", w.Code)
+	}
+
+	req, _ = http.NewRequest("POST", "/api/users/7/reserve?client.id=5678", bytes.NewReader(bodyBytes))
+	req.Header = map[string][]string{
+		"X-Api-Key":         {"first-client-secret"},
+		"X-Idempotency-Key": {"1234"},
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 when reserving for another client, got %d", w.Code)
+	}
+
+	req, _ = http.NewRequest("POST", "/api/users/7/reserve", bytes.NewReader(bodyBytes))
+	req.Header = map[string][]string{
+		"X-Api-Key":         {"first-client-secret"},
+		"X-Idempotency-Key": {"1234"},
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	router, _ := buildRouter(reserve.NewConfig(), staticConfig(reserve.NewConfig()))
+	document := openapi.NewDocument()
+
+	routes := map[string]bool{}
+	for _, route := range router.Routes() {
+		if _, ok := document.Operation(route.Method, route.Path); !ok {
+			t.Errorf("%s %s is not documented", route.Method, route.Path)
+		}
+		routes[route.Method+" "+strings.NewReplacer("{", ":", "}", "").Replace(route.Path)] = true
+	}
+	for path, item := range document.Paths {
+		for method := range item {
+			route := strings.ToUpper(method) + " " + strings.NewReplacer("{", ":", "}", "").Replace(path)
+			if !routes[route] {
+				t.Errorf("%s is documented but not routed", route)
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	var served openapi.Document
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected the document to be served, got %d %v", w.Code, err)
+	}
+	if served.OpenAPI != "3.0.3" || len(served.Paths) != len(document.Paths) {
+		t.Errorf("unexpected document %s %d", served.OpenAPI, len(served.Paths))
+	}
+}
+
+func TestAdminRoutesRequireTheToken(t *testing.T) {
+	config := reserve.NewConfig()
+	config.Admin.Token = "admin-secret"
+	router, _ := buildRouter(config, staticConfig(config))
+
+	for _, path := range []string{"/admin/heat", "/admin/exposure", "/admin/stats/registry", "/admin/overrides", "/admin/usage", "/admin/cluster"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401 without the admin token, got %d", path, w.Code)
+		}
+
+		req, _ = http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200 with the admin token, got %d: %s", path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestSignedRequestsCannotBeReplayedThroughAnotherPeer(t *testing.T) {
+	servers := make([]*httptest.Server, 2)
+	peers := make([]string, len(servers))
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		peers[i] = "http://" + servers[i].Listener.Addr().String()
+	}
+	for i, server := range servers {
+		config := reserve.NewConfig()
+		config.Cluster.Enabled = true
+		config.Cluster.Self = peers[i]
+		config.Cluster.Peers = peers
+		config.Cluster.Secret = "cluster-secret"
+		config.Auth.Enabled = true
+		config.Auth.Clients = []string{"1234:first-client-secret"}
+
+		server.Config.Handler, _ = buildRouter(config, staticConfig(config))
+		server.Start()
+		defer server.Close()
+	}
+
+	bodyBytes, _ := json.Marshal(gin.H{
+		"external_reference": "1234",
+		"mode":               "total",
+		"reason":             "reserve_for_payment",
+		"amount":             25,
+	})
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := auth.Sign([]byte("first-client-secret"), "POST", "/api/users/8/reserve", "", timestamp, "nonce-1", bodyBytes)
+	reserveOn := func(peer string) int {
+		req, _ := http.NewRequest("POST", peer+"/api/users/8/reserve", bytes.NewReader(bodyBytes))
+		req.Header.Set("X-Client-Id", "1234")
+		req.Header.Set("X-Timestamp", timestamp)
+		req.Header.Set("X-Nonce", "nonce-1")
+		req.Header.Set("X-Signature", hex.EncodeToString(signature))
+		req.Header.Set("X-Idempotency-Key", "1234")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	if status := reserveOn(peers[0]); status != http.StatusOK {
+		t.Fatalf("expected 200 for a signed request, got %d", status)
+	}
+	if status := reserveOn(peers[1]); status != http.StatusUnauthorized {
+		t.Fatalf("expected the replay through another peer to be refused by the owner, got %d", status)
+	}
+}
+
+func TestAllocationFailure(t *testing.T) {
+	config := reserve.NewConfig()
+	config.Upstream.AllocationFailurePercentage = 100
+	router, _ := buildRouter(config, staticConfig(config))
+
+	bodyBytes, _ := json.Marshal(gin.H{
+		"external_reference": "1234",
+		"mode":               "total",
+		"reason":             "reserve_for_payment",
+		"amount":             25,
+	})
+	req, _ := http.NewRequest("POST", "/api/users/9/reserve", bytes.NewReader(bodyBytes))
+	req.Header = map[string][]string{
+		"X-Client-Id":       {"1234"},
+		"X-Idempotency-Key": {"1234"},
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusBadRequest || body["code"] != "allocation_failed" || body["message"] != "generic error" || len(body) != 2 {
+		t.Fatalf("expected a 400 allocation_failed error, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestBucketAllocationFailure(t *testing.T) {
+	config := reserve.NewConfig()
+	config.Admin.Token = "admin-secret"
+	config.Upstream.AllocationFailurePercentage = 100
+	router, _ := buildRouter(config, staticConfig(config))
+
+	overrideBytes, _ := json.Marshal(gin.H{"mode": "bucket", "reason": "bucket failure test"})
+	req, _ := http.NewRequest("PUT", "/admin/overrides/10", bytes.NewReader(overrideBytes))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 setting the override, got %d: %s", w.Code, w.Body.String())
+	}
+
+	bodyBytes, _ := json.Marshal(gin.H{
+		"external_reference": "1234",
+		"mode":               "total",
+		"reason":             "reserve_for_payment",
+		"amount":             25,
+	})
+	req, _ = http.NewRequest("POST", "/api/users/10/reserve", bytes.NewReader(bodyBytes))
+	req.Header = map[string][]string{
+		"X-Client-Id":       {"1234"},
+		"X-Idempotency-Key": {"1234"},
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusBadRequest || body["code"] != "allocation_failed" || body["message"] != "generic error" {
+		t.Fatalf("expected a 400 allocation_failed error from the bucket path, got %d: %s", w.Code, w.Body.String())
+	}
+}
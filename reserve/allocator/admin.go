@@ -0,0 +1,260 @@
+package allocator
+
+import (
+	"github.com/emirpasic/gods/maps/treebidimap"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"reserve/reserve"
+	"reserve/reserve/logger"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type BucketURI struct {
+	UserID    uint64 `uri:"user_id" binding:"required"`
+	ReserveID int64  `uri:"reserve_id" binding:"required"`
+}
+
+type BucketModeBody struct {
+	Paused *bool `json:"paused" binding:"required"`
+}
+
+// BucketState is a bucket held in the registry. It expires once it has been
+// stored for the reserve lifetime; a split stores it again.
+type BucketState struct {
+	ID          int64     `json:"id"`
+	ClientID    string    `json:"client_id"`
+	Amount      int64     `json:"amount"`
+	StoredAt    time.Time `json:"stored_at"`
+	AgeMs       int64     `json:"age_ms"`
+	RemainingMs int64     `json:"remaining_ms"`
+}
+
+type UserState struct {
+	UserID  uint64        `json:"user_id"`
+	Amount  int64         `json:"amount"`
+	Buckets []BucketState `json:"buckets"`
+}
+
+type RegistryState struct {
+	BucketModePaused bool        `json:"bucket_mode_paused"`
+	Users            []UserState `json:"users"`
+}
+
+type Released struct {
+	Users   int `json:"users"`
+	Buckets int `json:"buckets"`
+}
+
+// PauseBucketMode makes every allocation standalone while paused. Buckets
+// already held are kept until they expire or are released.
+func (s *Service) PauseBucketMode(paused bool) {
+	var value int32
+	if paused {
+		value = 1
+	}
+	atomic.StoreInt32(s.paused, value)
+}
+
+func (s *Service) BucketModePaused() bool {
+	return atomic.LoadInt32(s.paused) == 1
+}
+
+// ReleaseUser releases every bucket of userID upstream and returns how many
+// there were.
+func (s *Service) ReleaseUser(userID uint64) int {
+	released := s.registry.Release(userID)
+	bucketsReleased.With(releaseReasons.Admin).Add(float64(released))
+
+	return released
+}
+
+// ReleaseBucket releases the bucket reserveID of userID upstream, reporting
+// whether the user held it.
+func (s *Service) ReleaseBucket(userID uint64, reserveID int64) bool {
+	found := false
+	s.registry.LoadAndStore(userID, func(reserves treebidimap.Map) treebidimap.Map {
+		for _, key := range reserves.Keys() {
+			value, _ := reserves.Get(key)
+			bucket, ok := value.(reserve.Reserve)
+			if !ok || bucket.ID != reserveID {
+				continue
+			}
+
+			s.client.ReleaseReserve(bucket.ID)
+			bucketsReleased.With(releaseReasons.Admin).Inc()
+			reserves.Remove(key)
+			found = true
+			break
+		}
+
+		return reserves
+	})
+
+	return found
+}
+
+// Flush releases the buckets of every user. Prewarms in flight are waited
+// for, and none begins until it returns, so that none stores a bucket
+// afterwards.
+func (s *Service) Flush() Released {
+	if s.prewarmer != nil {
+		defer s.prewarmer.drain()()
+	}
+
+	var released Released
+	for _, userID := range s.registry.Keys() {
+		if buckets := s.ReleaseUser(userID); buckets > 0 {
+			released.Users++
+			released.Buckets += buckets
+		}
+	}
+
+	return released
+}
+
+func (s *Service) UserState(userID uint64) UserState {
+	reserveLifetime := s.tune().reserveLifetime
+	now := time.Now()
+
+	state := UserState{
+		UserID:  userID,
+		Buckets: []BucketState{},
+	}
+	reserves, found, _ := s.registry.Load(userID)
+	if !found {
+		return state
+	}
+	for _, key := range reserves.Keys() {
+		storedAt, ok := key.(time.Time)
+		if !ok {
+			continue
+		}
+		value, _ := reserves.Get(key)
+		bucket, ok := value.(reserve.Reserve)
+		if !ok {
+			continue
+		}
+
+		remaining := storedAt.Add(reserveLifetime).Sub(now)
+		if remaining < 0 {
+			remaining = 0
+		}
+		state.Amount += bucket.Amount
+		state.Buckets = append(state.Buckets, BucketState{
+			ID:          bucket.ID,
+			ClientID:    bucket.ClientID,
+			Amount:      bucket.Amount,
+			StoredAt:    storedAt,
+			AgeMs:       now.Sub(storedAt).Milliseconds(),
+			RemainingMs: remaining.Milliseconds(),
+		})
+	}
+
+	return state
+}
+
+func (s *Service) RegistryState() RegistryState {
+	keys := s.registry.Keys()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+
+	state := RegistryState{
+		BucketModePaused: s.BucketModePaused(),
+		Users:            []UserState{},
+	}
+	for _, userID := range keys {
+		if user := s.UserState(userID); len(user.Buckets) > 0 {
+			state.Users = append(state.Users, user)
+		}
+	}
+
+	return state
+}
+
+func (s *Service) HandleRegistryStateRequest(c *gin.Context) {
+	c.JSON(http.StatusOK, s.RegistryState())
+	return
+}
+
+func (s *Service) HandleUserStateRequest(c *gin.Context) {
+	var uri reserve.CreateURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid uri!",
+			"code":    "invalid_uri",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.UserState(uri.UserID))
+	return
+}
+
+func (s *Service) HandleReleaseUser(c *gin.Context) {
+	var uri reserve.CreateURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid uri!",
+			"code":    "invalid_uri",
+		})
+		return
+	}
+
+	buckets := s.ReleaseUser(uri.UserID)
+	released := Released{Buckets: buckets}
+	if buckets > 0 {
+		released.Users = 1
+	}
+
+	c.JSON(http.StatusOK, released)
+	return
+}
+
+func (s *Service) HandleReleaseBucket(c *gin.Context) {
+	var uri BucketURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid uri!",
+			"code":    "invalid_uri",
+		})
+		return
+	}
+
+	if !s.ReleaseBucket(uri.UserID, uri.ReserveID) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"message": "Bucket not found",
+			"code":    "bucket_not_found",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+	return
+}
+
+func (s *Service) HandleFlush(c *gin.Context) {
+	c.JSON(http.StatusOK, s.Flush())
+	return
+}
+
+func (s *Service) HandleBucketMode(c *gin.Context) {
+	var body BucketModeBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid body!",
+			"code":    "invalid_body",
+		})
+		return
+	}
+
+	s.PauseBucketMode(*body.Paused)
+	s.logger.Warn("bucket mode toggled", "request_id", logger.RequestID(c), "paused", *body.Paused)
+
+	c.JSON(http.StatusOK, gin.H{
+		"bucket_mode_paused": s.BucketModePaused(),
+	})
+	return
+}
@@ -0,0 +1,76 @@
+package allocator
+
+import (
+	"reserve/reserve"
+	"reserve/reserve/balance"
+	"reserve/reserve/logger"
+	"testing"
+)
+
+func TestRegistryAdministration(t *testing.T) {
+	config := reserve.NewConfig().Allocator
+	config.Prewarm = false
+	s := NewService(config, reserve.NewConfig().Upstream, balance.NewMemory(100000000), logger.Discard())
+
+	for _, userID := range []uint64{1, 2} {
+		request := reserve.ReserveRequest{
+			UserID:   userID,
+			ClientID: "1234",
+			Body: reserve.Body{
+				Amount: 2500,
+				Mode:   reserve.Modes.Total,
+				Reason: reserve.Reasons.ReserveForPayment,
+			},
+		}
+		if _, err := s.AllocateReserve(request, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state := s.RegistryState()
+	if len(state.Users) != 2 || len(state.Users[0].Buckets) != 1 {
+		t.Fatalf("expected one bucket for each of 2 users, got %+v", state)
+	}
+	bucket := state.Users[0].Buckets[0]
+	if bucket.RemainingMs <= 0 || bucket.Amount != state.Users[0].Amount {
+		t.Errorf("unexpected bucket state %+v", bucket)
+	}
+
+	if s.ReleaseBucket(1, bucket.ID+1000) {
+		t.Error("expected an unknown bucket not to be released")
+	}
+	if !s.ReleaseBucket(1, bucket.ID) {
+		t.Error("expected the bucket to be released")
+	}
+	if buckets := s.UserState(1).Buckets; len(buckets) != 0 {
+		t.Errorf("expected no bucket left, got %+v", buckets)
+	}
+	if s.exposure.Global() != s.registry.Totals().Amount {
+		t.Errorf("expected the exposure to follow the registry, got %d", s.exposure.Global())
+	}
+
+	if released := s.Flush(); released.Users != 1 || released.Buckets != 1 {
+		t.Errorf("expected 1 bucket of 1 user flushed, got %+v", released)
+	}
+	if s.exposure.Global() != 0 {
+		t.Errorf("expected no exposure left, got %d", s.exposure.Global())
+	}
+
+	s.PauseBucketMode(true)
+	request := reserve.ReserveRequest{
+		UserID:   3,
+		ClientID: "1234",
+		Body: reserve.Body{
+			Amount: 2500,
+			Mode:   reserve.Modes.Total,
+			Reason: reserve.Reasons.ReserveForPayment,
+		},
+	}
+	allocated, err := s.AllocateReserve(request, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocated.Version == nil || *allocated.Version != "standalone" || len(s.UserState(3).Buckets) != 0 {
+		t.Errorf("expected a standalone reserve while bucket mode is paused, got %+v", allocated)
+	}
+}
@@ -12,36 +12,60 @@ var db DB
 
 func init() {
 	db = DB{
-		reserves:     map[int64]reserve.Reserve{},
-		mu:           sync.Mutex{},
-		splitDelay:   35 * time.Millisecond,
-		reserveDelay: 70 * time.Millisecond,
+		reserves: map[int64]reserve.Reserve{},
+		mu:       sync.Mutex{},
 	}
 }
 
 type client struct {
 	percentageSplitFailure      int
 	percentageAllocationFailure int
+	splitDelay                  time.Duration
+	reserveDelay                time.Duration
+	errors                      *errorWindow
 }
 
-func newClient() client {
-	return client{0, 0}
+func newClient(config reserve.UpstreamConfig) client {
+	return client{
+		config.SplitFailurePercentage,
+		config.AllocationFailurePercentage,
+		config.SplitDelay,
+		config.ReserveDelay,
+		newErrorWindow(upstreamErrorWindow),
+	}
+}
+
+func (c *client) observe(operation string, start time.Time, err error) {
+	observeUpstream(operation, start, err)
+	c.errors.observe(err)
 }
 
 func (c *client) ListReservesForUser(userID uint64) []reserve.Reserve {
+	defer c.observe("list", time.Now(), nil)
+
 	return db.List(userID)
 }
 
 func (c *client) ReleaseReserve(reserveID int64) {
+	defer c.observe("release", time.Now(), nil)
+
 	db.Release(reserveID)
 
 	return
 }
 
-func (c *client) PostReserve(request reserve.ReserveRequest, factor int) (reserve.Reserve, error) {
-	if rand.Intn(101) > c.percentageAllocationFailure {
+func (c *client) PostReserve(request reserve.ReserveRequest, factor int) (_ reserve.Reserve, err error) {
+	span := request.Trace.StartChild("upstream.post")
+	span.SetAttribute("amount", request.Body.Amount)
+	defer func(start time.Time) {
+		c.observe("post", start, err)
+		span.SetError(err)
+		span.Finish()
+	}(time.Now())
+
+	if rand.Intn(100) >= c.percentageAllocationFailure {
 		request.Body.Amount = request.Body.Amount / 100 * int64(factor)
-		newReserve, err := db.Insert(request)
+		newReserve, err := db.Insert(request, c.reserveDelay)
 		newReserve.Amount = newReserve.Amount * 100
 
 		return newReserve, err
@@ -55,9 +79,17 @@ func (c *client) SplitReserve(
 ) (
 	newParentReserve reserve.Reserve, newSplittedReserve reserve.Reserve, err error,
 ) {
+	span := request.Trace.StartChild("upstream.split")
+	span.SetAttribute("reserve_id", toSplitReserveID)
+	defer func(start time.Time) {
+		c.observe("split", start, err)
+		span.SetError(err)
+		span.Finish()
+	}(time.Now())
+
 	request.Body.Amount = request.Body.Amount / 100
-	if rand.Intn(101) > c.percentageSplitFailure {
-		newOriginal, newSplitted, err := db.Split(request, toSplitReserveID)
+	if rand.Intn(100) >= c.percentageSplitFailure {
+		newOriginal, newSplitted, err := db.Split(request, toSplitReserveID, c.splitDelay)
 		newOriginal.Amount = newOriginal.Amount * 100
 		newSplitted.Amount = newSplitted.Amount * 100
 
@@ -67,3 +99,36 @@ func (c *client) SplitReserve(
 	return reserve.Reserve{}, reserve.Reserve{}, errors.New("generic error")
 
 }
+
+func (c *client) MultiSplitReserve(
+	requests []reserve.ReserveRequest, toSplitReserveID int64,
+) (
+	newParentReserve reserve.Reserve, newSplittedReserves []reserve.Reserve, err error,
+) {
+	span := requests[0].Trace.StartChild("upstream.multi_split")
+	span.SetAttribute("reserve_id", toSplitReserveID)
+	span.SetAttribute("batch_size", len(requests))
+	defer func(start time.Time) {
+		c.observe("multi_split", start, err)
+		span.SetError(err)
+		span.Finish()
+	}(time.Now())
+
+	scaledRequests := make([]reserve.ReserveRequest, len(requests))
+	for i, request := range requests {
+		request.Body.Amount = request.Body.Amount / 100
+		scaledRequests[i] = request
+	}
+
+	if rand.Intn(100) >= c.percentageSplitFailure {
+		newOriginal, newSplitted, err := db.MultiSplit(scaledRequests, toSplitReserveID, c.splitDelay)
+		newOriginal.Amount = newOriginal.Amount * 100
+		for i := range newSplitted {
+			newSplitted[i].Amount = newSplitted[i].Amount * 100
+		}
+
+		return newOriginal, newSplitted, err
+	}
+
+	return reserve.Reserve{}, nil, errors.New("generic error")
+}
@@ -0,0 +1,117 @@
+package allocator
+
+import (
+	"errors"
+	"fmt"
+	"reserve/reserve"
+	"reserve/reserve/logger"
+	"sync"
+	"time"
+)
+
+var (
+	FlushFailedError = errors.New("coalesced allocation failed")
+)
+
+type allocation struct {
+	reserve reserve.Reserve
+	path    string
+	err     error
+}
+
+// batchKey groups requests by client as well as by user, since the bucket a
+// batch posts is charged to a single client's exposure.
+type batchKey struct {
+	userID   uint64
+	clientID string
+}
+
+type batch struct {
+	requests []reserve.ReserveRequest
+	waiters  []chan allocation
+}
+
+// coalescer groups the requests of a user and client that arrive within window
+// (or until maxBatch of them are waiting) so they can be served by a single
+// upstream operation.
+type coalescer struct {
+	mu       sync.Mutex
+	batches  map[batchKey]*batch
+	window   time.Duration
+	maxBatch int
+	flush    func(userID uint64, requests []reserve.ReserveRequest) []allocation
+	logger   *logger.Logger
+}
+
+func newCoalescer(
+	window time.Duration,
+	maxBatch int,
+	flush func(userID uint64, requests []reserve.ReserveRequest) []allocation,
+	logger *logger.Logger,
+) *coalescer {
+	return &coalescer{
+		batches:  map[batchKey]*batch{},
+		window:   window,
+		maxBatch: maxBatch,
+		flush:    flush,
+		logger:   logger,
+	}
+}
+
+func (c *coalescer) Allocate(request reserve.ReserveRequest) (reserve.Reserve, string, error) {
+	waiter := make(chan allocation, 1)
+	span := request.Trace.StartChild("coalescer.wait")
+	defer span.Finish()
+
+	key := batchKey{request.UserID, request.ClientID}
+	c.mu.Lock()
+	b, ok := c.batches[key]
+	if !ok {
+		b = &batch{}
+		c.batches[key] = b
+		time.AfterFunc(c.window, func() {
+			c.run(key, b)
+		})
+	}
+	b.requests = append(b.requests, request)
+	b.waiters = append(b.waiters, waiter)
+	full := c.maxBatch > 0 && len(b.requests) >= c.maxBatch
+	c.mu.Unlock()
+
+	if full {
+		c.run(key, b)
+	}
+
+	result := <-waiter
+	span.SetAttribute("batch_size", len(b.requests))
+	return result.reserve, result.path, result.err
+}
+
+// run flushes b unless the window timer or a full batch already did.
+func (c *coalescer) run(key batchKey, b *batch) {
+	c.mu.Lock()
+	if c.batches[key] != b {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.batches, key)
+	c.mu.Unlock()
+
+	// a flush that panics or returns too few results must not leave waiters
+	// blocked forever
+	delivered := 0
+	defer func() {
+		if r := recover(); r != nil {
+			c.logger.Error("coalesced flush panicked", "user_id", key.userID, "client_id", key.clientID, "panic", fmt.Sprint(r))
+		}
+		for _, waiter := range b.waiters[delivered:] {
+			waiter <- allocation{err: FlushFailedError}
+		}
+	}()
+
+	results := c.flush(key.userID, b.requests)
+	for delivered < len(b.waiters) && delivered < len(results) {
+		b.waiters[delivered] <- results[delivered]
+		delivered++
+	}
+}
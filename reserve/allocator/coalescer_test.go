@@ -0,0 +1,147 @@
+package allocator
+
+import (
+	"bytes"
+	"reserve/reserve"
+	"reserve/reserve/balance"
+	"reserve/reserve/logger"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescerFansOutOneFlush(t *testing.T) {
+	var flushes int32
+	c := newCoalescer(50*time.Millisecond, 0, func(userID uint64, requests []reserve.ReserveRequest) []allocation {
+		atomic.AddInt32(&flushes, 1)
+
+		allocations := make([]allocation, len(requests))
+		for i, request := range requests {
+			allocations[i] = allocation{reserve: reserve.Reserve{UserID: userID, Amount: request.Body.Amount}}
+		}
+		return allocations
+	}, logger.Discard())
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 5; i++ {
+		wg.Add(1)
+		go func(amount int64) {
+			defer wg.Done()
+			allocated, _, err := c.Allocate(reserve.ReserveRequest{UserID: 1, Body: reserve.Body{Amount: amount}})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if allocated.Amount != amount {
+				t.Errorf("expected amount %d, got %d", amount, allocated.Amount)
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+
+	if flushes != 1 {
+		t.Fatalf("expected a single flush, got %d", flushes)
+	}
+}
+
+func TestCoalescerFlushesFullBatchEarly(t *testing.T) {
+	var sizes []int
+	var mu sync.Mutex
+	c := newCoalescer(time.Hour, 2, func(userID uint64, requests []reserve.ReserveRequest) []allocation {
+		mu.Lock()
+		sizes = append(sizes, len(requests))
+		mu.Unlock()
+		return make([]allocation, len(requests))
+	}, logger.Discard())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Allocate(reserve.ReserveRequest{UserID: 1})
+		}()
+	}
+	wg.Wait()
+
+	if len(sizes) != 2 || sizes[0] != 2 || sizes[1] != 2 {
+		t.Fatalf("expected two batches of two, got %v", sizes)
+	}
+}
+
+func TestCoalescerReleasesWaitersWhenFlushPanics(t *testing.T) {
+	var logs bytes.Buffer
+	flushLogger, _ := logger.New(&logs, "info", "json")
+	c := newCoalescer(10*time.Millisecond, 0, func(userID uint64, requests []reserve.ReserveRequest) []allocation {
+		panic("upstream client bug")
+	}, flushLogger)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := c.Allocate(reserve.ReserveRequest{UserID: 1}); err != FlushFailedError {
+				t.Errorf("expected FlushFailedError, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !strings.Contains(logs.String(), "coalesced flush panicked") || !strings.Contains(logs.String(), "upstream client bug") {
+		t.Errorf("expected the panic to be logged, got %q", logs.String())
+	}
+}
+
+func TestCoalescedBucketsAreChargedToTheirClient(t *testing.T) {
+	config := reserve.NewConfig().Allocator
+	config.CoalesceWindow = 50 * time.Millisecond
+	config.MaxClientExposure = 1000
+	s := NewService(config, reserve.NewConfig().Upstream, balance.NewMemory(100000000), logger.Discard())
+	if !s.exposure.TryAcquire(99, "capped", 1000) {
+		t.Fatal("could not bring the client to its cap")
+	}
+
+	allocate := func(clientID string) reserve.Reserve {
+		allocated, err := s.AllocateReserve(reserve.ReserveRequest{
+			UserID:   7,
+			ClientID: clientID,
+			Body: reserve.Body{
+				Amount: 50,
+				Mode:   reserve.Modes.Total,
+				Reason: reserve.Reasons.ReserveForPayment,
+			},
+		}, true)
+		if err != nil {
+			t.Error(err)
+		}
+		return allocated
+	}
+
+	var wg sync.WaitGroup
+	var open reserve.Reserve
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		allocate("capped")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		defer wg.Done()
+		open = allocate("open")
+	}()
+	wg.Wait()
+
+	if open.Version == nil || *open.Version != "splitted" {
+		t.Errorf("expected the client under its cap to be served from a bucket, got %+v", open)
+	}
+	exposure := s.exposure.Snapshot()
+	if exposure.Clients["capped"] != 1000 {
+		t.Errorf("expected the capped client not to be charged, got %d", exposure.Clients["capped"])
+	}
+	if exposure.Clients["open"] == 0 {
+		t.Error("expected the bucket to be charged to the client that posted it")
+	}
+}
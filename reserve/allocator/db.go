@@ -9,10 +9,8 @@ import (
 )
 
 type DB struct {
-	reserves     map[int64]reserve.Reserve
-	mu           sync.Mutex
-	splitDelay   time.Duration
-	reserveDelay time.Duration
+	reserves map[int64]reserve.Reserve
+	mu       sync.Mutex
 }
 
 func (db *DB) List(userID uint64) []reserve.Reserve {
@@ -46,10 +44,10 @@ func (db *DB) Release(reserveID int64) {
 	return
 }
 
-func (db *DB) Insert(request reserve.ReserveRequest) (reserve.Reserve, error) {
+func (db *DB) Insert(request reserve.ReserveRequest, delay time.Duration) (reserve.Reserve, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	time.Sleep(db.reserveDelay)
+	time.Sleep(delay)
 
 	ID := rand.Int63n(1000000)
 
@@ -73,26 +71,40 @@ func (db *DB) Insert(request reserve.ReserveRequest) (reserve.Reserve, error) {
 	return db.reserves[ID], nil
 }
 
-func (db *DB) Split(request reserve.ReserveRequest, toSplitReserveID int64) (reserve.Reserve, reserve.Reserve, error) {
+func (db *DB) Split(request reserve.ReserveRequest, toSplitReserveID int64, delay time.Duration) (reserve.Reserve, reserve.Reserve, error) {
+	newParentReserve, newSplittedReserves, err := db.MultiSplit([]reserve.ReserveRequest{request}, toSplitReserveID, delay)
+	if err != nil {
+		return reserve.Reserve{}, reserve.Reserve{}, err
+	}
+
+	return newParentReserve, newSplittedReserves[0], nil
+}
+
+// MultiSplit carves one reserve per request out of toSplitReserveID in a
+// single operation, leaving the rest in a new parent reserve.
+func (db *DB) MultiSplit(requests []reserve.ReserveRequest, toSplitReserveID int64, delay time.Duration) (reserve.Reserve, []reserve.Reserve, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	time.Sleep(db.splitDelay)
+	time.Sleep(delay)
 
-	// request reserve.ReserveRequest, toSplitReserveID int64,
 	originalReserve, ok := db.reserves[toSplitReserveID]
 	if !ok {
-		return reserve.Reserve{}, reserve.Reserve{}, errors.New("could not find reserve to split")
+		return reserve.Reserve{}, nil, errors.New("could not find reserve to split")
+	}
+
+	var requestedAmount int64
+	for _, request := range requests {
+		requestedAmount += request.Body.Amount
 	}
 
-	if originalReserve.Amount <= request.Body.Amount {
-		return reserve.Reserve{}, reserve.Reserve{}, errors.New("could not split reserve")
+	if originalReserve.Amount <= requestedAmount {
+		return reserve.Reserve{}, nil, errors.New("could not split reserve")
 	}
 
 	originalReserve.Status = "released"
 	db.reserves[toSplitReserveID] = originalReserve
 
 	newParentReserveID := rand.Int63n(1000000)
-	newSplittedReserveID := rand.Int63n(1000000)
 
 	var version = "splitted_rest"
 	newParentReserve := reserve.Reserve{
@@ -103,32 +115,38 @@ func (db *DB) Split(request reserve.ReserveRequest, toSplitReserveID int64) (res
 		IdempotencyKey:    originalReserve.IdempotencyKey,
 		Reason:            originalReserve.Reason,
 		Mode:              originalReserve.Mode,
-		Amount:            originalReserve.Amount - request.Body.Amount,
-		ClientID:          request.ClientID,
-		UserID:            request.UserID,
+		Amount:            originalReserve.Amount - requestedAmount,
+		ClientID:          originalReserve.ClientID,
+		UserID:            originalReserve.UserID,
 		Status:            "reserved",
 		DateCreated:       time.Now().String(),
 		LastModified:      time.Now().String(),
 	}
 	db.reserves[newParentReserveID] = newParentReserve
 
-	var versionS = "splitted"
-	newSplittedReserve := reserve.Reserve{
-		ID:                newSplittedReserveID,
-		Version:           &versionS,
-		TTL:               nil,
-		ExternalReference: request.Body.ExternalReference,
-		IdempotencyKey:    request.IdempotencyKey,
-		Reason:            request.Body.Reason,
-		Mode:              request.Body.Mode,
-		Amount:            request.Body.Amount,
-		ClientID:          request.ClientID,
-		UserID:            request.UserID,
-		Status:            "reserved",
-		DateCreated:       time.Now().String(),
-		LastModified:      time.Now().String(),
+	newSplittedReserves := make([]reserve.Reserve, 0, len(requests))
+	for _, request := range requests {
+		newSplittedReserveID := rand.Int63n(1000000)
+
+		var versionS = "splitted"
+		newSplittedReserve := reserve.Reserve{
+			ID:                newSplittedReserveID,
+			Version:           &versionS,
+			TTL:               nil,
+			ExternalReference: request.Body.ExternalReference,
+			IdempotencyKey:    request.IdempotencyKey,
+			Reason:            request.Body.Reason,
+			Mode:              request.Body.Mode,
+			Amount:            request.Body.Amount,
+			ClientID:          request.ClientID,
+			UserID:            request.UserID,
+			Status:            "reserved",
+			DateCreated:       time.Now().String(),
+			LastModified:      time.Now().String(),
+		}
+		db.reserves[newSplittedReserveID] = newSplittedReserve
+		newSplittedReserves = append(newSplittedReserves, newSplittedReserve)
 	}
-	db.reserves[newSplittedReserveID] = newSplittedReserve
 
-	return newParentReserve, newSplittedReserve, nil
+	return newParentReserve, newSplittedReserves, nil
 }
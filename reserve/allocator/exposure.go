@@ -0,0 +1,150 @@
+package allocator
+
+import (
+	"github.com/emirpasic/gods/maps/treebidimap"
+	"reserve/reserve"
+	"sync"
+)
+
+// exposure accounts for the amount locked in overshoot buckets per user, per
+// client and for the whole process. Buckets being posted are acquired up
+// front so concurrent allocations cannot jointly overshoot a cap.
+type exposure struct {
+	mu        sync.Mutex
+	users     map[uint64]int64
+	clients   map[string]int64
+	global    int64
+	maxUser   int64
+	maxClient int64
+	maxGlobal int64
+}
+
+type Exposure struct {
+	Global  int64            `json:"global"`
+	Clients map[string]int64 `json:"clients"`
+	Users   map[uint64]int64 `json:"users"`
+	Limits  ExposureLimits   `json:"limits"`
+}
+
+type ExposureLimits struct {
+	User   int64 `json:"user"`
+	Client int64 `json:"client"`
+	Global int64 `json:"global"`
+}
+
+func newExposure(config reserve.AllocatorConfig) *exposure {
+	return &exposure{
+		users:     map[uint64]int64{},
+		clients:   map[string]int64{},
+		maxUser:   config.MaxUserExposure,
+		maxClient: config.MaxClientExposure,
+		maxGlobal: config.MaxGlobalExposure,
+	}
+}
+
+// SetLimits replaces the caps. Amounts already booked are kept, even above
+// lowered caps, and released as usual.
+func (e *exposure) SetLimits(config reserve.AllocatorConfig) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.maxUser = config.MaxUserExposure
+	e.maxClient = config.MaxClientExposure
+	e.maxGlobal = config.MaxGlobalExposure
+}
+
+// TryAcquire books amount against every cap, failing without side effects
+// when any of them would be exceeded. A cap of zero means unlimited.
+func (e *exposure) TryAcquire(userID uint64, clientID string, amount int64) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if exceeds(e.users[userID]+amount, e.maxUser) ||
+		exceeds(e.clients[clientID]+amount, e.maxClient) ||
+		exceeds(e.global+amount, e.maxGlobal) {
+		return false
+	}
+
+	e.add(userID, clientID, amount)
+	return true
+}
+
+func (e *exposure) Release(userID uint64, clientID string, amount int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.add(userID, clientID, -amount)
+}
+
+// Update replaces the contribution of a user's buckets once they changed.
+func (e *exposure) Update(userID uint64, before, after map[string]int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for clientID, amount := range before {
+		e.add(userID, clientID, -amount)
+	}
+	for clientID, amount := range after {
+		e.add(userID, clientID, amount)
+	}
+}
+
+func (e *exposure) add(userID uint64, clientID string, amount int64) {
+	e.global += amount
+
+	e.users[userID] += amount
+	if e.users[userID] == 0 {
+		delete(e.users, userID)
+	}
+
+	e.clients[clientID] += amount
+	if e.clients[clientID] == 0 {
+		delete(e.clients, clientID)
+	}
+}
+
+func (e *exposure) Global() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.global
+}
+
+func (e *exposure) Snapshot() Exposure {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	snapshot := Exposure{
+		Global:  e.global,
+		Clients: make(map[string]int64, len(e.clients)),
+		Users:   make(map[uint64]int64, len(e.users)),
+		Limits: ExposureLimits{
+			User:   e.maxUser,
+			Client: e.maxClient,
+			Global: e.maxGlobal,
+		},
+	}
+	for clientID, amount := range e.clients {
+		snapshot.Clients[clientID] = amount
+	}
+	for userID, amount := range e.users {
+		snapshot.Users[userID] = amount
+	}
+
+	return snapshot
+}
+
+func exceeds(amount, limit int64) bool {
+	return limit > 0 && amount > limit
+}
+
+func amountsByClient(reserves treebidimap.Map) map[string]int64 {
+	amounts := map[string]int64{}
+	for _, value := range reserves.Values() {
+		if bucket, ok := value.(reserve.Reserve); ok {
+			amounts[bucket.ClientID] += bucket.Amount
+		}
+	}
+
+	return amounts
+}
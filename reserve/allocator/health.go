@@ -0,0 +1,93 @@
+package allocator
+
+import (
+	"sync"
+	"time"
+)
+
+// upstreamErrorWindow is how far back the upstream and balance provider error
+// rates look.
+const upstreamErrorWindow = 30 * time.Second
+
+// errorWindow counts upstream calls and failures over tumbling windows. The
+// rate is computed over the current window and the previous one, so it does
+// not drop to zero right after a window starts.
+type errorWindow struct {
+	mu             sync.Mutex
+	length         time.Duration
+	start          time.Time
+	calls          int64
+	errors         int64
+	previousCalls  int64
+	previousErrors int64
+}
+
+func newErrorWindow(length time.Duration) *errorWindow {
+	return &errorWindow{
+		length: length,
+		start:  time.Now(),
+	}
+}
+
+func (w *errorWindow) observe(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.roll(time.Now())
+	w.calls++
+	if err != nil {
+		w.errors++
+	}
+}
+
+func (w *errorWindow) rate() (int64, float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.roll(time.Now())
+	calls := w.calls + w.previousCalls
+	if calls == 0 {
+		return 0, 0
+	}
+
+	return calls, float64(w.errors+w.previousErrors) / float64(calls)
+}
+
+func (w *errorWindow) roll(now time.Time) {
+	elapsed := now.Sub(w.start)
+	if elapsed < w.length {
+		return
+	}
+
+	if elapsed < 2*w.length {
+		w.previousCalls, w.previousErrors = w.calls, w.errors
+	} else {
+		w.previousCalls, w.previousErrors = 0, 0
+	}
+	w.calls, w.errors = 0, 0
+	w.start = now
+}
+
+// UpstreamErrorRate is the share of upstream calls that failed recently,
+// along with the number of calls it is computed over.
+func (s *Service) UpstreamErrorRate() (int64, float64) {
+	return s.client.errors.rate()
+}
+
+// BalanceErrorRate is the share of balance lookups that failed recently,
+// along with the number of lookups it is computed over.
+func (s *Service) BalanceErrorRate() (int64, float64) {
+	return s.balanceErrors.rate()
+}
+
+// available looks up the balance of userID, counting the failed lookups.
+func (s *Service) available(userID uint64) (int64, error) {
+	available, err := s.balance.Available(userID)
+	s.balanceErrors.observe(err)
+
+	return available, err
+}
+
+func (s *Service) RegistryStats() RegistryStats {
+	return s.registry.Stats()
+}
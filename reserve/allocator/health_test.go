@@ -0,0 +1,32 @@
+package allocator
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestErrorWindow(t *testing.T) {
+	w := newErrorWindow(time.Hour)
+	w.observe(nil)
+	w.observe(errors.New("generic error"))
+	w.observe(nil)
+	w.observe(errors.New("generic error"))
+
+	calls, rate := w.rate()
+	if calls != 4 || rate != 0.5 {
+		t.Errorf("expected 4 calls at 0.5, got %d at %v", calls, rate)
+	}
+
+	// the previous window still counts
+	w.roll(w.start.Add(time.Hour))
+	w.observe(nil)
+	if calls, _ := w.rate(); calls != 5 {
+		t.Errorf("expected 5 calls, got %d", calls)
+	}
+
+	w.roll(w.start.Add(3 * time.Hour))
+	if calls, rate := w.rate(); calls != 0 || rate != 0 {
+		t.Errorf("expected old calls to be forgotten, got %d at %v", calls, rate)
+	}
+}
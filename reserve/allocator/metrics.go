@@ -0,0 +1,105 @@
+package allocator
+
+import (
+	"reserve/reserve/metrics"
+	"time"
+)
+
+// allocationPaths label how an allocation was served.
+var allocationPaths = struct {
+	BucketSplit string
+	NewBucket   string
+	Standalone  string
+	Rejected    string
+}{
+	"bucket_split",
+	"new_bucket",
+	"standalone",
+	"rejected",
+}
+
+// releaseReasons label why a bucket was released upstream.
+var releaseReasons = struct {
+	Expired string
+	Evicted string
+	Handoff string
+	Surplus string
+	Admin   string
+}{
+	"expired",
+	"evicted",
+	"handoff",
+	"surplus",
+	"admin",
+}
+
+var (
+	allocationsTotal = metrics.NewCounterVec(
+		"reserve_allocations_total",
+		"Reserves allocated, by path and result.",
+		"path", "result",
+	)
+	allocationDuration = metrics.NewHistogramVec(
+		"reserve_allocation_duration_seconds",
+		"Time taken to allocate a reserve, by path.",
+		metrics.DefaultBuckets,
+		"path",
+	)
+	allocationRetries = metrics.NewCounterVec(
+		"reserve_allocation_retries_total",
+		"Attempts to allocate from a bucket beyond the first one.",
+	)
+	upstreamDuration = metrics.NewHistogramVec(
+		"reserve_upstream_request_duration_seconds",
+		"Latency of the calls to the reserves API, by operation.",
+		metrics.DefaultBuckets,
+		"operation",
+	)
+	upstreamErrors = metrics.NewCounterVec(
+		"reserve_upstream_errors_total",
+		"Failed calls to the reserves API, by operation.",
+		"operation",
+	)
+	bucketsReleased = metrics.NewCounterVec(
+		"reserve_buckets_released_total",
+		"Buckets released upstream, by reason.",
+		"reason",
+	)
+)
+
+func observeAllocation(path string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+
+	allocationsTotal.With(path, result).Inc()
+	allocationDuration.With(path).Observe(time.Since(start).Seconds())
+}
+
+func observeUpstream(operation string, start time.Time, err error) {
+	upstreamDuration.With(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		upstreamErrors.With(operation).Inc()
+	}
+}
+
+// RegisterMetrics exposes the size of the registry and of the exposure on
+// every scrape.
+func (s *Service) RegisterMetrics(r *metrics.Registry) {
+	r.GaugeFunc("reserve_registry_users", "Users holding buckets.", func() float64 {
+		return float64(s.registry.Totals().Users)
+	})
+	r.GaugeFunc("reserve_registry_buckets", "Buckets held in the registry.", func() float64 {
+		return float64(s.registry.Totals().Buckets)
+	})
+	r.GaugeFunc("reserve_registry_locked_amount", "Amount, in cents, left in the buckets of the registry.", func() float64 {
+		return float64(s.registry.Totals().Amount)
+	})
+	r.CounterFunc("reserve_registry_evictions_total", "Users evicted from the registry to make room.", func() float64 {
+		return float64(s.registry.Stats().Evictions)
+	})
+	r.GaugeFunc("reserve_exposure_global", "Amount, in cents, booked against the global exposure cap.", func() float64 {
+		return float64(s.exposure.Global())
+	})
+}
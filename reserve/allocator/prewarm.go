@@ -0,0 +1,207 @@
+package allocator
+
+import (
+	"github.com/emirpasic/gods/maps/treebidimap"
+	"math"
+	"reserve/reserve"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// prewarmer remembers which users have a bucket being posted in the
+// background so bursts of triggers post a single one.
+type prewarmer struct {
+	mu       sync.Mutex
+	inFlight map[uint64]bool
+	running  sync.WaitGroup
+	// draining counts the callers of drain that have not resumed yet, no
+	// prewarm begins meanwhile
+	draining int
+	// lowWaterRatio holds the float64 bits of the share of a bucket below
+	// which buckets are refilled
+	lowWaterRatio uint64
+}
+
+func newPrewarmer(lowWaterRatio float64) *prewarmer {
+	return &prewarmer{
+		inFlight:      map[uint64]bool{},
+		lowWaterRatio: math.Float64bits(lowWaterRatio),
+	}
+}
+
+// low reports whether buckets holding remaining should be refilled with a
+// bucket of bucketAmount.
+func (p *prewarmer) low(remaining, bucketAmount int64) bool {
+	ratio := math.Float64frombits(atomic.LoadUint64(&p.lowWaterRatio))
+
+	return remaining == 0 || float64(remaining) < ratio*float64(bucketAmount)
+}
+
+func (p *prewarmer) setLowWaterRatio(lowWaterRatio float64) {
+	atomic.StoreUint64(&p.lowWaterRatio, math.Float64bits(lowWaterRatio))
+}
+
+func (p *prewarmer) begin(userID uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.draining > 0 || p.inFlight[userID] {
+		return false
+	}
+	p.inFlight[userID] = true
+	p.running.Add(1)
+
+	return true
+}
+
+func (p *prewarmer) end(userID uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.inFlight, userID)
+	p.running.Done()
+}
+
+// drain waits for the prewarms in flight and keeps new ones from beginning
+// until resume is called.
+func (p *prewarmer) drain() (resume func()) {
+	p.mu.Lock()
+	p.draining++
+	p.mu.Unlock()
+
+	p.running.Wait()
+
+	return func() {
+		p.mu.Lock()
+		p.draining--
+		p.mu.Unlock()
+	}
+}
+
+// Prewarm posts, in the background, a bucket sized for request unless the
+// user's buckets still hold the low-water share of such a bucket. It is
+// called when a user enters bucket mode and when a split leaves its buckets
+// running low.
+func (s *Service) Prewarm(request reserve.ReserveRequest) {
+	if s.prewarmer == nil || s.BucketModePaused() || !s.low(s.remaining(request.UserID), request) || !s.prewarmer.begin(request.UserID) {
+		return
+	}
+
+	go func() {
+		defer s.prewarmer.end(request.UserID)
+
+		if err := s.prewarm(request); err != nil {
+			s.logger.With(request.LogFields()...).Warn("could not prewarm bucket", "error", err)
+		}
+	}()
+}
+
+// low reports whether buckets holding remaining should be refilled for
+// requests like request.
+func (s *Service) low(remaining int64, request reserve.ReserveRequest) bool {
+	return s.prewarmer.low(remaining, request.Body.Amount*int64(s.tune().overshootFactor))
+}
+
+func (s *Service) prewarm(request reserve.ReserveRequest) error {
+	if !s.low(s.remaining(request.UserID), request) {
+		return nil
+	}
+
+	available, err := s.available(request.UserID)
+	if err != nil {
+		return err
+	}
+
+	bucketAmount, ok := s.bucketAmount(request.Body.Amount, available)
+	if !ok || !s.exposure.TryAcquire(request.UserID, request.ClientID, bucketAmount) {
+		return nil
+	}
+	defer s.exposure.Release(request.UserID, request.ClientID, bucketAmount)
+
+	bucketRequest := request
+	bucketRequest.Body.Amount = bucketAmount
+
+	// a user without buckets is entering bucket mode, and the request that
+	// moved it there is about to post a bucket of its own: post under the
+	// user's lock so that only one of them is posted
+	entering := false
+	var postErr error
+	err = s.registry.LoadAndStore(request.UserID, func(reserves treebidimap.Map) treebidimap.Map {
+		if reserves.Size() > 0 {
+			return reserves
+		}
+		entering = true
+
+		newReserve, err := s.client.PostReserve(bucketRequest, 1)
+		if err != nil {
+			postErr = err
+			return reserves
+		}
+		reserves.Put(time.Now(), newReserve)
+		s.expireLater(request.UserID)
+
+		return reserves
+	})
+	if err != nil {
+		return err
+	}
+	if entering {
+		return postErr
+	}
+	if !s.low(s.remaining(request.UserID), request) {
+		return nil
+	}
+
+	// otherwise the bucket is posted without holding the user's lock,
+	// requests keep being served from the current buckets meanwhile
+	newReserve, err := s.client.PostReserve(bucketRequest, 1)
+	if err != nil {
+		return err
+	}
+
+	stored := false
+	err = s.registry.LoadAndStore(request.UserID, func(reserves treebidimap.Map) treebidimap.Map {
+		if !s.low(remainingAmount(reserves), request) {
+			return reserves
+		}
+
+		reserves.Put(time.Now(), newReserve)
+		stored = true
+
+		return reserves
+	})
+	if err != nil || !stored {
+		// someone else refilled the buckets while we were posting
+		s.client.ReleaseReserve(newReserve.ID)
+		bucketsReleased.With(releaseReasons.Surplus).Inc()
+		return err
+	}
+
+	s.expireLater(request.UserID)
+
+	return nil
+}
+
+func (s *Service) expireLater(userID uint64) {
+	time.AfterFunc(s.tune().reserveLifetime, func() {
+		s.expireBuckets(userID)
+	})
+}
+
+func (s *Service) remaining(userID uint64) int64 {
+	reserves, _, _ := s.registry.Load(userID)
+
+	return remainingAmount(reserves)
+}
+
+func remainingAmount(reserves treebidimap.Map) int64 {
+	var amount int64
+	for _, value := range reserves.Values() {
+		if bucket, ok := value.(reserve.Reserve); ok {
+			amount += bucket.Amount
+		}
+	}
+
+	return amount
+}
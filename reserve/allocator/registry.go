@@ -1,77 +1,256 @@
 package allocator
 
 import (
-	"errors"
+	"container/list"
 	"github.com/emirpasic/gods/maps/treebidimap"
 	"github.com/emirpasic/gods/utils"
 	"reserve/reserve"
+	"reserve/reserve/lock"
 	"sync"
 )
 
+// registry keeps the overshoot buckets of every user. Writers are serialized
+// per user through the lock manager and work on a copy of the user's buckets
+// that is swapped in once they are done, so readers never block behind an
+// upstream call.
+//
+// When capacity is set every shard holds the buckets of at most its share of
+// users, rounded up; the least recently used user is evicted, releasing its
+// buckets upstream, to make room for a new one. The capacity is therefore
+// approximate, and must be at least the number of shards to mean anything.
 type registry struct {
-	// map[uin64]syncRWMutex
-	mu sync.Map
+	locks    *lock.Manager
+	shards   []registryShard
+	exposure *exposure
+	capacity int
+	release  func(reserve.Reserve)
+}
+
+type registryShard struct {
+	mu sync.Mutex
 	// map[uint64]map[time.Time]reserve.Reserve
-	rm map[uint64]*treebidimap.Map
+	rm        map[uint64]*registryItem
+	lru       *list.List
+	evictions uint64
+}
+
+type registryItem struct {
+	reserves *treebidimap.Map
+	elem     *list.Element
 }
 
-func newRegistry() registry {
-	return registry{
-		mu: sync.Map{},
-		rm: map[uint64]*treebidimap.Map{},
+type RegistryStats struct {
+	Size      int        `json:"size"`
+	Capacity  int        `json:"capacity"`
+	Evictions uint64     `json:"evictions"`
+	Locks     lock.Stats `json:"locks"`
+}
+
+func newRegistry(shards, capacity int, exposure *exposure, release func(reserve.Reserve)) registry {
+	if shards <= 0 {
+		shards = lock.DefaultShards
+	}
+
+	r := registry{
+		locks:    lock.NewManager(shards),
+		shards:   make([]registryShard, shards),
+		exposure: exposure,
+		capacity: capacity,
+		release:  release,
 	}
+	for i := range r.shards {
+		r.shards[i].rm = map[uint64]*registryItem{}
+		r.shards[i].lru = list.New()
+	}
+
+	return r
 }
 
-var (
-	LoadKeyMapError    = errors.New("could not load reserves key")
-	ParseValueMapError = errors.New("could not load parse reserves value")
-)
+func (r *registry) shard(key uint64) *registryShard {
+	return &r.shards[lock.ShardIndex(key, len(r.shards))]
+}
+
+func (r *registry) shardCapacity() int {
+	return (r.capacity + len(r.shards) - 1) / len(r.shards)
+}
 
 func (r *registry) LoadAndStore(key uint64, fn func(reserves treebidimap.Map) treebidimap.Map) error {
-	entry, _ := r.mu.LoadOrStore(key, sync.RWMutex{})
-	mu, ok := entry.(sync.RWMutex)
-	if !ok {
-		return ParseValueMapError
+	victims := r.loadAndStore(key, fn)
+
+	// evicting takes the victims' locks, which must not be done while
+	// holding the one of key
+	for _, victim := range victims {
+		r.evict(victim)
 	}
-	mu.Lock()
 
-	reserves, ok := r.rm[key]
-	if !ok {
-		reserves = treebidimap.NewWith(utils.TimeComparator, reserve.ByAmountComparator)
-		r.rm[key] = reserves
+	return nil
+}
+
+func (r *registry) loadAndStore(key uint64, fn func(reserves treebidimap.Map) treebidimap.Map) []uint64 {
+	unlock := r.locks.Lock(key)
+	defer unlock()
+
+	shard := r.shard(key)
+
+	shard.mu.Lock()
+	current, ok := shard.rm[key]
+	shard.mu.Unlock()
+
+	reserves := treebidimap.NewWith(utils.TimeComparator, reserve.ByAmountComparator)
+	if ok {
+		reserves = current.reserves.Select(func(key interface{}, value interface{}) bool {
+			return true
+		})
 	}
+	before := amountsByClient(*reserves)
 
 	nextVal := fn(*reserves)
+	r.exposure.Update(key, before, amountsByClient(nextVal))
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	item, ok := shard.rm[key]
 	if nextVal.Size() == 0 {
-		r.rm[key] = nil
-		delete(r.rm, key)
-		defer r.mu.Delete(key)
-	} else {
-		*r.rm[key] = nextVal
+		if ok {
+			shard.lru.Remove(item.elem)
+			delete(shard.rm, key)
+		}
+		return nil
 	}
 
-	mu.Unlock()
-	return nil
+	if !ok {
+		item = &registryItem{elem: shard.lru.PushFront(key)}
+		shard.rm[key] = item
+	}
+	item.reserves = &nextVal
+	shard.lru.MoveToFront(item.elem)
+
+	if r.capacity <= 0 {
+		return nil
+	}
+
+	var victims []uint64
+	for elem := shard.lru.Back(); elem != nil && len(shard.rm)-len(victims) > r.shardCapacity(); elem = elem.Prev() {
+		victims = append(victims, elem.Value.(uint64))
+	}
+
+	return victims
+}
+
+// evict releases every bucket of key upstream before forgetting them. key
+// was picked as a victim without holding its lock, so it is kept if it has
+// been touched since or its shard is no longer over capacity.
+func (r *registry) evict(key uint64) {
+	unlock := r.locks.Lock(key)
+	defer unlock()
+
+	shard := r.shard(key)
+	shard.mu.Lock()
+	item, ok := shard.rm[key]
+	if !ok || shard.lru.Back() != item.elem || len(shard.rm) <= r.shardCapacity() {
+		shard.mu.Unlock()
+		return
+	}
+	shard.lru.Remove(item.elem)
+	delete(shard.rm, key)
+	shard.evictions++
+	shard.mu.Unlock()
+
+	reserves := *item.reserves
+	r.exposure.Update(key, amountsByClient(reserves), nil)
+	for _, value := range reserves.Values() {
+		if bucket, ok := value.(reserve.Reserve); ok {
+			r.release(bucket)
+		}
+	}
+	bucketsReleased.With(releaseReasons.Evicted).Add(float64(reserves.Size()))
+}
+
+// Release releases every bucket of key upstream and returns how many there
+// were.
+func (r *registry) Release(key uint64) int {
+	released := 0
+	r.loadAndStore(key, func(reserves treebidimap.Map) treebidimap.Map {
+		for _, value := range reserves.Values() {
+			if bucket, ok := value.(reserve.Reserve); ok {
+				r.release(bucket)
+			}
+		}
+		released = reserves.Size()
+		reserves.Clear()
+
+		return reserves
+	})
+
+	return released
+}
+
+// Keys lists the users currently holding buckets.
+func (r *registry) Keys() []uint64 {
+	var keys []uint64
+	for i := range r.shards {
+		r.shards[i].mu.Lock()
+		for key := range r.shards[i].rm {
+			keys = append(keys, key)
+		}
+		r.shards[i].mu.Unlock()
+	}
+
+	return keys
 }
 
 func (r *registry) Load(key uint64) (treebidimap.Map, bool, error) {
+	shard := r.shard(key)
 
-	entry, ok := r.mu.Load(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	item, ok := shard.rm[key]
 	if !ok {
 		return treebidimap.Map{}, false, nil
 	}
 
-	mu, ok := entry.(sync.RWMutex)
-	if !ok {
-		return treebidimap.Map{}, true, ParseValueMapError
+	return *item.reserves, true, nil
+}
+
+func (r *registry) Stats() RegistryStats {
+	stats := RegistryStats{
+		Capacity: r.capacity,
+		Locks:    r.locks.Stats(),
+	}
+	for i := range r.shards {
+		r.shards[i].mu.Lock()
+		stats.Size += len(r.shards[i].rm)
+		stats.Evictions += r.shards[i].evictions
+		r.shards[i].mu.Unlock()
 	}
-	mu.RLock()
-	defer mu.RUnlock()
 
-	reserves, ok := r.rm[key]
-	if !ok {
-		return treebidimap.Map{}, false, nil
+	return stats
+}
+
+type registryTotals struct {
+	Users   int
+	Buckets int
+	Amount  int64
+}
+
+// Totals adds up the buckets of every user.
+func (r *registry) Totals() registryTotals {
+	var totals registryTotals
+	for i := range r.shards {
+		r.shards[i].mu.Lock()
+		for _, item := range r.shards[i].rm {
+			totals.Users++
+			totals.Buckets += item.reserves.Size()
+			totals.Amount += remainingAmount(*item.reserves)
+		}
+		r.shards[i].mu.Unlock()
 	}
 
-	return *reserves, true, nil
+	return totals
+}
+
+func (r *registry) LockStats() lock.Stats {
+	return r.locks.Stats()
 }
@@ -0,0 +1,153 @@
+package allocator
+
+import (
+	"github.com/emirpasic/gods/maps/treebidimap"
+	"reserve/reserve"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistryStress(t *testing.T) {
+	const (
+		users      = 8
+		goroutines = 32
+		iterations = 200
+	)
+
+	r := newRegistry(4, 0, newExposure(reserve.AllocatorConfig{}), func(reserve.Reserve) {})
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(2)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				userID := uint64((g + i) % users)
+				err := r.LoadAndStore(userID, func(reserves treebidimap.Map) treebidimap.Map {
+					amount := int64(reserves.Size() + 1)
+					reserves.Put(time.Unix(0, amount), reserve.Reserve{UserID: userID, Amount: amount})
+					if reserves.Size() > 4 {
+						reserves.Clear()
+					}
+					return reserves
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				reserves, _, err := r.Load(uint64((g + i) % users))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, value := range reserves.Values() {
+					if value.(reserve.Reserve).Amount > 5 {
+						t.Errorf("unexpected bucket %+v", value)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for userID := uint64(0); userID < users; userID++ {
+		reserves, _, _ := r.Load(userID)
+		var locked int64
+		for _, value := range reserves.Values() {
+			locked += value.(reserve.Reserve).Amount
+		}
+		if exposed := r.exposure.Snapshot().Users[userID]; exposed != locked {
+			t.Fatalf("user %d: exposure %d does not match %d locked in buckets", userID, exposed, locked)
+		}
+	}
+
+	if keys := r.LockStats().Keys; keys != 0 {
+		t.Fatalf("expected lock entries to be released, %d left", keys)
+	}
+}
+
+func TestRegistryEvictsLeastRecentlyUsedUsers(t *testing.T) {
+	var released []reserve.Reserve
+	r := newRegistry(1, 2, newExposure(reserve.AllocatorConfig{}), func(bucket reserve.Reserve) {
+		released = append(released, bucket)
+	})
+
+	for userID := uint64(1); userID <= 3; userID++ {
+		r.LoadAndStore(userID, func(reserves treebidimap.Map) treebidimap.Map {
+			reserves.Put(time.Now(), reserve.Reserve{ID: int64(userID), UserID: userID, Amount: 100})
+			return reserves
+		})
+
+		// user 1 is used again so user 2 becomes the least recently used
+		if userID == 2 {
+			r.LoadAndStore(1, func(reserves treebidimap.Map) treebidimap.Map {
+				return reserves
+			})
+		}
+	}
+
+	if len(released) != 1 || released[0].UserID != 2 {
+		t.Fatalf("expected the buckets of user 2 to be released, got %+v", released)
+	}
+	if _, found, _ := r.Load(2); found {
+		t.Fatal("expected user 2 to be evicted")
+	}
+	if exposed := r.exposure.Snapshot().Users[2]; exposed != 0 {
+		t.Fatalf("expected no exposure left for user 2, got %d", exposed)
+	}
+
+	stats := r.Stats()
+	if stats.Size != 2 || stats.Evictions != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRegistryKeepsVictimsTouchedBeforeEviction(t *testing.T) {
+	var released []reserve.Reserve
+	r := newRegistry(1, 2, newExposure(reserve.AllocatorConfig{}), func(bucket reserve.Reserve) {
+		released = append(released, bucket)
+	})
+	store := func(userID uint64) []uint64 {
+		return r.loadAndStore(userID, func(reserves treebidimap.Map) treebidimap.Map {
+			reserves.Put(time.Now(), reserve.Reserve{ID: int64(userID), UserID: userID, Amount: 100})
+			return reserves
+		})
+	}
+
+	store(1)
+	store(2)
+	victims := store(3)
+	if len(victims) != 1 || victims[0] != 1 {
+		t.Fatalf("expected user 1 to be picked as the victim, got %v", victims)
+	}
+
+	// user 1 is used again before its eviction runs
+	r.loadAndStore(1, func(reserves treebidimap.Map) treebidimap.Map {
+		return reserves
+	})
+	r.evict(victims[0])
+	if len(released) != 0 {
+		t.Fatalf("expected the touched victim to be kept, got %+v", released)
+	}
+	if _, found, _ := r.Load(1); !found {
+		t.Fatal("expected user 1 to be kept")
+	}
+
+	// user 2 is now the least recently used, but the shard drops back to its
+	// capacity before its eviction runs
+	r.Release(3)
+	r.evict(2)
+	if len(released) != 1 || released[0].UserID != 3 {
+		t.Fatalf("expected only the released user 3, got %+v", released)
+	}
+	if stats := r.Stats(); stats.Evictions != 0 {
+		t.Fatalf("expected no eviction, got %+v", stats)
+	}
+}
@@ -1,29 +1,102 @@
 package allocator
 
 import (
+	"errors"
 	"fmt"
 	"github.com/emirpasic/gods/maps/treebidimap"
 	"github.com/gin-gonic/gin"
+	"net/http"
 	"reserve/reserve"
+	"reserve/reserve/balance"
+	"reserve/reserve/logger"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	CouldNotAllocateError = errors.New("could not allocate reserve")
+)
+
 type Service struct {
-	registry           registry
-	client             client
+	registry  registry
+	exposure  *exposure
+	client    client
+	balance   balance.Provider
+	coalescer *coalescer
+	prewarmer *prewarmer
+	logger    *logger.Logger
+	// paused is set while bucket mode is paused by an operator
+	paused *int32
+	// tuning holds the settings that can be reloaded at runtime
+	tuning *atomic.Value
+
+	// balanceErrors counts the failed balance lookups for readiness
+	balanceErrors *errorWindow
+}
+
+type tuning struct {
 	overshootFactor    int
 	maxRetryAllocation int
 	reserveLifetime    time.Duration
 }
 
-func NewService(config reserve.AllocatorConfig) Service {
-	return Service{
-		newRegistry(),
-		newClient(),
-		config.OvershootFactor,
-		config.MaxRetryAllocation,
-		config.ReserveLifetime,
+func NewService(
+	config reserve.AllocatorConfig,
+	upstream reserve.UpstreamConfig,
+	balance balance.Provider,
+	logger *logger.Logger,
+) Service {
+	exposure := newExposure(config)
+	client := newClient(upstream)
+	release := func(bucket reserve.Reserve) {
+		client.ReleaseReserve(bucket.ID)
+	}
+
+	s := Service{
+		registry: newRegistry(config.LockShards, config.RegistryCapacity, exposure, release),
+		exposure: exposure,
+		client:   client,
+		balance:  balance,
+		logger:   logger,
+
+		balanceErrors: newErrorWindow(upstreamErrorWindow),
+		paused:        new(int32),
+		tuning:        &atomic.Value{},
+	}
+	s.tuning.Store(newTuning(config))
+
+	if config.CoalesceWindow > 0 {
+		s.coalescer = newCoalescer(config.CoalesceWindow, config.CoalesceMaxBatch, s.allocateBatch, logger)
+	}
+
+	if config.Prewarm {
+		s.prewarmer = newPrewarmer(config.PrewarmLowWaterRatio)
+	}
+
+	return s
+}
+
+func newTuning(config reserve.AllocatorConfig) tuning {
+	return tuning{
+		overshootFactor:    config.OvershootFactor,
+		maxRetryAllocation: config.MaxRetryAllocation,
+		reserveLifetime:    config.ReserveLifetime,
+	}
+}
+
+func (s *Service) tune() tuning {
+	return s.tuning.Load().(tuning)
+}
+
+// Reload applies the overshoot factor, retries, bucket lifetime, exposure
+// limits and low-water ratio of config; buckets already posted are kept. The
+// remaining settings take effect on restart.
+func (s *Service) Reload(config reserve.AllocatorConfig) {
+	s.tuning.Store(newTuning(config))
+	s.exposure.SetLimits(config)
+	if s.prewarmer != nil {
+		s.prewarmer.setLowWaterRatio(config.PrewarmLowWaterRatio)
 	}
 }
 
@@ -31,64 +104,129 @@ func (s *Service) AllocateReserve(
 	request reserve.ReserveRequest, isConcurrent bool,
 ) (
 	reserve.Reserve, error,
+) {
+	span := request.Trace.StartChild("allocator.allocate")
+	defer span.Finish()
+	request.Trace = span
+
+	start := time.Now()
+	allocatedReserve, path, err := s.allocate(request, isConcurrent)
+	observeAllocation(path, start, err)
+	span.SetAttribute("path", path)
+	span.SetError(err)
+
+	return allocatedReserve, err
+}
+
+// allocate serves request and reports the path it took.
+func (s *Service) allocate(
+	request reserve.ReserveRequest, isConcurrent bool,
+) (
+	reserve.Reserve, string, error,
 ) {
 	var allocatedReserve reserve.Reserve
+	log := s.logger.With(request.LogFields()...)
+	span := request.Trace
+
+	if isConcurrent && s.BucketModePaused() {
+		isConcurrent = false
+	}
+
+	available, err := s.available(request.UserID)
+	if err != nil {
+		return reserve.Reserve{}, allocationPaths.Rejected, err
+	}
+
+	if request.Body.Amount > available {
+		if request.Body.Mode != reserve.Modes.Partial || available <= 0 {
+			return reserve.Reserve{}, allocationPaths.Rejected, reserve.InsufficientFundsError
+		}
+
+		request.Body.Amount = available
+	}
+
+	if isConcurrent && s.coalescer != nil {
+		allocatedReserve, path, err := s.coalescer.Allocate(request)
+		if err == nil {
+			s.Prewarm(request)
+		}
+
+		return allocatedReserve, path, err
+	}
 
 	if isConcurrent {
+		var acquiredExposure int64
+		defer func() {
+			s.exposure.Release(request.UserID, request.ClientID, acquiredExposure)
+		}()
+
+		standaloneFallback := false
+		allocated := false
+		var bucketErr error
+		path := allocationPaths.BucketSplit
+		lockWait := span.StartChild("registry.lock_wait")
 		allocErr := s.registry.LoadAndStore(request.UserID, func(reserves treebidimap.Map) treebidimap.Map {
+			lockWait.Finish()
 
 			shouldTryToReserveNew := reserves.Size() == 0
 
-			for i := 0; i < s.maxRetryAllocation; i++ {
+			for i := 0; i < s.tune().maxRetryAllocation; i++ {
+				if i > 0 {
+					allocationRetries.With().Inc()
+					span.SetAttribute("retries", i)
+				}
+
 				if shouldTryToReserveNew {
-					newReserve, err := s.client.PostReserve(request, 10)
+					bucketAmount, ok := s.bucketAmount(request.Body.Amount, available)
+					if !ok || !s.exposure.TryAcquire(request.UserID, request.ClientID, bucketAmount) {
+						standaloneFallback = true
+						return reserves
+					}
+					acquiredExposure += bucketAmount
+
+					bucketRequest := request
+					bucketRequest.Body.Amount = bucketAmount
+					newReserve, err := s.client.PostReserve(bucketRequest, 1)
 					if err != nil {
-						fmt.Println("Error posting reserve")
+						log.Error("could not post bucket", "amount", bucketAmount, "error", err)
+						bucketErr = err
 
 						return reserves
 					}
 
 					reserves.Put(time.Now(), newReserve)
+					path = allocationPaths.NewBucket
 				}
 
-				var toRemove []time.Time
-				var toAllocate []reserve.Reserve
 				for _, reservesR := range reserves.Values() {
 					parentReserve, ok := reservesR.(reserve.Reserve)
 					if !ok {
-						fmt.Println("Error parsing reserve")
+						log.Error("unexpected bucket in registry")
 						return reserves
 					}
 
-					if parentReserve.Amount > request.Body.Amount {
-						var newParentReserve reserve.Reserve
-						newParentReserve, allocatedReserve, _ = s.client.SplitReserve(request, parentReserve.ID)
-						timeKeyR, found := reserves.GetKey(parentReserve)
-						if !found {
-							fmt.Println("Could not find key parent reserve")
-							return reserves
-						}
-
-						timeKey, ok := timeKeyR.(time.Time)
-						if !ok {
-							fmt.Println("Could not find key parent reserve")
-							return reserves
-						}
-
-						toRemove = append(toRemove, timeKey)
-						toAllocate = append(toAllocate, newParentReserve)
-					} else {
-						shouldTryToReserveNew = true
+					if parentReserve.Amount <= request.Body.Amount {
 						break
 					}
-				}
 
-				for _, deletedEntry := range toRemove {
-					reserves.Remove(deletedEntry)
-				}
+					timeKeyR, found := reserves.GetKey(parentReserve)
+					timeKey, ok := timeKeyR.(time.Time)
+					if !found || !ok {
+						log.Error("could not find bucket key in registry", "reserve_id", parentReserve.ID)
+						return reserves
+					}
 
-				for _, allocatedParentReserve := range toAllocate {
-					reserves.Put(time.Now(), allocatedParentReserve)
+					newParentReserve, splittedReserve, err := s.client.SplitReserve(request, parentReserve.ID)
+					if err != nil {
+						log.Error("could not split bucket", "reserve_id", parentReserve.ID, "error", err)
+						bucketErr = err
+						break
+					}
+
+					reserves.Remove(timeKey)
+					reserves.Put(time.Now(), newParentReserve)
+					allocatedReserve = splittedReserve
+					allocated = true
 
 					return reserves
 				}
@@ -98,10 +236,28 @@ func (s *Service) AllocateReserve(
 
 			return reserves
 		})
+		if allocErr == nil && standaloneFallback {
+			standaloneReserve, err := s.allocateStandalone(request)
+			return standaloneReserve, allocationPaths.Standalone, err
+		}
+		if allocErr == nil && !allocated {
+			allocErr = bucketErr
+			if allocErr == nil {
+				allocErr = CouldNotAllocateError
+			}
+		}
+		if allocErr == nil {
+			s.Prewarm(request)
+		}
 
-		return allocatedReserve, allocErr
+		return allocatedReserve, path, allocErr
 	}
 
+	standaloneReserve, err := s.allocateStandalone(request)
+	return standaloneReserve, allocationPaths.Standalone, err
+}
+
+func (s *Service) allocateStandalone(request reserve.ReserveRequest) (reserve.Reserve, error) {
 	notConcurrentReserve, err := s.client.PostReserve(request, 1)
 	if err != nil {
 		return reserve.Reserve{}, err
@@ -112,23 +268,173 @@ func (s *Service) AllocateReserve(
 	return notConcurrentReserve, nil
 }
 
+// allocateBatch serves every request of a coalesced batch with one split of
+// the user's largest bucket, posting a new bucket first when none can hold
+// the whole batch. The requests of a batch share a client, which the posted
+// bucket is charged to.
+func (s *Service) allocateBatch(userID uint64, requests []reserve.ReserveRequest) []allocation {
+	var requestedAmount int64
+	for _, request := range requests {
+		requestedAmount += request.Body.Amount
+	}
+
+	available, err := s.available(userID)
+	if err != nil {
+		allocations := make([]allocation, len(requests))
+		for i := range requests {
+			allocations[i] = allocation{path: allocationPaths.Rejected, err: err}
+		}
+
+		return allocations
+	}
+	bucketAmount, fitsBucket := s.bucketAmount(requestedAmount, available)
+
+	bucketRequest := requests[0]
+	bucketRequest.Body.Amount = bucketAmount
+	log := s.logger.With(bucketRequest.LogFields()...).With("batch_size", len(requests))
+	span := bucketRequest.Trace.StartChild("allocator.allocate_batch")
+	defer span.Finish()
+	span.SetAttribute("batch_size", len(requests))
+	bucketRequest.Trace = span
+	splitRequests := append([]reserve.ReserveRequest(nil), requests...)
+	splitRequests[0].Trace = span
+
+	var acquiredExposure int64
+	defer func() {
+		s.exposure.Release(userID, bucketRequest.ClientID, acquiredExposure)
+	}()
+
+	standaloneFallback := false
+	path := allocationPaths.BucketSplit
+	var splittedReserves []reserve.Reserve
+	lockWait := span.StartChild("registry.lock_wait")
+	allocErr := s.registry.LoadAndStore(userID, func(reserves treebidimap.Map) treebidimap.Map {
+		lockWait.Finish()
+
+		for i := 0; i < s.tune().maxRetryAllocation; i++ {
+			if i > 0 {
+				allocationRetries.With().Inc()
+				span.SetAttribute("retries", i)
+			}
+
+			parentKey, parentReserve, found := largestBucket(reserves)
+
+			if !found || parentReserve.Amount <= requestedAmount {
+				if !fitsBucket || !s.exposure.TryAcquire(userID, bucketRequest.ClientID, bucketAmount) {
+					standaloneFallback = true
+					return reserves
+				}
+				acquiredExposure += bucketAmount
+
+				newReserve, err := s.client.PostReserve(bucketRequest, 1)
+				if err != nil {
+					log.Error("could not post bucket", "amount", bucketAmount, "error", err)
+					continue
+				}
+
+				parentKey = time.Now()
+				parentReserve = newReserve
+				reserves.Put(parentKey, parentReserve)
+				path = allocationPaths.NewBucket
+			}
+
+			newParentReserve, newSplittedReserves, err := s.client.MultiSplitReserve(splitRequests, parentReserve.ID)
+			if err != nil {
+				log.Error("could not split bucket", "reserve_id", parentReserve.ID, "error", err)
+				continue
+			}
+
+			reserves.Remove(parentKey)
+			reserves.Put(time.Now(), newParentReserve)
+			splittedReserves = newSplittedReserves
+
+			return reserves
+		}
+
+		return reserves
+	})
+	allocations := make([]allocation, len(requests))
+	if allocErr == nil && standaloneFallback {
+		for i, request := range requests {
+			standaloneReserve, err := s.allocateStandalone(request)
+			allocations[i] = allocation{standaloneReserve, allocationPaths.Standalone, err}
+		}
+
+		return allocations
+	}
+
+	if allocErr == nil && splittedReserves == nil {
+		allocErr = CouldNotAllocateError
+	}
+
+	for i := range requests {
+		if allocErr != nil {
+			allocations[i] = allocation{path: path, err: allocErr}
+			continue
+		}
+
+		allocations[i] = allocation{reserve: splittedReserves[i], path: path}
+	}
+
+	return allocations
+}
+
+// bucketAmount is the overshoot bucket to post for amount, capped at the
+// user's available funds. It is not ok when the capped bucket leaves no room
+// to split amount out of it.
+func (s *Service) bucketAmount(amount, available int64) (int64, bool) {
+	bucketAmount := amount * int64(s.tune().overshootFactor)
+	if bucketAmount > available {
+		bucketAmount = available
+	}
+
+	return bucketAmount, bucketAmount > amount
+}
+
+func largestBucket(reserves treebidimap.Map) (time.Time, reserve.Reserve, bool) {
+	values := reserves.Values()
+	if len(values) == 0 {
+		return time.Time{}, reserve.Reserve{}, false
+	}
+
+	largest, ok := values[0].(reserve.Reserve)
+	if !ok {
+		return time.Time{}, reserve.Reserve{}, false
+	}
+
+	timeKeyR, found := reserves.GetKey(largest)
+	if !found {
+		return time.Time{}, reserve.Reserve{}, false
+	}
+
+	timeKey, ok := timeKeyR.(time.Time)
+	if !ok {
+		return time.Time{}, reserve.Reserve{}, false
+	}
+
+	return timeKey, largest, true
+}
+
+// RegisterBucketExpirationMiddleware expires the buckets of the user of the
+// request once they outlive the reserve lifetime. In cluster mode it must
+// come after cluster.Service.RegisterForwardMiddleware, so that only the
+// owner watches the buckets it holds.
 func (s *Service) RegisterBucketExpirationMiddleware(c *gin.Context) {
-	timeout := time.After(s.reserveLifetime)
-	shouldExit := false
+	timeout := time.After(s.tune().reserveLifetime)
 
 	userIDParam := c.Param("user_id")
 	userID, _ := strconv.ParseUint(userIDParam, 10, 64)
 	go func(userID uint64) {
-		defer func (){
+		defer func() {
 			if r := recover(); r != nil {
-				fmt.Println("Recovered in f", r)
+				s.logger.Error("bucket expiration panicked", "user_id", userID, "panic", fmt.Sprint(r))
 			}
 		}()
 
 		for {
 			_, found, err := s.registry.Load(userID)
 			if err != nil {
-				fmt.Println("Error loading user buckets")
+				s.logger.Error("could not load buckets", "user_id", userID, "error", err)
 				return
 			}
 
@@ -138,48 +444,97 @@ func (s *Service) RegisterBucketExpirationMiddleware(c *gin.Context) {
 
 			<-timeout
 
-			allocErr := s.registry.LoadAndStore(userID, func(reserves treebidimap.Map) treebidimap.Map {
-				currentTime := time.Now()
+			shouldExit, allocErr := s.expireBuckets(userID)
+			if allocErr != nil || shouldExit {
+				return
+			}
 
-				var toRemove *time.Time
-				for _, reserveR := range reserves.Keys() {
-					reserveTime, ok := reserveR.(time.Time)
-					if !ok {
-						fmt.Println("Error parsing time bucket")
-						return reserves
-					}
+			timeout = time.After(s.tune().reserveLifetime)
+		}
+	}(userID)
+}
 
-					if currentTime.After(reserveTime.Add(s.reserveLifetime)) {
-						reserveValue, _ := reserves.Get(reserveTime)
-						reserveToRelease, ok := reserveValue.(reserve.Reserve)
-						if !ok {
-							fmt.Println("Error parsing reserve")
-							return reserves
-						}
+// expireBuckets releases the buckets of userID that outlived reserveLifetime
+// and reports whether none is left.
+func (s *Service) expireBuckets(userID uint64) (bool, error) {
+	empty := false
 
-						s.client.ReleaseReserve(reserveToRelease.ID)
+	reserveLifetime := s.tune().reserveLifetime
+	err := s.registry.LoadAndStore(userID, func(reserves treebidimap.Map) treebidimap.Map {
+		currentTime := time.Now()
 
-						toRemove = &reserveTime
-					}
-				}
+		var toRemove []time.Time
+		for _, reserveR := range reserves.Keys() {
+			reserveTime, ok := reserveR.(time.Time)
+			if !ok {
+				s.logger.Error("unexpected bucket key in registry", "user_id", userID)
+				return reserves
+			}
 
-				if toRemove != nil {
-					reserves.Remove(*toRemove)
+			if currentTime.After(reserveTime.Add(reserveLifetime)) {
+				reserveValue, _ := reserves.Get(reserveTime)
+				reserveToRelease, ok := reserveValue.(reserve.Reserve)
+				if !ok {
+					s.logger.Error("unexpected bucket in registry", "user_id", userID)
+					return reserves
 				}
 
-				if reserves.Size() == 0 {
-					shouldExit = true
-				}
+				s.client.ReleaseReserve(reserveToRelease.ID)
+				bucketsReleased.With(releaseReasons.Expired).Inc()
+				s.logger.Debug("bucket expired", "user_id", userID, "reserve_id", reserveToRelease.ID)
 
-				return reserves
-			})
-			if allocErr != nil || shouldExit {
-				return
+				toRemove = append(toRemove, reserveTime)
 			}
+		}
 
-			timeout = time.After(s.reserveLifetime)
+		for _, reserveTime := range toRemove {
+			reserves.Remove(reserveTime)
 		}
-	}(userID)
+
+		if reserves.Size() == 0 {
+			empty = true
+		}
+
+		return reserves
+	})
+
+	return empty, err
+}
+
+func (s *Service) HandleStatsRequest(c *gin.Context) {
+	c.JSON(http.StatusOK, s.registry.Stats())
+	return
+}
+
+func (s *Service) HandleExposureRequest(c *gin.Context) {
+	c.JSON(http.StatusOK, s.exposure.Snapshot())
+	return
+}
+
+// Handoff releases upstream the buckets of every user for which owns is false,
+// so that the instance now owning them starts from a clean slate. It returns
+// the number of users handed off.
+//
+// Requests admitted before the handoff may still store buckets afterwards,
+// those are released once they outlive reserveLifetime like any other.
+func (s *Service) Handoff(owns func(userID uint64) bool) int {
+	if s.prewarmer != nil {
+		defer s.prewarmer.drain()()
+	}
+
+	handedOff := 0
+	for _, userID := range s.registry.Keys() {
+		if owns(userID) {
+			continue
+		}
+
+		if released := s.registry.Release(userID); released > 0 {
+			bucketsReleased.With(releaseReasons.Handoff).Add(float64(released))
+			handedOff++
+		}
+	}
+
+	return handedOff
 }
 
 func (s *Service) ListFromRegistry(userID uint64) []reserve.Reserve {
@@ -0,0 +1,235 @@
+package allocator
+
+import (
+	"reserve/reserve"
+	"reserve/reserve/balance"
+	"reserve/reserve/logger"
+	"testing"
+	"time"
+)
+
+func TestAllocateReserveCapsByAvailableFunds(t *testing.T) {
+	provider := balance.NewMemory(0)
+	provider.Set(1, 1000)
+	s := NewService(reserve.NewConfig().Allocator, reserve.NewConfig().Upstream, provider, logger.Discard())
+
+	request := reserve.ReserveRequest{
+		UserID:   1,
+		ClientID: "1234",
+		Body: reserve.Body{
+			Amount: 2500,
+			Mode:   reserve.Modes.Total,
+			Reason: reserve.Reasons.ReserveForPayment,
+		},
+	}
+
+	if _, err := s.AllocateReserve(request, false); err != reserve.InsufficientFundsError {
+		t.Fatalf("expected insufficient funds for a total reserve, got %v", err)
+	}
+
+	request.Body.Mode = reserve.Modes.Partial
+	partial, err := s.AllocateReserve(request, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partial.Amount != 1000 {
+		t.Fatalf("expected a partial reserve of the available 1000, got %d", partial.Amount)
+	}
+
+	request.Body.Amount = 500
+	bucketed, err := s.AllocateReserve(request, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucketed.Amount != 500 {
+		t.Fatalf("expected a reserve of 500, got %d", bucketed.Amount)
+	}
+	for _, bucket := range s.ListFromRegistry(1) {
+		if bucket.Amount > 1000 {
+			t.Fatalf("bucket of %d exceeds the available funds", bucket.Amount)
+		}
+	}
+}
+
+func TestPrewarmPostsBucketInBackground(t *testing.T) {
+	config := reserve.NewConfig().Allocator
+	config.Prewarm = true
+	s := NewService(config, reserve.NewConfig().Upstream, balance.NewMemory(100000000), logger.Discard())
+
+	request := reserve.ReserveRequest{
+		UserID:   2,
+		ClientID: "1234",
+		Body: reserve.Body{
+			Amount: 25000,
+			Mode:   reserve.Modes.Total,
+			Reason: reserve.Reasons.ReserveForPayment,
+		},
+	}
+	s.Prewarm(request)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(s.ListFromRegistry(2)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no bucket was prewarmed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if buckets := s.ListFromRegistry(2); buckets[0].Amount != 250000 {
+		t.Fatalf("expected a bucket of 250000, got %+v", buckets)
+	}
+
+	// the bucket is above the low-water ratio, nothing else is posted
+	s.Prewarm(request)
+	time.Sleep(150 * time.Millisecond)
+	if buckets := s.ListFromRegistry(2); len(buckets) != 1 {
+		t.Fatalf("expected a single bucket, got %+v", buckets)
+	}
+}
+
+func TestPrewarmPostsOnlyWhenBucketsRunLow(t *testing.T) {
+	config := reserve.NewConfig().Allocator
+	config.Prewarm = true
+	upstream := reserve.NewConfig().Upstream
+	upstream.ReserveDelay = time.Millisecond
+	upstream.SplitDelay = time.Millisecond
+	s := NewService(config, upstream, balance.NewMemory(100000000), logger.Discard())
+
+	request := reserve.ReserveRequest{
+		UserID:   3,
+		ClientID: "1234",
+		Body: reserve.Body{
+			Amount: 2500,
+			Mode:   reserve.Modes.Total,
+			Reason: reserve.Reasons.ReserveForPayment,
+		},
+	}
+	postedBefore := 0
+	upstreamPosts := func() int {
+		posts := -postedBefore
+		for _, entry := range db.List(3) {
+			if entry.Version != nil && *entry.Version == "initial_tbs" {
+				posts++
+			}
+		}
+		return posts
+	}
+	postedBefore = upstreamPosts()
+	// a request entering bucket mode triggers a prewarm, as the
+	// concurrency service does, before being allocated itself
+	allocate := func() {
+		s.Prewarm(request)
+		if _, err := s.AllocateReserve(request, true); err != nil {
+			t.Fatal(err)
+		}
+		s.prewarmer.drain()()
+	}
+
+	// the bucket of 25000 keeps at least 5000 through eight splits
+	for i := 0; i < 8; i++ {
+		allocate()
+	}
+	if posts := upstreamPosts(); posts != 1 {
+		t.Fatalf("expected a single bucket posted upstream, got %d", posts)
+	}
+
+	allocate()
+	if posts := upstreamPosts(); posts != 2 {
+		t.Fatalf("expected a bucket to be prewarmed below the low-water ratio, got %d posts", posts)
+	}
+}
+
+func TestDrainKeepsPrewarmsFromBeginning(t *testing.T) {
+	p := newPrewarmer(0.2)
+	if !p.begin(1) {
+		t.Fatal("expected a prewarm to begin")
+	}
+
+	resumed := make(chan func())
+	go func() {
+		resumed <- p.drain()
+	}()
+	for draining := 0; draining == 0; {
+		p.mu.Lock()
+		draining = p.draining
+		p.mu.Unlock()
+	}
+
+	if p.begin(2) {
+		t.Fatal("expected no prewarm to begin while draining")
+	}
+	select {
+	case <-resumed:
+		t.Fatal("expected drain to wait for the prewarm in flight")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	p.end(1)
+	resume := <-resumed
+	if p.begin(2) {
+		t.Fatal("expected no prewarm to begin before resuming")
+	}
+	resume()
+	if !p.begin(2) {
+		t.Fatal("expected prewarms to begin once resumed")
+	}
+	p.end(2)
+}
+
+func TestBucketFallsBackToStandaloneAtTheExposureCap(t *testing.T) {
+	config := reserve.NewConfig().Allocator
+	config.MaxUserExposure = 1000
+	s := NewService(config, reserve.NewConfig().Upstream, balance.NewMemory(100000000), logger.Discard())
+
+	request := reserve.ReserveRequest{
+		UserID:   5,
+		ClientID: "1234",
+		Body: reserve.Body{
+			Amount: 500,
+			Mode:   reserve.Modes.Total,
+			Reason: reserve.Reasons.ReserveForPayment,
+		},
+	}
+
+	allocated, err := s.AllocateReserve(request, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocated.Version == nil || *allocated.Version != "standalone" || allocated.Amount != 500 {
+		t.Fatalf("expected a standalone reserve of 500, got %+v", allocated)
+	}
+	if buckets := s.ListFromRegistry(5); len(buckets) != 0 {
+		t.Errorf("expected no bucket past the cap, got %d", len(buckets))
+	}
+}
+
+func TestBucketFailuresAreReported(t *testing.T) {
+	request := reserve.ReserveRequest{
+		UserID:   6,
+		ClientID: "1234",
+		Body: reserve.Body{
+			Amount: 500,
+			Mode:   reserve.Modes.Total,
+			Reason: reserve.Reasons.ReserveForPayment,
+		},
+	}
+
+	post := reserve.NewConfig().Upstream
+	post.AllocationFailurePercentage = 100
+	s := NewService(reserve.NewConfig().Allocator, post, balance.NewMemory(100000000), logger.Discard())
+	if allocated, err := s.AllocateReserve(request, true); err == nil {
+		t.Errorf("expected a failed bucket post to be reported, got %+v", allocated)
+	}
+
+	split := reserve.NewConfig().Upstream
+	split.SplitFailurePercentage = 100
+	s = NewService(reserve.NewConfig().Allocator, split, balance.NewMemory(100000000), logger.Discard())
+	if allocated, err := s.AllocateReserve(request, true); err == nil {
+		t.Errorf("expected a failed split to be reported, got %+v", allocated)
+	}
+	for _, bucket := range s.ListFromRegistry(6) {
+		if bucket.ID == 0 {
+			t.Error("expected no bucket to be replaced by the result of a failed split")
+		}
+	}
+}
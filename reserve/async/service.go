@@ -0,0 +1,151 @@
+package async
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"reserve/reserve"
+	"sync"
+	"time"
+)
+
+var (
+	QueueFullError = errors.New("async allocation queue is full")
+)
+
+type job struct {
+	id           string
+	request      reserve.ReserveRequest
+	isConcurrent bool
+}
+
+type store struct {
+	mu      sync.Mutex
+	pending map[string]reserve.PendingReserve
+}
+
+// Service completes allocations on a bounded pool of workers and keeps their
+// outcome around for ResultTTL so callers can poll for it. onComplete, when
+// set, is told the outcome of every allocation once it is stored.
+type Service struct {
+	jobs            chan job
+	store           *store
+	allocateReserve func(reserve.ReserveRequest, bool) (reserve.Reserve, error)
+	onComplete      func(reserve.ReserveRequest, reserve.Reserve, error)
+	resultTTL       time.Duration
+}
+
+func NewService(
+	config reserve.AsyncConfig,
+	allocateReserve func(reserve.ReserveRequest, bool) (reserve.Reserve, error),
+	onComplete func(reserve.ReserveRequest, reserve.Reserve, error),
+) Service {
+	s := Service{
+		jobs:            make(chan job, config.QueueSize),
+		store:           &store{pending: map[string]reserve.PendingReserve{}},
+		allocateReserve: allocateReserve,
+		onComplete:      onComplete,
+		resultTTL:       config.ResultTTL,
+	}
+
+	for i := 0; i < config.Workers; i++ {
+		go s.worker()
+	}
+	if s.resultTTL > 0 {
+		go s.expirer()
+	}
+
+	return s
+}
+
+func (s *Service) Submit(request reserve.ReserveRequest, isConcurrent bool) (reserve.PendingReserve, error) {
+	id, err := newID()
+	if err != nil {
+		return reserve.PendingReserve{}, err
+	}
+
+	now := time.Now()
+	pending := reserve.PendingReserve{
+		ID:           id,
+		UserID:       request.UserID,
+		Status:       reserve.PendingStatuses.Pending,
+		DateCreated:  now,
+		LastModified: now,
+	}
+
+	s.store.mu.Lock()
+	s.store.pending[id] = pending
+	s.store.mu.Unlock()
+
+	select {
+	case s.jobs <- job{id, request, isConcurrent}:
+		return pending, nil
+	default:
+		s.store.mu.Lock()
+		delete(s.store.pending, id)
+		s.store.mu.Unlock()
+
+		return reserve.PendingReserve{}, QueueFullError
+	}
+}
+
+func (s *Service) Load(userID uint64, id string) (reserve.PendingReserve, bool) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	pending, ok := s.store.pending[id]
+	if !ok || pending.UserID != userID {
+		return reserve.PendingReserve{}, false
+	}
+
+	return pending, true
+}
+
+func (s *Service) worker() {
+	for j := range s.jobs {
+		allocatedReserve, err := s.allocateReserve(j.request, j.isConcurrent)
+
+		s.store.mu.Lock()
+		pending := s.store.pending[j.id]
+		if err != nil {
+			pending.Status = reserve.PendingStatuses.Failed
+			pending.Error = err.Error()
+		} else {
+			pending.Status = reserve.PendingStatuses.Reserved
+			pending.Reserve = &allocatedReserve
+		}
+		pending.LastModified = time.Now()
+		s.store.pending[j.id] = pending
+		s.store.mu.Unlock()
+
+		if s.onComplete != nil {
+			s.onComplete(j.request, allocatedReserve, err)
+		}
+	}
+}
+
+func (s *Service) expirer() {
+	ticker := time.NewTicker(s.resultTTL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		deadline := time.Now().Add(-s.resultTTL)
+
+		s.store.mu.Lock()
+		for id, pending := range s.store.pending {
+			if pending.Status != reserve.PendingStatuses.Pending && pending.LastModified.Before(deadline) {
+				delete(s.store.pending, id)
+			}
+		}
+		s.store.mu.Unlock()
+	}
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,108 @@
+package async
+
+import (
+	"errors"
+	"reserve/reserve"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, s Service, userID uint64, id string, status reserve.PendingStatus) reserve.PendingReserve {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if pending, ok := s.Load(userID, id); ok && pending.Status == status {
+			return pending
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("expected %s to become %s", id, status)
+	return reserve.PendingReserve{}
+}
+
+func TestPendingReserveLifecycle(t *testing.T) {
+	release := make(chan struct{})
+	completed := make(chan error, 2)
+	s := NewService(reserve.NewConfig().Async, func(request reserve.ReserveRequest, isConcurrent bool) (reserve.Reserve, error) {
+		<-release
+		if request.Body.Amount > 1000 {
+			return reserve.Reserve{}, reserve.InsufficientFundsError
+		}
+		return reserve.Reserve{ID: 1, Amount: request.Body.Amount}, nil
+	}, func(request reserve.ReserveRequest, allocated reserve.Reserve, err error) {
+		completed <- err
+	})
+
+	reserved, err := s.Submit(reserve.ReserveRequest{UserID: 1, Body: reserve.Body{Amount: 100}}, false)
+	if err != nil || reserved.Status != reserve.PendingStatuses.Pending {
+		t.Fatalf("expected a pending reserve, got %+v %v", reserved, err)
+	}
+	failed, _ := s.Submit(reserve.ReserveRequest{UserID: 1, Body: reserve.Body{Amount: 5000}}, false)
+
+	if pending, ok := s.Load(1, reserved.ID); !ok || pending.Status != reserve.PendingStatuses.Pending {
+		t.Errorf("expected the reserve to be pending until allocated, got %+v", pending)
+	}
+	if _, ok := s.Load(2, reserved.ID); ok {
+		t.Error("expected the reserve not to be found for another user")
+	}
+
+	close(release)
+
+	pending := waitFor(t, s, 1, reserved.ID, reserve.PendingStatuses.Reserved)
+	if pending.Reserve == nil || pending.Reserve.Amount != 100 || pending.Error != "" {
+		t.Errorf("expected the allocated reserve, got %+v", pending)
+	}
+	pending = waitFor(t, s, 1, failed.ID, reserve.PendingStatuses.Failed)
+	if pending.Reserve != nil || pending.Error != reserve.InsufficientFundsError.Error() {
+		t.Errorf("expected the allocation error, got %+v", pending)
+	}
+
+	failures := 0
+	for i := 0; i < 2; i++ {
+		if err := <-completed; err != nil {
+			failures++
+		}
+	}
+	if failures != 1 {
+		t.Errorf("expected both completions to be reported, one failed, got %d failed", failures)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	config := reserve.NewConfig().Async
+	config.Workers = 0
+	config.QueueSize = 1
+	s := NewService(config, func(reserve.ReserveRequest, bool) (reserve.Reserve, error) {
+		return reserve.Reserve{}, errors.New("not expected to run")
+	}, nil)
+
+	if _, err := s.Submit(reserve.ReserveRequest{UserID: 1}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Submit(reserve.ReserveRequest{UserID: 1}, false); err != QueueFullError {
+		t.Errorf("expected QueueFullError, got %v", err)
+	}
+	if len(s.store.pending) != 1 {
+		t.Errorf("expected the refused reserve not to be kept, got %d", len(s.store.pending))
+	}
+}
+
+func TestResultsExpire(t *testing.T) {
+	config := reserve.NewConfig().Async
+	config.ResultTTL = 10 * time.Millisecond
+	s := NewService(config, func(request reserve.ReserveRequest, isConcurrent bool) (reserve.Reserve, error) {
+		return reserve.Reserve{ID: 1}, nil
+	}, nil)
+
+	submitted, _ := s.Submit(reserve.ReserveRequest{UserID: 1}, false)
+	waitFor(t, s, 1, submitted.ID, reserve.PendingStatuses.Reserved)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := s.Load(1, submitted.ID); !ok {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("expected the result to expire after the result TTL")
+}
@@ -0,0 +1,269 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net/http"
+	"reserve/reserve"
+	"reserve/reserve/logger"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	APIKeyHeader    = "X-Api-Key"
+	ClientIDHeader  = "X-Client-Id"
+	TimestampHeader = "X-Timestamp"
+	NonceHeader     = "X-Nonce"
+	SignatureHeader = "X-Signature"
+
+	maxNonceLength = 128
+)
+
+var (
+	MissingCredentialsError = errors.New("missing credentials")
+	UnknownClientError      = errors.New("unknown client")
+	InvalidSignatureError   = errors.New("invalid signature")
+	StaleTimestampError     = errors.New("timestamp outside the allowed clock skew")
+	ReplayedNonceError      = errors.New("nonce already used")
+	InvalidClientError      = errors.New("clients must be listed as client_id:secret")
+)
+
+// clients is the registry of the callers allowed to reserve. Each client has
+// one secret, sent as is as an API key or used to sign requests.
+type clients struct {
+	secrets map[string][]byte
+	// byKey finds the client of an API key by its SHA-256, so that the
+	// lookup does not depend on the key itself
+	byKey map[[sha256.Size]byte]string
+}
+
+// Service authenticates the callers creating reserves, either by API key or
+// by an HMAC-SHA256 signature of the request, and binds the authenticated
+// client ID to the request.
+//
+// A signed request carries X-Client-Id, X-Timestamp in unix seconds, a
+// unique X-Nonce and X-Signature, the hex HMAC of
+//
+//	method \n path \n raw query \n timestamp \n nonce \n hex SHA-256 of the body
+//
+// keyed with the client secret. Timestamps further than the allowed clock
+// skew are refused and nonces are remembered for twice the skew, so a
+// signed request cannot be replayed. Requests are signed against the URL the
+// caller sent, so a request forwarded to the owning peer still verifies
+// there.
+//
+// Nonces are remembered by each instance only. In cluster mode requests are
+// authenticated on the instance owning their user, once forwarded there, so
+// replays are refused per owner rather than across the cluster: a request
+// replayed after its user moved to another owner is accepted again.
+type Service struct {
+	enabled  bool
+	allowKey bool
+	skew     time.Duration
+	clients  *atomic.Value
+	nonces   *nonces
+	logger   *logger.Logger
+}
+
+func NewService(config reserve.AuthConfig, logger *logger.Logger) (Service, error) {
+	s := Service{
+		enabled:  config.Enabled,
+		allowKey: config.AllowAPIKeys,
+		skew:     config.MaxClockSkew,
+		clients:  &atomic.Value{},
+		nonces:   newNonces(),
+		logger:   logger,
+	}
+	if err := s.Reload(config); err != nil {
+		return Service{}, err
+	}
+
+	return s, nil
+}
+
+// Reload swaps in the clients of config; authentication is enabled or
+// disabled on restart only.
+func (s *Service) Reload(config reserve.AuthConfig) error {
+	c, err := newClients(config.Clients)
+	if err != nil {
+		return err
+	}
+	s.clients.Store(c)
+
+	return nil
+}
+
+// Check reports why Reload would refuse config.
+func (s *Service) Check(config reserve.AuthConfig) error {
+	_, err := newClients(config.Clients)
+
+	return err
+}
+
+func newClients(entries []string) (clients, error) {
+	c := clients{
+		secrets: map[string][]byte{},
+		byKey:   map[[sha256.Size]byte]string{},
+	}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return clients{}, InvalidClientError
+		}
+
+		c.secrets[parts[0]] = []byte(parts[1])
+		c.byKey[sha256.Sum256([]byte(parts[1]))] = parts[0]
+	}
+
+	return c, nil
+}
+
+// Authenticate returns the client that sent request, whose body is read and
+// restored.
+func (s *Service) Authenticate(request *http.Request, now time.Time) (string, error) {
+	c := s.clients.Load().(clients)
+
+	if key := request.Header.Get(APIKeyHeader); key != "" && s.allowKey {
+		clientID, ok := c.byKey[sha256.Sum256([]byte(key))]
+		if !ok {
+			return "", UnknownClientError
+		}
+
+		return clientID, nil
+	}
+
+	clientID := request.Header.Get(ClientIDHeader)
+	timestamp := request.Header.Get(TimestampHeader)
+	nonce := request.Header.Get(NonceHeader)
+	signature := request.Header.Get(SignatureHeader)
+	if clientID == "" || timestamp == "" || nonce == "" || signature == "" || len(nonce) > maxNonceLength {
+		return "", MissingCredentialsError
+	}
+
+	secret, ok := c.secrets[clientID]
+	if !ok {
+		return "", UnknownClientError
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", StaleTimestampError
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > s.skew || skew < -s.skew {
+		return "", StaleTimestampError
+	}
+
+	var body []byte
+	if request.Body != nil {
+		body, err = ioutil.ReadAll(request.Body)
+		if err != nil {
+			return "", err
+		}
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	expected := Sign(secret, request.Method, request.URL.Path, request.URL.RawQuery, timestamp, nonce, body)
+	decoded, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(decoded, expected) {
+		return "", InvalidSignatureError
+	}
+
+	// only nonces of valid signatures are remembered, so that nobody can
+	// burn the nonces of a client
+	if !s.nonces.add(clientID+":"+nonce, now, 2*s.skew) {
+		return "", ReplayedNonceError
+	}
+
+	return clientID, nil
+}
+
+// Sign is the signature of a request by the client holding secret.
+func Sign(secret []byte, method, path, rawQuery, timestamp, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{
+		method,
+		path,
+		rawQuery,
+		timestamp,
+		nonce,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")))
+
+	return mac.Sum(nil)
+}
+
+// RegisterMiddleware refuses unauthenticated requests and binds the
+// authenticated client ID for HandleCreation. It lets everything through
+// when authentication is disabled. In cluster mode it must come after
+// cluster.Service.RegisterForwardMiddleware, so that nonces are checked by
+// the owner.
+func (s *Service) RegisterMiddleware(c *gin.Context) {
+	if !s.enabled {
+		c.Next()
+		return
+	}
+
+	clientID, err := s.Authenticate(c.Request, time.Now())
+	if err != nil {
+		s.logger.Warn("authentication failed",
+			"request_id", logger.RequestID(c),
+			"client_id", c.GetHeader(ClientIDHeader),
+			"error", err,
+		)
+		c.Header("WWW-Authenticate", "Signature")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"message": err.Error(),
+			"code":    "unauthenticated",
+		})
+		return
+	}
+	c.Set(reserve.AuthenticatedClientIDKey, clientID)
+
+	c.Next()
+	return
+}
+
+// nonces remembers the nonces seen recently. Expired ones are dropped as new
+// ones come in.
+type nonces struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	swept time.Time
+}
+
+func newNonces() *nonces {
+	return &nonces{seen: map[string]time.Time{}}
+}
+
+// add records nonce until now+ttl and reports whether it was new.
+func (n *nonces) add(nonce string, now time.Time, ttl time.Duration) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if now.Sub(n.swept) >= ttl {
+		for seen, expiry := range n.seen {
+			if now.After(expiry) {
+				delete(n.seen, seen)
+			}
+		}
+		n.swept = now
+	}
+
+	if expiry, ok := n.seen[nonce]; ok && !now.After(expiry) {
+		return false
+	}
+	n.seen[nonce] = now.Add(ttl)
+
+	return true
+}
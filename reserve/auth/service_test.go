@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reserve/reserve"
+	"reserve/reserve/logger"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestService(t *testing.T) Service {
+	config := reserve.NewConfig().Auth
+	config.Enabled = true
+	config.Clients = []string{"1234:first-client-secret", "5678:second-client-secret"}
+
+	s, err := NewService(config, logger.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func signedRequest(clientID, secret string, timestamp time.Time, nonce, body string) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/api/users/1/reserve?client.id="+clientID, strings.NewReader(body))
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	signature := Sign([]byte(secret), request.Method, request.URL.Path, request.URL.RawQuery, ts, nonce, []byte(body))
+
+	request.Header.Set(ClientIDHeader, clientID)
+	request.Header.Set(TimestampHeader, ts)
+	request.Header.Set(NonceHeader, nonce)
+	request.Header.Set(SignatureHeader, hex.EncodeToString(signature))
+
+	return request
+}
+
+func TestAPIKeys(t *testing.T) {
+	s := newTestService(t)
+
+	request := httptest.NewRequest(http.MethodPost, "/api/users/1/reserve", nil)
+	request.Header.Set(APIKeyHeader, "second-client-secret")
+	if clientID, err := s.Authenticate(request, time.Now()); err != nil || clientID != "5678" {
+		t.Errorf("expected client 5678, got %q %v", clientID, err)
+	}
+
+	request.Header.Set(APIKeyHeader, "guessed-secret")
+	if _, err := s.Authenticate(request, time.Now()); err != UnknownClientError {
+		t.Errorf("expected UnknownClientError, got %v", err)
+	}
+
+	request = httptest.NewRequest(http.MethodPost, "/api/users/1/reserve", nil)
+	request.Header.Set(ClientIDHeader, "1234")
+	if _, err := s.Authenticate(request, time.Now()); err != MissingCredentialsError {
+		t.Errorf("expected a bare client ID to be refused, got %v", err)
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	s := newTestService(t)
+	now := time.Now()
+	body := `{"amount": 25}`
+
+	request := signedRequest("1234", "first-client-secret", now, "nonce-1", body)
+	clientID, err := s.Authenticate(request, now)
+	if err != nil || clientID != "1234" {
+		t.Fatalf("expected client 1234, got %q %v", clientID, err)
+	}
+	if restored, _ := ioutil.ReadAll(request.Body); string(restored) != body {
+		t.Errorf("expected the body to be restored, got %q", restored)
+	}
+
+	request = signedRequest("1234", "first-client-secret", now, "nonce-1", body)
+	if _, err := s.Authenticate(request, now); err != ReplayedNonceError {
+		t.Errorf("expected a replay to be refused, got %v", err)
+	}
+
+	request = signedRequest("1234", "first-client-secret", now.Add(-10*time.Minute), "nonce-2", body)
+	if _, err := s.Authenticate(request, now); err != StaleTimestampError {
+		t.Errorf("expected a stale timestamp to be refused, got %v", err)
+	}
+
+	request = signedRequest("1234", "second-client-secret", now, "nonce-3", body)
+	if _, err := s.Authenticate(request, now); err != InvalidSignatureError {
+		t.Errorf("expected a signature with another secret to be refused, got %v", err)
+	}
+
+	request = signedRequest("1234", "first-client-secret", now, "nonce-4", body)
+	request.Body = ioutil.NopCloser(strings.NewReader(`{"amount": 2500}`))
+	if _, err := s.Authenticate(request, now); err != InvalidSignatureError {
+		t.Errorf("expected a tampered body to be refused, got %v", err)
+	}
+
+	// the invalid request above did not use up its nonce
+	request = signedRequest("1234", "first-client-secret", now, "nonce-4", body)
+	if _, err := s.Authenticate(request, now); err != nil {
+		t.Errorf("expected nonce-4 to be accepted, got %v", err)
+	}
+}
+
+func TestNoncesExpire(t *testing.T) {
+	n := newNonces()
+	now := time.Now()
+
+	if !n.add("1234:a", now, time.Minute) || n.add("1234:a", now.Add(time.Second), time.Minute) {
+		t.Fatal("expected the nonce to be accepted once")
+	}
+	if !n.add("1234:a", now.Add(2*time.Minute), time.Minute) {
+		t.Error("expected an expired nonce to be forgotten")
+	}
+	if len(n.seen) != 1 {
+		t.Errorf("expected expired nonces to be swept, got %d", len(n.seen))
+	}
+}
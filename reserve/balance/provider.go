@@ -0,0 +1,99 @@
+package balance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reserve/reserve"
+	"sync"
+)
+
+var (
+	UnknownProviderError  = errors.New("unknown balance provider")
+	UnexpectedStatusError = errors.New("unexpected balance provider status")
+)
+
+// Provider reports how much of a user's money is available to be reserved,
+// in cents.
+type Provider interface {
+	Available(userID uint64) (int64, error)
+}
+
+func NewProvider(config reserve.BalanceConfig) (Provider, error) {
+	switch config.Provider {
+	case "memory":
+		return NewMemory(config.DefaultBalance), nil
+	case "http":
+		return NewHTTP(config.URL, &http.Client{Timeout: config.Timeout}), nil
+	default:
+		return nil, UnknownProviderError
+	}
+}
+
+type Memory struct {
+	mu             sync.RWMutex
+	balances       map[uint64]int64
+	defaultBalance int64
+}
+
+func NewMemory(defaultBalance int64) *Memory {
+	return &Memory{
+		balances:       map[uint64]int64{},
+		defaultBalance: defaultBalance,
+	}
+}
+
+func (m *Memory) Available(userID uint64) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	available, ok := m.balances[userID]
+	if !ok {
+		return m.defaultBalance, nil
+	}
+
+	return available, nil
+}
+
+func (m *Memory) Set(userID uint64, available int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.balances[userID] = available
+}
+
+// HTTP asks a balance service for GET {url}/users/{user_id}/balance, which
+// answers {"available": 12.34} in the same units as reserve bodies.
+type HTTP struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTP(url string, client *http.Client) *HTTP {
+	return &HTTP{
+		url:    url,
+		client: client,
+	}
+}
+
+func (h *HTTP) Available(userID uint64) (int64, error) {
+	resp, err := h.client.Get(fmt.Sprintf("%s/users/%d/balance", h.url, userID))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, UnexpectedStatusError
+	}
+
+	var body struct {
+		Available float64 `json:"available"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, err
+	}
+
+	return int64(body.Available * 100), nil
+}
@@ -0,0 +1,70 @@
+package balance
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reserve/reserve"
+	"testing"
+	"time"
+)
+
+func TestHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/1/balance":
+			w.Write([]byte(`{"available": 12.34}`))
+		case "/users/2/balance":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/users/3/balance":
+			w.Write([]byte(`not json`))
+		case "/users/4/balance":
+			time.Sleep(100 * time.Millisecond)
+			w.Write([]byte(`{"available": 1}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	config := reserve.NewConfig().Balance
+	config.Provider = "http"
+	config.URL = server.URL
+	config.Timeout = 20 * time.Millisecond
+	provider, err := NewProvider(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if available, err := provider.Available(1); err != nil || available != 1234 {
+		t.Errorf("expected 1234 cents, got %d %v", available, err)
+	}
+	if _, err := provider.Available(2); err != UnexpectedStatusError {
+		t.Errorf("expected UnexpectedStatusError, got %v", err)
+	}
+	if _, err := provider.Available(3); err == nil {
+		t.Error("expected an invalid body to fail")
+	}
+	if _, err := provider.Available(4); err == nil {
+		t.Error("expected a slow balance service to time out")
+	}
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory(500)
+	m.Set(1, 100)
+
+	if available, _ := m.Available(1); available != 100 {
+		t.Errorf("expected 100, got %d", available)
+	}
+	if available, _ := m.Available(2); available != 500 {
+		t.Errorf("expected the default balance, got %d", available)
+	}
+}
+
+func TestUnknownProvider(t *testing.T) {
+	config := reserve.NewConfig().Balance
+	config.Provider = "ledger"
+	if _, err := NewProvider(config); err != UnknownProviderError {
+		t.Errorf("expected UnknownProviderError, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// ring is a consistent hash ring of peers, each placed on it virtualNodes
+// times so users spread evenly and a membership change only moves the users
+// of the peers that joined or left.
+type ring struct {
+	peers  []string
+	hashes []uint64
+	owners map[uint64]string
+}
+
+func newRing(peers []string, virtualNodes int) *ring {
+	if virtualNodes <= 0 {
+		virtualNodes = 1
+	}
+
+	r := &ring{
+		peers:  append([]string(nil), peers...),
+		owners: map[uint64]string{},
+	}
+	for _, peer := range peers {
+		for i := 0; i < virtualNodes; i++ {
+			hash := hashString(peer + "#" + strconv.Itoa(i))
+			if _, taken := r.owners[hash]; taken {
+				continue
+			}
+			r.owners[hash] = peer
+			r.hashes = append(r.hashes, hash)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+
+	return r
+}
+
+// Owner is the peer owning userID, the first one found clockwise from the
+// user's hash. It is empty when the ring has no peers.
+func (r *ring) Owner(userID uint64) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	hash := hashUser(userID)
+	i := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= hash
+	})
+	if i == len(r.hashes) {
+		i = 0
+	}
+
+	return r.owners[r.hashes[i]]
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	return mix(h.Sum64())
+}
+
+func hashUser(userID uint64) uint64 {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], userID)
+
+	h := fnv.New64a()
+	h.Write(b[:])
+
+	return mix(h.Sum64())
+}
+
+// mix spreads the fnv hash of short, similar inputs over the whole ring.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h
+}
@@ -0,0 +1,41 @@
+package cluster
+
+import (
+	"testing"
+)
+
+func TestRingSpreadsAndMovesFewUsers(t *testing.T) {
+	peers := []string{"http://a:8080", "http://b:8080", "http://c:8080", "http://d:8080"}
+	before := newRing(peers, 128)
+	after := newRing(peers[:3], 128)
+
+	const users = 40000
+	owned := map[string]int{}
+	moved := 0
+	for userID := uint64(0); userID < users; userID++ {
+		owner := before.Owner(userID)
+		owned[owner]++
+
+		if newOwner := after.Owner(userID); newOwner != owner {
+			if owner != peers[3] {
+				t.Fatalf("user %d moved from %s to %s though its owner did not leave", userID, owner, newOwner)
+			}
+			moved++
+		}
+	}
+
+	for _, peer := range peers {
+		if share := float64(owned[peer]) / users; share < 0.15 || share > 0.35 {
+			t.Fatalf("expected an even spread, %s owns %.2f of the users", peer, share)
+		}
+	}
+	if moved != owned[peers[3]] {
+		t.Fatalf("expected only the users of the peer leaving to move, %d moved", moved)
+	}
+}
+
+func TestEmptyRingOwnsNothing(t *testing.T) {
+	if owner := newRing(nil, 128).Owner(1); owner != "" {
+		t.Fatalf("expected no owner, got %s", owner)
+	}
+}
@@ -0,0 +1,378 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"reserve/reserve"
+	"reserve/reserve/logger"
+	"reserve/reserve/tracing"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	NoPeersError     = errors.New("cluster mode needs at least one peer")
+	InvalidPeerError = errors.New("peers must be absolute http urls")
+)
+
+const (
+	// ForwardedHeader marks requests forwarded by a peer, they are always
+	// served by the receiving instance. It names the peer, which sends
+	// ForwardedAtHeader and ForwardSignatureHeader along to prove it.
+	ForwardedHeader        = "X-Reserve-Forwarded-By"
+	ForwardedAtHeader      = "X-Reserve-Forwarded-At"
+	ForwardSignatureHeader = "X-Reserve-Forward-Signature"
+	// OwnerHeader names the instance that served a request.
+	OwnerHeader = "X-Reserve-Owner"
+
+	// maxForwardAge bounds how long a forwarded request may be replayed
+	maxForwardAge = 30 * time.Second
+)
+
+// membership is swapped as a whole when the peers change.
+type membership struct {
+	ring    *ring
+	proxies map[string]*httputil.ReverseProxy
+}
+
+type state struct {
+	// mu serializes membership changes, requests read the current one
+	// without locking
+	mu         sync.Mutex
+	membership atomic.Value
+}
+
+// Service hashes user IDs to the instance owning them, so every request of a
+// user is served by the same heat map and registry. Requests reaching any
+// other instance are forwarded to the owner.
+type Service struct {
+	enabled      bool
+	self         string
+	secret       []byte
+	virtualNodes int
+	transport    http.RoundTripper
+	state        *state
+	// onHandoff releases the buckets of the users for which owns is false.
+	onHandoff func(owns func(userID uint64) bool) int
+}
+
+type PeersBody struct {
+	Peers []string `json:"peers"`
+}
+
+type Membership struct {
+	Enabled bool     `json:"enabled"`
+	Self    string   `json:"self"`
+	Peers   []string `json:"peers"`
+}
+
+type Handoff struct {
+	Membership
+	HandedOff int `json:"handed_off"`
+}
+
+func NewService(config reserve.ClusterConfig, onHandoff func(owns func(userID uint64) bool) int) (Service, error) {
+	s := Service{
+		enabled:      config.Enabled,
+		self:         normalize(config.Self),
+		secret:       []byte(config.Secret),
+		virtualNodes: config.VirtualNodes,
+		transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: config.ForwardTimeout,
+			MaxIdleConnsPerHost:   64,
+		},
+		state:     &state{},
+		onHandoff: onHandoff,
+	}
+
+	if !config.Enabled {
+		s.state.membership.Store(membership{ring: newRing(nil, 0)})
+		return s, nil
+	}
+
+	m, err := s.newMembership(config.Peers)
+	if err != nil {
+		return Service{}, err
+	}
+	s.state.membership.Store(m)
+
+	return s, nil
+}
+
+func (s *Service) newMembership(peers []string) (membership, error) {
+	if len(peers) == 0 {
+		return membership{}, NoPeersError
+	}
+
+	m := membership{proxies: map[string]*httputil.ReverseProxy{}}
+	normalized := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		peer = normalize(peer)
+		target, err := url.Parse(peer)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return membership{}, InvalidPeerError
+		}
+		if _, ok := m.proxies[peer]; ok {
+			continue
+		}
+
+		normalized = append(normalized, peer)
+		m.proxies[peer] = s.newProxy(peer, target)
+	}
+	m.ring = newRing(normalized, s.virtualNodes)
+
+	return m, nil
+}
+
+// newProxy forwards requests to peer, signed for it only.
+func (s *Service) newProxy(peer string, target *url.URL) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = s.transport
+
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+
+		// a request whose body cannot be read goes unsigned, and the owner
+		// refuses it as forwarded
+		body, err := readBody(req)
+		if err != nil {
+			return
+		}
+
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(ForwardedHeader, s.self)
+		req.Header.Set(ForwardedAtHeader, timestamp)
+		req.Header.Set(ForwardSignatureHeader, hex.EncodeToString(
+			Sign(s.secret, s.self, peer, req.Method, req.URL.Path, req.URL.RawQuery, timestamp, body),
+		))
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(`{"message":"Could not reach the owner instance!","code":"owner_unavailable"}`))
+	}
+
+	return proxy
+}
+
+func (s *Service) load() membership {
+	return s.state.membership.Load().(membership)
+}
+
+// Owner is the instance owning userID, empty when cluster mode is disabled.
+func (s *Service) Owner(userID uint64) string {
+	return s.load().ring.Owner(userID)
+}
+
+// Owns reports whether this instance serves the requests of userID, which it
+// always does when cluster mode is disabled.
+func (s *Service) Owns(userID uint64) bool {
+	owner := s.Owner(userID)
+
+	return owner == "" || owner == s.self
+}
+
+// SetPeers replaces the peers and hands off the buckets of the users this
+// instance no longer owns. Requests of those users are forwarded to their
+// new owner as soon as the peers are replaced.
+func (s *Service) SetPeers(peers []string) (int, error) {
+	if !s.enabled {
+		return 0, NoPeersError
+	}
+
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	m, err := s.newMembership(peers)
+	if err != nil {
+		return 0, err
+	}
+	s.state.membership.Store(m)
+
+	if s.onHandoff == nil {
+		return 0, nil
+	}
+
+	return s.onHandoff(s.Owns), nil
+}
+
+func (s *Service) Membership() Membership {
+	peers := s.load().ring.peers
+	if peers == nil {
+		peers = []string{}
+	}
+
+	return Membership{
+		Enabled: s.enabled,
+		Self:    s.self,
+		Peers:   peers,
+	}
+}
+
+// Sign is the signature of a request forwarded by peer to target, keyed with
+// the secret shared by the cluster.
+func Sign(secret []byte, peer, target, method, path, rawQuery, timestamp string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{
+		peer,
+		target,
+		method,
+		path,
+		rawQuery,
+		timestamp,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")))
+
+	return mac.Sum(nil)
+}
+
+// readBody reads the body of request and puts it back for the next reader.
+func readBody(request *http.Request) ([]byte, error) {
+	if request.Body == nil {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return nil, err
+	}
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
+
+// forwarded reports whether request was forwarded to this instance by one of
+// the peers of m: it names a peer, was sent less than maxForwardAge ago and
+// is signed with the cluster secret for this instance.
+func (s *Service) forwarded(request *http.Request, m membership, now time.Time) bool {
+	peer := request.Header.Get(ForwardedHeader)
+	if _, ok := m.proxies[peer]; !ok {
+		return false
+	}
+
+	timestamp := request.Header.Get(ForwardedAtHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > maxForwardAge || age < -maxForwardAge {
+		return false
+	}
+
+	body, err := readBody(request)
+	if err != nil {
+		return false
+	}
+
+	expected := Sign(s.secret, peer, s.self, request.Method, request.URL.Path, request.URL.RawQuery, timestamp, body)
+	decoded, err := hex.DecodeString(request.Header.Get(ForwardSignatureHeader))
+
+	return err == nil && hmac.Equal(decoded, expected)
+}
+
+// RegisterForwardMiddleware forwards the requests of users owned by another
+// instance. Requests already forwarded by a peer are served here even when
+// the peers disagree on the owner, rather than bouncing between them; the
+// forwarded headers of requests that cannot prove they come from a peer are
+// dropped.
+func (s *Service) RegisterForwardMiddleware(c *gin.Context) {
+	m := s.load()
+	if !s.enabled || !s.forwarded(c.Request, m, time.Now()) {
+		c.Request.Header.Del(ForwardedHeader)
+		c.Request.Header.Del(ForwardedAtHeader)
+		c.Request.Header.Del(ForwardSignatureHeader)
+	}
+
+	if !s.enabled {
+		c.Next()
+		return
+	}
+
+	userIDParam := c.Param("user_id")
+	userID, err := strconv.ParseUint(userIDParam, 10, 64)
+	if err != nil {
+		c.Next()
+		return
+	}
+
+	owner := m.ring.Owner(userID)
+	if owner == "" || owner == s.self || c.GetHeader(ForwardedHeader) != "" {
+		c.Header(OwnerHeader, s.self)
+		c.Next()
+		return
+	}
+
+	span := tracing.FromContext(c).StartChild("cluster.forward")
+	span.SetAttribute("owner", owner)
+	defer span.Finish()
+
+	// the owner logs and traces the request under the same request ID and
+	// trace, and echoes the ID back itself
+	if requestID := logger.RequestID(c); requestID != "" {
+		c.Request.Header.Set(logger.RequestIDHeader, requestID)
+		c.Writer.Header().Del(logger.RequestIDHeader)
+	}
+	if traceparent := span.TraceParent(); traceparent != "" {
+		c.Request.Header.Set(tracing.TraceParentHeader, traceparent)
+	}
+
+	m.proxies[owner].ServeHTTP(c.Writer, c.Request)
+	c.Abort()
+
+	return
+}
+
+func (s *Service) HandleMembershipRequest(c *gin.Context) {
+	c.JSON(http.StatusOK, s.Membership())
+	return
+}
+
+func (s *Service) HandleSetPeers(c *gin.Context) {
+	var body PeersBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid body!",
+			"code":    "invalid_body",
+		})
+		return
+	}
+
+	if !s.enabled {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"message": "Cluster mode is disabled!",
+			"code":    "cluster_disabled",
+		})
+		return
+	}
+
+	handedOff, err := s.SetPeers(body.Peers)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": err.Error(),
+			"code":    "invalid_peers",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Handoff{s.Membership(), handedOff})
+	return
+}
+
+func normalize(peer string) string {
+	return strings.TrimRight(strings.TrimSpace(peer), "/")
+}
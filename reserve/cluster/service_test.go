@@ -0,0 +1,66 @@
+package cluster
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"reserve/reserve"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForwardedRequestsMustBeSigned(t *testing.T) {
+	config := reserve.NewConfig().Cluster
+	config.Enabled = true
+	config.Self = "http://a:8080"
+	config.Peers = []string{"http://a:8080", "http://b:8080"}
+	config.Secret = "cluster-secret"
+	s, err := NewService(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	request := func(peer, target, secret, path, body string, sentAt time.Time) bool {
+		timestamp := strconv.FormatInt(sentAt.Unix(), 10)
+		signature := Sign([]byte(secret), peer, target, "POST", "/api/users/1/reserve", "", timestamp, []byte(`{"amount":25}`))
+
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set(ForwardedHeader, peer)
+		req.Header.Set(ForwardedAtHeader, timestamp)
+		req.Header.Set(ForwardSignatureHeader, hex.EncodeToString(signature))
+
+		forwarded := s.forwarded(req, s.load(), now)
+		if read, _ := ioutil.ReadAll(req.Body); string(read) != body {
+			t.Errorf("expected the body to be kept for the handler, got %q", read)
+		}
+
+		return forwarded
+	}
+
+	path, body := "/api/users/1/reserve", `{"amount":25}`
+	if !request("http://b:8080", "http://a:8080", "cluster-secret", path, body, now) {
+		t.Error("expected a request signed by a peer to be forwarded")
+	}
+
+	cases := map[string]bool{
+		"unknown peer":    request("http://c:8080", "http://a:8080", "cluster-secret", path, body, now),
+		"other target":    request("http://b:8080", "http://b:8080", "cluster-secret", path, body, now),
+		"wrong secret":    request("http://b:8080", "http://a:8080", "guessed", path, body, now),
+		"other request":   request("http://b:8080", "http://a:8080", "cluster-secret", "/api/users/2/reserve", body, now),
+		"other body":      request("http://b:8080", "http://a:8080", "cluster-secret", path, `{"amount":2500}`, now),
+		"stale":           request("http://b:8080", "http://a:8080", "cluster-secret", path, body, now.Add(-time.Minute)),
+		"from the future": request("http://b:8080", "http://a:8080", "cluster-secret", path, body, now.Add(time.Minute)),
+	}
+	for name, forwarded := range cases {
+		if forwarded {
+			t.Errorf("%s: expected the request not to be taken as forwarded", name)
+		}
+	}
+
+	if s.forwarded(httptest.NewRequest("GET", "/registry/1", nil), s.load(), now) {
+		t.Error("expected an unsigned request not to be taken as forwarded")
+	}
+}
@@ -0,0 +1,227 @@
+package concurrency
+
+import (
+	"errors"
+	"math"
+	"reserve/reserve"
+	"time"
+)
+
+var (
+	UnknownDetectorError = errors.New("unknown concurrency detector")
+)
+
+const (
+	windowSlots = 10
+	historySize = 8
+)
+
+type sample struct {
+	at    time.Time
+	score float64
+}
+
+// entry holds the per-key state of every detector; each detector only reads
+// and writes its own fields.
+type entry struct {
+	// heat
+	heat        float64
+	heatUpdated time.Time
+	// window
+	window     [windowSlots]float64
+	windowSlot int64
+	// rate
+	rate        float64
+	rateUpdated time.Time
+	// inflight
+	inFlight float64
+
+	mode        reserve.AllocationMode
+	modeSince   time.Time
+	transitions uint64
+
+	// ring buffer of the scores seen by the latest checks
+	history     [historySize]sample
+	historyNext int
+}
+
+// empty reports whether no detector holds state for the entry and it is back
+// in standalone mode.
+func (e *entry) empty() bool {
+	return e.heat == 0 && e.window == [windowSlots]float64{} && e.rate == 0 && e.inFlight == 0 &&
+		e.currentMode() == reserve.AllocationModes.Standalone
+}
+
+func (e *entry) record(score float64, now time.Time) {
+	e.history[e.historyNext] = sample{now, score}
+	e.historyNext = (e.historyNext + 1) % historySize
+}
+
+func (e *entry) currentMode() reserve.AllocationMode {
+	if e.mode == "" {
+		return reserve.AllocationModes.Standalone
+	}
+
+	return e.mode
+}
+
+// detector turns the requests seen for a key into a score that is compared
+// against ConcurrrentThresshold. Start and Done bracket every request, with
+// the weight of that request, Expire is run by the sweeper and clears
+// whatever state has gone cold.
+type detector interface {
+	Start(e *entry, weight float64, now time.Time)
+	Done(e *entry, weight float64, now time.Time)
+	Expire(e *entry, now time.Time)
+	Score(e entry, now time.Time) float64
+}
+
+func newDetector(config reserve.ConcurrencyConfig) (detector, error) {
+	switch config.Detector {
+	case "heat":
+		return &heatDetector{config.Heat, config.HalfLife, config.ColdHeat}, nil
+	case "window":
+		slotWidth := config.Window / windowSlots
+		if slotWidth <= 0 {
+			slotWidth = 1
+		}
+		return &windowDetector{slotWidth}, nil
+	case "rate":
+		return &rateDetector{config.Window}, nil
+	case "inflight":
+		return &inFlightDetector{}, nil
+	default:
+		return nil, UnknownDetectorError
+	}
+}
+
+// heatDetector adds a fixed heat per finished request. Heat halves every
+// HalfLife; the decay is applied lazily whenever the entry is read or written.
+type heatDetector struct {
+	heat     float64
+	halfLife time.Duration
+	coldHeat float64
+}
+
+func (d *heatDetector) Start(e *entry, weight float64, now time.Time) {}
+
+func (d *heatDetector) Done(e *entry, weight float64, now time.Time) {
+	e.heat = d.Score(*e, now) + d.heat*weight
+	e.heatUpdated = now
+}
+
+func (d *heatDetector) Expire(e *entry, now time.Time) {
+	e.heat = d.Score(*e, now)
+	e.heatUpdated = now
+
+	if e.heat < d.coldHeat {
+		e.heat = 0
+		e.heatUpdated = time.Time{}
+	}
+}
+
+func (d *heatDetector) Score(e entry, now time.Time) float64 {
+	if e.heat == 0 {
+		return 0
+	}
+
+	elapsed := now.Sub(e.heatUpdated)
+	if elapsed <= 0 {
+		return e.heat
+	}
+
+	return e.heat * math.Exp2(-elapsed.Seconds()/d.halfLife.Seconds())
+}
+
+// windowDetector counts the requests finished during the last Window, kept
+// in windowSlots slots that are recycled as time passes.
+type windowDetector struct {
+	slotWidth time.Duration
+}
+
+func (d *windowDetector) Start(e *entry, weight float64, now time.Time) {}
+
+func (d *windowDetector) Done(e *entry, weight float64, now time.Time) {
+	d.roll(e, now)
+	e.window[e.windowSlot%windowSlots] += weight
+}
+
+func (d *windowDetector) Expire(e *entry, now time.Time) {
+	d.roll(e, now)
+}
+
+func (d *windowDetector) Score(e entry, now time.Time) float64 {
+	d.roll(&e, now)
+
+	var count float64
+	for _, slotCount := range e.window {
+		count += slotCount
+	}
+
+	return count
+}
+
+func (d *windowDetector) roll(e *entry, now time.Time) {
+	slot := now.UnixNano() / int64(d.slotWidth)
+	if slot-e.windowSlot >= windowSlots {
+		e.window = [windowSlots]float64{}
+	} else {
+		for s := e.windowSlot + 1; s <= slot; s++ {
+			e.window[s%windowSlots] = 0
+		}
+	}
+	e.windowSlot = slot
+}
+
+// rateDetector estimates the arrival rate, in requests per second, with a
+// counter that leaks exponentially with time constant Window.
+type rateDetector struct {
+	window time.Duration
+}
+
+func (d *rateDetector) Start(e *entry, weight float64, now time.Time) {
+	e.rate = d.Score(*e, now) + weight/d.window.Seconds()
+	e.rateUpdated = now
+}
+
+func (d *rateDetector) Done(e *entry, weight float64, now time.Time) {}
+
+func (d *rateDetector) Expire(e *entry, now time.Time) {
+	e.rate = d.Score(*e, now)
+	e.rateUpdated = now
+
+	if e.rate < 1e-3 {
+		e.rate = 0
+		e.rateUpdated = time.Time{}
+	}
+}
+
+func (d *rateDetector) Score(e entry, now time.Time) float64 {
+	if e.rate == 0 {
+		return 0
+	}
+
+	return e.rate * math.Exp(-now.Sub(e.rateUpdated).Seconds()/d.window.Seconds())
+}
+
+// inFlightDetector counts the requests of a key currently being served.
+type inFlightDetector struct{}
+
+func (d *inFlightDetector) Start(e *entry, weight float64, now time.Time) {
+	e.inFlight += weight
+}
+
+func (d *inFlightDetector) Done(e *entry, weight float64, now time.Time) {
+	e.inFlight -= weight
+
+	// weights are not integral, do not let rounding keep the entry alive
+	if e.inFlight < 1e-9 {
+		e.inFlight = 0
+	}
+}
+
+func (d *inFlightDetector) Expire(e *entry, now time.Time) {}
+
+func (d *inFlightDetector) Score(e entry, now time.Time) float64 {
+	return float64(e.inFlight)
+}
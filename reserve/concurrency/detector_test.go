@@ -0,0 +1,109 @@
+package concurrency
+
+import (
+	"reserve/reserve"
+	"testing"
+	"time"
+)
+
+func TestDetectors(t *testing.T) {
+	config := reserve.NewConfig().Concurrency
+	now := time.Unix(1000, 0)
+
+	tests := []struct {
+		name     string
+		requests int
+		after    time.Duration
+		expected func(score float64) bool
+	}{
+		{"heat", 3, 0, func(score float64) bool { return score == 30 }},
+		{"heat", 3, 10 * time.Second, func(score float64) bool { return score == 15 }},
+		{"window", 3, 0, func(score float64) bool { return score == 3 }},
+		{"window", 3, 2 * time.Second, func(score float64) bool { return score == 0 }},
+		{"rate", 3, 0, func(score float64) bool { return score == 3 }},
+		{"rate", 3, time.Second, func(score float64) bool { return score > 1.1 && score < 1.2 }},
+		{"inflight", 3, 0, func(score float64) bool { return score == 0 }},
+	}
+
+	for _, test := range tests {
+		config.Detector = test.name
+		d, err := newDetector(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var e entry
+		for i := 0; i < test.requests; i++ {
+			d.Start(&e, 1, now)
+			d.Done(&e, 1, now)
+		}
+
+		if score := d.Score(e, now.Add(test.after)); !test.expected(score) {
+			t.Errorf("%s: unexpected score %v after %v", test.name, score, test.after)
+		}
+	}
+}
+
+func TestWindowDetectorWithTinyWindow(t *testing.T) {
+	config := reserve.NewConfig().Concurrency
+	config.Detector = "window"
+	config.Window = 5 * time.Nanosecond
+
+	d, err := newDetector(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var e entry
+	now := time.Unix(1000, 0)
+	d.Done(&e, 1, now)
+	d.Expire(&e, now.Add(time.Second))
+	if score := d.Score(e, now.Add(time.Second)); score != 0 {
+		t.Errorf("expected the window to have passed, got %v", score)
+	}
+}
+
+func TestInFlightDetectorCountsOpenRequests(t *testing.T) {
+	d := &inFlightDetector{}
+	now := time.Now()
+
+	var e entry
+	d.Start(&e, 1, now)
+	d.Start(&e, 1, now)
+	if score := d.Score(e, now); score != 2 {
+		t.Fatalf("expected two requests in flight, got %v", score)
+	}
+
+	d.Done(&e, 1, now)
+	d.Done(&e, 1, now)
+	if !e.empty() {
+		t.Fatal("expected the entry to be empty once every request finished")
+	}
+}
+
+func TestSweepEvictsColdEntries(t *testing.T) {
+	config := reserve.NewConfig().Concurrency
+	d, _ := newDetector(config)
+	h, _ := newHeatMap(4, 0, "lru")
+
+	start := time.Now()
+	for userID := uint64(0); userID < 10; userID++ {
+		h.LoadAndStore(Key{UserID: userID}, func(e *entry) {
+			d.Done(e, 1, start)
+		})
+	}
+
+	h.Sweep(func(e *entry) {
+		d.Expire(e, start.Add(time.Second))
+	})
+	if size := h.Size(); size != 10 {
+		t.Fatalf("expected warm entries to survive, %d left", size)
+	}
+
+	h.Sweep(func(e *entry) {
+		d.Expire(e, start.Add(10*config.HalfLife))
+	})
+	if size := h.Size(); size != 0 {
+		t.Fatalf("expected cold entries to be evicted, %d left", size)
+	}
+}
@@ -1,80 +1,209 @@
 package concurrency
 
 import (
+	"container/list"
 	"errors"
+	"reserve/reserve/lock"
 	"sync"
 )
 
+// heatMap keeps one entry per key. When capacity is set every shard holds at
+// most its share of it, rounded up, and makes room for new keys by evicting
+// the least recently (lru) or least frequently (lfu) used one. The capacity
+// is therefore approximate, and must be at least the number of shards to
+// mean anything.
 type heatMap struct {
-	// map[uin64]uint64
-	hm sync.Map
-	// map[uin64]syncRWMutex
-	mu sync.Map
+	locks    *lock.Manager
+	shards   []heatShard
+	capacity int
+	lfu      bool
 }
 
-func newHeatMap() heatMap {
-	return heatMap{
-		hm: sync.Map{},
-		mu: sync.Map{},
-	}
+type heatShard struct {
+	mu sync.Mutex
+	// map[Key]*heatItem
+	hm        map[Key]*heatItem
+	lru       *list.List
+	evictions uint64
+}
+
+type heatItem struct {
+	e    entry
+	hits uint64
+	elem *list.Element
+}
+
+type HeatMapStats struct {
+	Size      int        `json:"size"`
+	Capacity  int        `json:"capacity"`
+	Evictions uint64     `json:"evictions"`
+	Locks     lock.Stats `json:"locks"`
 }
 
 var (
-	LoadKeyMapError    = errors.New("could not load heat map key")
-	ParseValueMapError = errors.New("could not load parse map value")
+	LoadKeyMapError            = errors.New("could not load heat map key")
+	UnknownEvictionPolicyError = errors.New("unknown eviction policy")
 )
 
-func (h *heatMap) LoadAndStore(key, initialValue uint64, fn func(entry uint64) uint64) error {
+func newHeatMap(shards, capacity int, policy string) (heatMap, error) {
+	if shards <= 0 {
+		shards = lock.DefaultShards
+	}
+	if policy != "lru" && policy != "lfu" {
+		return heatMap{}, UnknownEvictionPolicyError
+	}
 
-	entry, _ := h.mu.LoadOrStore(key, sync.RWMutex{})
-	mu, ok := entry.(sync.RWMutex)
-	if !ok {
-		return ParseValueMapError
+	h := heatMap{
+		locks:    lock.NewManager(shards),
+		shards:   make([]heatShard, shards),
+		capacity: capacity,
+		lfu:      policy == "lfu",
+	}
+	for i := range h.shards {
+		h.shards[i].hm = map[Key]*heatItem{}
+		h.shards[i].lru = list.New()
 	}
-	mu.Lock()
 
-	entry, _ = h.hm.LoadOrStore(key, initialValue)
-	heat, ok := entry.(uint64)
-	if !ok {
-		mu.Unlock()
-		return ParseValueMapError
+	return h, nil
+}
+
+func (h *heatMap) shard(key Key) *heatShard {
+	return &h.shards[lock.ShardIndex(key.hash(), len(h.shards))]
+}
+
+func (h *heatMap) shardCapacity() int {
+	return (h.capacity + len(h.shards) - 1) / len(h.shards)
+}
+
+// LoadAndStore hands fn the entry of key (the zero entry when absent) and
+// stores it back, dropping it once fn leaves it empty.
+func (h *heatMap) LoadAndStore(key Key, fn func(e *entry)) error {
+	unlock := h.locks.Lock(key.hash())
+	defer unlock()
+
+	shard := h.shard(key)
+
+	var e entry
+	shard.mu.Lock()
+	if item, ok := shard.hm[key]; ok {
+		e = item.e
+	}
+	shard.mu.Unlock()
+
+	fn(&e)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	item, ok := shard.hm[key]
+	if e.empty() {
+		if ok {
+			shard.lru.Remove(item.elem)
+			delete(shard.hm, key)
+		}
+		return nil
 	}
 
-	nextVal := fn(heat)
-	if nextVal == 0 {
-		h.hm.Delete(key)
-		defer h.mu.Delete(key)
-	} else {
-		h.hm.Store(key, nextVal)
+	if !ok {
+		if h.capacity > 0 {
+			for len(shard.hm) >= h.shardCapacity() {
+				h.evict(shard)
+			}
+		}
+
+		item = &heatItem{elem: shard.lru.PushFront(key)}
+		shard.hm[key] = item
 	}
+	item.e = e
+	item.hits++
+	shard.lru.MoveToFront(item.elem)
 
-	mu.Unlock()
 	return nil
 }
 
-func (h *heatMap) Load(key uint64) (uint64, error) {
+// evict drops one entry of shard, which must be locked.
+func (h *heatMap) evict(shard *heatShard) {
+	victim := shard.lru.Back()
+	if h.lfu {
+		for elem := shard.lru.Back(); elem != nil; elem = elem.Prev() {
+			if shard.hm[elem.Value.(Key)].hits < shard.hm[victim.Value.(Key)].hits {
+				victim = elem
+			}
+		}
+	}
+
+	shard.lru.Remove(victim)
+	delete(shard.hm, victim.Value.(Key))
+	shard.evictions++
+}
 
-	entry, ok := h.mu.Load(key)
-	if !ok {
-		return 0, LoadKeyMapError
+// Sweep runs fn over every entry, dropping those it leaves empty.
+func (h *heatMap) Sweep(fn func(e *entry)) {
+	for i := range h.shards {
+		shard := &h.shards[i]
+
+		shard.mu.Lock()
+		keys := make([]Key, 0, len(shard.hm))
+		for key := range shard.hm {
+			keys = append(keys, key)
+		}
+		shard.mu.Unlock()
+
+		for _, key := range keys {
+			h.LoadAndStore(key, fn)
+		}
 	}
+}
 
-	mu, ok := entry.(sync.RWMutex)
-	if !ok {
-		return 0, ParseValueMapError
+// Range calls fn with a copy of every entry, holding one shard at a time.
+func (h *heatMap) Range(fn func(key Key, e entry)) {
+	for i := range h.shards {
+		shard := &h.shards[i]
+
+		shard.mu.Lock()
+		for key, item := range shard.hm {
+			fn(key, item.e)
+		}
+		shard.mu.Unlock()
 	}
-	mu.RLock()
-	defer mu.RUnlock()
+}
 
-	entry, ok = h.hm.Load(key)
-	if !ok {
-		return 0, LoadKeyMapError
+func (h *heatMap) Size() int {
+	size := 0
+	for i := range h.shards {
+		h.shards[i].mu.Lock()
+		size += len(h.shards[i].hm)
+		h.shards[i].mu.Unlock()
 	}
 
-	heat, ok := entry.(uint64)
+	return size
+}
+
+func (h *heatMap) Load(key Key) (entry, error) {
+	shard := h.shard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	item, ok := shard.hm[key]
 	if !ok {
-		return 0, ParseValueMapError
+		return entry{}, LoadKeyMapError
+	}
+
+	return item.e, nil
+}
+
+func (h *heatMap) Stats() HeatMapStats {
+	stats := HeatMapStats{
+		Capacity: h.capacity,
+		Locks:    h.locks.Stats(),
+	}
+	for i := range h.shards {
+		h.shards[i].mu.Lock()
+		stats.Size += len(h.shards[i].hm)
+		stats.Evictions += h.shards[i].evictions
+		h.shards[i].mu.Unlock()
 	}
 
-	return heat, nil
+	return stats
 }
@@ -0,0 +1,45 @@
+package concurrency
+
+import "testing"
+
+func TestHeatMapEviction(t *testing.T) {
+	touch := func(h *heatMap, userID uint64, times int) {
+		for i := 0; i < times; i++ {
+			h.LoadAndStore(Key{UserID: userID}, func(e *entry) {
+				e.inFlight = 1
+			})
+		}
+	}
+
+	tests := []struct {
+		policy  string
+		evicted uint64
+	}{
+		// user 1 is the least recently used
+		{"lru", 1},
+		// user 2 is the least frequently used
+		{"lfu", 2},
+	}
+
+	for _, test := range tests {
+		h, err := newHeatMap(1, 2, test.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		touch(&h, 1, 3)
+		touch(&h, 2, 1)
+		touch(&h, 3, 1)
+
+		if _, err := h.Load(Key{UserID: test.evicted}); err != LoadKeyMapError {
+			t.Errorf("%s: expected user %d to be evicted", test.policy, test.evicted)
+		}
+		if stats := h.Stats(); stats.Size != 2 || stats.Evictions != 1 {
+			t.Errorf("%s: unexpected stats %+v", test.policy, stats)
+		}
+	}
+
+	if _, err := newHeatMap(1, 2, "fifo"); err != UnknownEvictionPolicyError {
+		t.Fatalf("expected an unknown policy error, got %v", err)
+	}
+}
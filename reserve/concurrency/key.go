@@ -0,0 +1,58 @@
+package concurrency
+
+import (
+	"errors"
+	"hash/fnv"
+	"reserve/reserve"
+)
+
+var (
+	UnknownKeyError = errors.New("unknown concurrency key")
+)
+
+// Key identifies what heat is tracked for. Depending on KeyBy the client or
+// the reason are left empty so that all of them share the user's heat.
+type Key struct {
+	UserID   uint64         `json:"user_id"`
+	ClientID string         `json:"client_id,omitempty"`
+	Reason   reserve.Reason `json:"reason,omitempty"`
+}
+
+func (k Key) hash() uint64 {
+	if k.ClientID == "" && k.Reason == "" {
+		return k.UserID
+	}
+
+	h := fnv.New64a()
+	var userID [8]byte
+	for i := range userID {
+		userID[i] = byte(k.UserID >> (8 * i))
+	}
+	h.Write(userID[:])
+	h.Write([]byte(k.ClientID))
+	h.Write([]byte{0})
+	h.Write([]byte(k.Reason))
+
+	return h.Sum64()
+}
+
+type keyFunc func(userID uint64, clientID string, reason reserve.Reason) Key
+
+func newKeyFunc(keyBy string) (keyFunc, error) {
+	switch keyBy {
+	case "user":
+		return func(userID uint64, clientID string, reason reserve.Reason) Key {
+			return Key{UserID: userID}
+		}, nil
+	case "user_client":
+		return func(userID uint64, clientID string, reason reserve.Reason) Key {
+			return Key{UserID: userID, ClientID: clientID}
+		}, nil
+	case "user_reason":
+		return func(userID uint64, clientID string, reason reserve.Reason) Key {
+			return Key{UserID: userID, Reason: reason}
+		}, nil
+	default:
+		return nil, UnknownKeyError
+	}
+}
@@ -0,0 +1,43 @@
+package concurrency
+
+import (
+	"reserve/reserve"
+	"reserve/reserve/metrics"
+)
+
+var (
+	concurrencyChecks = metrics.NewCounterVec(
+		"reserve_concurrency_checks_total",
+		"Concurrency checks, by the allocation mode they resulted in.",
+		"mode",
+	)
+	modeTransitions = metrics.NewCounterVec(
+		"reserve_mode_transitions_total",
+		"Keys switching allocation mode, by the mode switched to.",
+		"mode",
+	)
+	heatMapExpirations = metrics.NewCounterVec(
+		"reserve_heat_map_expirations_total",
+		"Keys dropped from the heat map by the sweeper once gone cold.",
+	)
+)
+
+// RegisterMetrics exposes the size of the heat map on every scrape.
+func (s *Service) RegisterMetrics(r *metrics.Registry) {
+	r.GaugeFunc("reserve_heat_map_keys", "Keys tracked in the heat map.", func() float64 {
+		return float64(s.heatMap.Size())
+	})
+	r.GaugeFunc("reserve_heat_map_bucket_keys", "Keys of the heat map in bucket mode.", func() float64 {
+		count := 0
+		s.heatMap.Range(func(key Key, e entry) {
+			if e.currentMode() == reserve.AllocationModes.Bucket {
+				count++
+			}
+		})
+
+		return float64(count)
+	})
+	r.CounterFunc("reserve_heat_map_evictions_total", "Keys evicted from the heat map to make room.", func() float64 {
+		return float64(s.heatMap.Stats().Evictions)
+	})
+}
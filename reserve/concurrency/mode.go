@@ -0,0 +1,89 @@
+package concurrency
+
+import (
+	"reserve/reserve"
+	"time"
+)
+
+type KeyState struct {
+	Key         Key                    `json:"key"`
+	Score       float64                `json:"score"`
+	Mode        reserve.AllocationMode `json:"mode"`
+	Since       time.Time              `json:"since"`
+	Transitions uint64                 `json:"transitions"`
+	History     []Sample               `json:"history"`
+}
+
+type Sample struct {
+	At    time.Time `json:"at"`
+	Score float64   `json:"score"`
+}
+
+// hysteresis moves an entry into bucket mode once its score goes above enter
+// and back to standalone once it falls below exit, never leaving a mode
+// before minDwell has passed.
+type hysteresis struct {
+	enter    float64
+	exit     float64
+	minDwell time.Duration
+}
+
+func (h hysteresis) apply(e *entry, score float64, now time.Time) {
+	if now.Sub(e.modeSince) < h.minDwell {
+		return
+	}
+
+	switch e.currentMode() {
+	case reserve.AllocationModes.Standalone:
+		if score > h.enter {
+			h.switchTo(e, reserve.AllocationModes.Bucket, now)
+		}
+	case reserve.AllocationModes.Bucket:
+		if score < h.exit {
+			h.switchTo(e, reserve.AllocationModes.Standalone, now)
+		}
+	}
+}
+
+func (h hysteresis) switchTo(e *entry, mode reserve.AllocationMode, now time.Time) {
+	e.mode = mode
+	e.modeSince = now
+	e.transitions++
+
+	modeTransitions.With(string(mode)).Inc()
+}
+
+func keyState(key Key, e entry, score float64) KeyState {
+	state := KeyState{
+		Key:         key,
+		Score:       score,
+		Mode:        e.currentMode(),
+		Since:       e.modeSince,
+		Transitions: e.transitions,
+		History:     []Sample{},
+	}
+
+	// oldest first
+	for i := 0; i < historySize; i++ {
+		s := e.history[(e.historyNext+i)%historySize]
+		if !s.at.IsZero() {
+			state.History = append(state.History, Sample{s.at, s.score})
+		}
+	}
+
+	return state
+}
+
+// hottest is a min-heap on score keeping the top N key states.
+type hottest []KeyState
+
+func (h hottest) Len() int            { return len(h) }
+func (h hottest) Less(i, j int) bool  { return h[i].Score < h[j].Score }
+func (h hottest) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *hottest) Push(x interface{}) { *h = append(*h, x.(KeyState)) }
+func (h *hottest) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
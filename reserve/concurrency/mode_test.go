@@ -0,0 +1,40 @@
+package concurrency
+
+import (
+	"reserve/reserve"
+	"testing"
+	"time"
+)
+
+func TestHysteresis(t *testing.T) {
+	h := hysteresis{enter: 10, exit: 5, minDwell: time.Second}
+	now := time.Now()
+
+	var e entry
+	steps := []struct {
+		score    float64
+		after    time.Duration
+		expected reserve.AllocationMode
+	}{
+		{11, 0, reserve.AllocationModes.Bucket},
+		// below exit but still dwelling in bucket mode
+		{1, 500 * time.Millisecond, reserve.AllocationModes.Bucket},
+		// between thresholds keeps the current mode
+		{7, 2 * time.Second, reserve.AllocationModes.Bucket},
+		{4, 3 * time.Second, reserve.AllocationModes.Standalone},
+		{7, 5 * time.Second, reserve.AllocationModes.Standalone},
+		// above enter but still dwelling in standalone mode
+		{11, 3500 * time.Millisecond, reserve.AllocationModes.Standalone},
+	}
+
+	for i, step := range steps {
+		h.apply(&e, step.score, now.Add(step.after))
+		if mode := e.currentMode(); mode != step.expected {
+			t.Fatalf("step %d: expected %s, got %s", i, step.expected, mode)
+		}
+	}
+
+	if e.transitions != 2 {
+		t.Fatalf("expected two transitions, got %d", e.transitions)
+	}
+}
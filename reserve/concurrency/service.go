@@ -1,93 +1,295 @@
 package concurrency
 
 import (
+	"container/heap"
 	"github.com/gin-gonic/gin"
+	"net/http"
 	"reserve/reserve"
+	"reserve/reserve/logger"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+type tuning struct {
+	detector   detector
+	amountUnit int64
+	hysteresis hysteresis
+}
+
 type Service struct {
-	heatMap    heatMap
-	decayDelay time.Duration
-	decay      uint
-	heat       int
-	concurrencyThresshold uint64
+	heatMap heatMap
+	keyOf   keyFunc
+	// tuning holds the settings that can be reloaded at runtime
+	tuning *atomic.Value
+	// onBucketMode is called with the request that moved a key into bucket
+	// mode.
+	onBucketMode func(reserve.ReserveRequest)
+	logger       *logger.Logger
+	stop         chan struct{}
+	// stopped is done once the last snapshot is saved
+	stopped *sync.WaitGroup
+	// snapshotStatus holds the snapshotStatus of the last periodic snapshot
+	snapshotStatus *atomic.Value
 }
 
-func NewService(config reserve.ConcurrencyConfig) Service {
-	return Service{
-		heatMap:    newHeatMap(),
-		decayDelay: config.DecayDelay,
-		decay:      config.Decay,
-		heat:       config.Heat,
-		concurrencyThresshold: config.ConcurrrentThresshold,
+func NewService(
+	config reserve.ConcurrencyConfig,
+	onBucketMode func(reserve.ReserveRequest),
+	logger *logger.Logger,
+) (Service, error) {
+	tuning, err := newTuning(config)
+	if err != nil {
+		return Service{}, err
+	}
+
+	keyOf, err := newKeyFunc(config.KeyBy)
+	if err != nil {
+		return Service{}, err
+	}
+
+	heatMap, err := newHeatMap(config.LockShards, config.Capacity, config.EvictionPolicy)
+	if err != nil {
+		return Service{}, err
+	}
+
+	s := Service{
+		heatMap:        heatMap,
+		keyOf:          keyOf,
+		tuning:         &atomic.Value{},
+		onBucketMode:   onBucketMode,
+		logger:         logger,
+		stop:           make(chan struct{}),
+		stopped:        &sync.WaitGroup{},
+		snapshotStatus: &atomic.Value{},
+	}
+	s.tuning.Store(tuning)
+	if config.SnapshotEnabled {
+		if err := s.Restore(config.SnapshotPath); err != nil {
+			s.logger.Error("could not restore heat map snapshot", "path", config.SnapshotPath, "error", err)
+		}
+		s.stopped.Add(1)
+		go s.snapshotter(config.SnapshotPath, config.SnapshotInterval)
 	}
+	go s.sweeper(config.SweepInterval)
+
+	return s, nil
 }
 
-func (s *Service) CheckConcurrency(entryID uint64) bool {
-	value, err := s.heatMap.Load(entryID)
+func newTuning(config reserve.ConcurrencyConfig) (tuning, error) {
+	detector, err := newDetector(config)
 	if err != nil {
-		return false
+		return tuning{}, err
+	}
+
+	var amountUnit int64
+	if config.WeightByAmount {
+		amountUnit = config.AmountUnit
 	}
 
-	return value > s.concurrencyThresshold
+	return tuning{
+		detector:   detector,
+		amountUnit: amountUnit,
+		hysteresis: hysteresis{
+			enter:    float64(config.ConcurrrentThresshold),
+			exit:     float64(config.ExitThreshold),
+			minDwell: config.MinDwell,
+		},
+	}, nil
 }
 
-func (s *Service) RegisterEntryMiddleware(c *gin.Context) {
-	c.Next()
+func (s *Service) tune() tuning {
+	return s.tuning.Load().(tuning)
+}
 
-	userIDParam := c.Param("user_id")
-	userID, _ := strconv.ParseUint(userIDParam, 10, 64)
+// Reload applies the detector, weighting and thresholds of config to the
+// heat map as it is; entries keep their state. The remaining settings take
+// effect on restart.
+func (s *Service) Reload(config reserve.ConcurrencyConfig) error {
+	tuning, err := newTuning(config)
+	if err != nil {
+		return err
+	}
+	s.tuning.Store(tuning)
+
+	return nil
+}
 
-	shouldRegisterExpirer := false
+// Check reports why Reload would refuse config.
+func (s *Service) Check(config reserve.ConcurrencyConfig) error {
+	_, err := newTuning(config)
 
-	err := s.heatMap.LoadAndStore(
-		userID,
-		0,
-		func(curr uint64) uint64 {
-			nextVal := curr + uint64(s.heat)
+	return err
+}
 
-			if curr == uint64(s.heat) {
-				shouldRegisterExpirer = true
-			}
+func (s *Service) CheckConcurrency(request reserve.ReserveRequest) bool {
+	t := s.tune()
 
-			return nextVal
-		},
-	)
-	if err != nil {
+	var previous, mode reserve.AllocationMode
+	s.heatMap.LoadAndStore(s.keyOf(request.UserID, request.ClientID, request.Body.Reason), func(e *entry) {
+		now := time.Now()
+		score := t.detector.Score(*e, now)
+		e.record(score, now)
+
+		previous = e.currentMode()
+		t.hysteresis.apply(e, score, now)
+		mode = e.currentMode()
+	})
+
+	concurrencyChecks.With(string(mode)).Inc()
+	if previous != mode {
+		s.logger.With(request.LogFields()...).Info("allocation mode changed", "from", previous, "to", mode)
+	}
+
+	if mode == reserve.AllocationModes.Bucket && previous != mode && s.onBucketMode != nil {
+		s.onBucketMode(request)
+	}
+
+	return mode == reserve.AllocationModes.Bucket
+}
+
+// UserStates lists the state of every key tracked for userID.
+func (s *Service) UserStates(userID uint64) []KeyState {
+	detector := s.tune().detector
+	now := time.Now()
+
+	states := []KeyState{}
+	s.heatMap.Range(func(key Key, e entry) {
+		if key.UserID == userID {
+			states = append(states, keyState(key, e, detector.Score(e, now)))
+		}
+	})
+
+	return states
+}
+
+// Hottest lists the limit keys with the highest score, hottest first.
+func (s *Service) Hottest(limit int) []KeyState {
+	detector := s.tune().detector
+	now := time.Now()
+
+	top := &hottest{}
+	s.heatMap.Range(func(key Key, e entry) {
+		score := detector.Score(e, now)
+		if top.Len() < limit {
+			heap.Push(top, keyState(key, e, score))
+		} else if top.Len() > 0 && (*top)[0].Score < score {
+			(*top)[0] = keyState(key, e, score)
+			heap.Fix(top, 0)
+		}
+	})
+
+	states := make([]KeyState, top.Len())
+	for i := len(states) - 1; i >= 0; i-- {
+		states[i] = heap.Pop(top).(KeyState)
+	}
+
+	return states
+}
+
+func (s *Service) HandleStatsRequest(c *gin.Context) {
+	c.JSON(http.StatusOK, s.heatMap.Stats())
+	return
+}
+
+func (s *Service) HandleHottestRequest(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if err != nil || limit <= 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid query parameters!",
+			"code":    "invalid_query_parameters",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.Hottest(limit))
+	return
+}
+
+func (s *Service) HandleUserRequest(c *gin.Context) {
+	var uri reserve.CreateURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid uri!",
+			"code":    "invalid_uri",
+		})
 		return
 	}
 
-	if shouldRegisterExpirer {
-		go s.expirer(userID)
+	c.JSON(http.StatusOK, s.UserStates(uri.UserID))
+	return
+}
+
+// RegisterEntryMiddleware tracks the heat of reserve creations. Requests
+// whose user cannot be parsed are not tracked; the handler rejects them.
+func (s *Service) RegisterEntryMiddleware(c *gin.Context) {
+	userIDParam := c.Param("user_id")
+	userID, err := strconv.ParseUint(userIDParam, 10, 64)
+	if err != nil {
+		c.Next()
+		return
 	}
 
+	body, _ := reserve.PeekBody(c)
+	key := s.keyOf(userID, reserve.PeekClientID(c), body.Reason)
+
+	// Start and Done go to the same detector even if it is reloaded meanwhile
+	t := s.tune()
+	weight := t.weight(body.Amount)
+
+	s.register(key, weight, t.detector.Start)
+	c.Next()
+	s.register(key, weight, t.detector.Done)
+
 	return
 }
 
-func (s *Service) expirer(userID uint64) {
-	timeout := time.After(s.decayDelay)
+// weight is 1 per request, or the amount in AmountUnit units when weighting
+// by amount.
+func (t tuning) weight(amount int64) float64 {
+	if t.amountUnit <= 0 {
+		return 1
+	}
+
+	return float64(amount) / float64(t.amountUnit)
+}
+
+func (s *Service) register(key Key, weight float64, fn func(e *entry, weight float64, now time.Time)) {
+	s.heatMap.LoadAndStore(key, func(e *entry) {
+		fn(e, weight, time.Now())
+	})
+}
+
+// Stop ends the sweeper and, when enabled, returns once a last snapshot is
+// saved.
+func (s *Service) Stop() {
+	close(s.stop)
+	s.stopped.Wait()
+}
+
+// sweeper periodically decays every entry and evicts the ones gone cold, so
+// keys that stop receiving requests do not linger in the heat map.
+func (s *Service) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
 	for {
-		<-timeout
-
-		shouldExit := false
-		err := s.heatMap.LoadAndStore(
-			userID,
-			0,
-			func(curr uint64) uint64 {
-				nextVal := curr - uint64(s.decay)
-				if nextVal <= 0 {
-					shouldExit = true
-					return 0
-				}
-				return nextVal
-			},
-		)
-		if err != nil || shouldExit {
+		select {
+		case <-s.stop:
 			return
+		case <-ticker.C:
+			t := s.tune()
+			now := time.Now()
+			expired := 0
+			s.heatMap.Sweep(func(e *entry) {
+				t.detector.Expire(e, now)
+				t.hysteresis.apply(e, t.detector.Score(*e, now), now)
+				if e.empty() {
+					expired++
+				}
+			})
+			heatMapExpirations.With().Add(float64(expired))
 		}
-
-		timeout = time.After(s.decayDelay)
 	}
 }
@@ -0,0 +1,124 @@
+package concurrency
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"reserve/reserve"
+	"reserve/reserve/logger"
+	"testing"
+)
+
+func TestRegisterEntryMiddlewareKeysAndWeights(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	config := reserve.NewConfig().Concurrency
+	config.KeyBy = "user_client"
+	config.WeightByAmount = true
+	config.AmountUnit = 100
+	config.ConcurrrentThresshold = 100
+	config.SnapshotEnabled = false
+
+	s, err := NewService(config, nil, logger.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	var bound reserve.Body
+	router := gin.New()
+	router.POST("/api/users/:user_id/reserve", s.RegisterEntryMiddleware, func(c *gin.Context) {
+		if err := c.ShouldBindJSON(&bound); err != nil {
+			t.Error(err)
+		}
+	})
+
+	body := []byte(`{"amount": 20, "mode": "total", "reason": "reserve_for_payment", "external_reference": "1"}`)
+	req, _ := http.NewRequest("POST", "/api/users/1/reserve", bytes.NewReader(body))
+	req.Header.Set("X-Client-Id", "1234")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if bound.Amount != 2000 {
+		t.Fatalf("expected the handler to still bind the body, got %+v", bound)
+	}
+
+	request := reserve.ReserveRequest{UserID: 1, ClientID: "1234", Body: bound}
+	if !s.CheckConcurrency(request) {
+		t.Fatal("expected a 20 weight request with heat 10 to exceed the threshold")
+	}
+
+	request.ClientID = "5678"
+	if s.CheckConcurrency(request) {
+		t.Fatal("expected other clients of the user not to share the heat")
+	}
+}
+
+func TestHottest(t *testing.T) {
+	config := reserve.NewConfig().Concurrency
+	config.SnapshotEnabled = false
+
+	s, err := NewService(config, nil, logger.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	for userID := uint64(1); userID <= 5; userID++ {
+		for i := uint64(0); i < userID; i++ {
+			s.register(Key{UserID: userID}, 1, s.tune().detector.Done)
+		}
+		s.CheckConcurrency(reserve.ReserveRequest{UserID: userID})
+	}
+
+	top := s.Hottest(3)
+	if len(top) != 3 {
+		t.Fatalf("expected three keys, got %d", len(top))
+	}
+	for i, userID := range []uint64{5, 4, 3} {
+		if top[i].Key.UserID != userID {
+			t.Fatalf("expected user %d at position %d, got %+v", userID, i, top[i])
+		}
+	}
+
+	if top[0].Mode != reserve.AllocationModes.Bucket || len(top[0].History) != 1 {
+		t.Fatalf("expected the hottest user in bucket mode with one sample, got %+v", top[0])
+	}
+	if states := s.UserStates(2); len(states) != 1 || states[0].Mode != reserve.AllocationModes.Bucket {
+		t.Fatalf("unexpected state for user 2: %+v", states)
+	}
+}
+
+func TestReloadKeepsHeat(t *testing.T) {
+	config := reserve.NewConfig().Concurrency
+	config.SnapshotEnabled = false
+	config.ConcurrrentThresshold = 100
+	config.ExitThreshold = 0
+
+	s, err := NewService(config, nil, logger.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	request := reserve.ReserveRequest{UserID: 1}
+	for i := 0; i < 3; i++ {
+		s.register(Key{UserID: 1}, 1, s.tune().detector.Done)
+	}
+	if s.CheckConcurrency(request) {
+		t.Fatal("expected standalone mode below the threshold")
+	}
+
+	config.ConcurrrentThresshold = 20
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	if !s.CheckConcurrency(request) {
+		t.Fatal("expected the heat gathered before the reload to reach the new threshold")
+	}
+
+	config.Detector = "magic"
+	if err := s.Reload(config); err != UnknownDetectorError {
+		t.Fatalf("expected an unknown detector to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package concurrency
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reserve/reserve"
+	"time"
+)
+
+// record is the persisted form of an entry. In-flight counts and the check
+// history are not kept: the requests they describe did not survive the
+// restart.
+type record struct {
+	Key         Key                    `json:"key"`
+	Heat        float64                `json:"heat,omitempty"`
+	HeatUpdated time.Time              `json:"heat_updated"`
+	Window      [windowSlots]float64   `json:"window"`
+	WindowSlot  int64                  `json:"window_slot,omitempty"`
+	Rate        float64                `json:"rate,omitempty"`
+	RateUpdated time.Time              `json:"rate_updated"`
+	Mode        reserve.AllocationMode `json:"mode,omitempty"`
+	ModeSince   time.Time              `json:"mode_since"`
+	Transitions uint64                 `json:"transitions,omitempty"`
+}
+
+type snapshot struct {
+	TakenAt time.Time `json:"taken_at"`
+	Records []record  `json:"records"`
+}
+
+// Snapshot writes the heat map to path, atomically replacing the previous
+// snapshot.
+func (s *Service) Snapshot(path string) error {
+	snap := snapshot{
+		TakenAt: time.Now(),
+		Records: []record{},
+	}
+	s.heatMap.Range(func(key Key, e entry) {
+		snap.Records = append(snap.Records, record{
+			Key:         key,
+			Heat:        e.heat,
+			HeatUpdated: e.heatUpdated,
+			Window:      e.window,
+			WindowSlot:  e.windowSlot,
+			Rate:        e.rate,
+			RateUpdated: e.rateUpdated,
+			Mode:        e.mode,
+			ModeSince:   e.modeSince,
+			Transitions: e.transitions,
+		})
+	})
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Restore loads the snapshot at path. Entries keep the time they were last
+// updated, so the decay for the downtime is applied as they are read; the
+// ones that went cold meanwhile are dropped right away.
+func (s *Service) Restore(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+
+	t := s.tune()
+	now := time.Now()
+	for _, r := range snap.Records {
+		r := r
+		s.heatMap.LoadAndStore(r.Key, func(e *entry) {
+			e.heat = r.Heat
+			e.heatUpdated = r.HeatUpdated
+			e.window = r.Window
+			e.windowSlot = r.WindowSlot
+			e.rate = r.Rate
+			e.rateUpdated = r.RateUpdated
+			e.mode = r.Mode
+			e.modeSince = r.ModeSince
+			e.transitions = r.Transitions
+
+			t.detector.Expire(e, now)
+			t.hysteresis.apply(e, t.detector.Score(*e, now), now)
+		})
+	}
+
+	return nil
+}
+
+func (s *Service) snapshotter(path string, interval time.Duration) {
+	defer s.stopped.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			s.saveSnapshot(path)
+			return
+		case <-ticker.C:
+			s.saveSnapshot(path)
+		}
+	}
+}
+
+// snapshotStatus is the outcome of the last periodic snapshot.
+type snapshotStatus struct {
+	err error
+}
+
+func (s *Service) saveSnapshot(path string) {
+	err := s.Snapshot(path)
+	if err != nil {
+		s.logger.Error("could not save heat map snapshot", "path", path, "error", err)
+	}
+	s.snapshotStatus.Store(snapshotStatus{err})
+}
+
+// SnapshotError is the error of the last periodic snapshot, nil when it was
+// saved or none was taken yet.
+func (s *Service) SnapshotError() error {
+	status, _ := s.snapshotStatus.Load().(snapshotStatus)
+	return status.err
+}
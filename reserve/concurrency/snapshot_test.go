@@ -0,0 +1,62 @@
+package concurrency
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reserve/reserve"
+	"reserve/reserve/logger"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "heatmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := reserve.NewConfig().Concurrency
+	config.SnapshotEnabled = true
+	config.SnapshotPath = filepath.Join(dir, "heatmap.json")
+	config.SnapshotInterval = time.Hour
+
+	before, err := NewService(config, nil, logger.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hot := reserve.ReserveRequest{UserID: 1}
+	for i := 0; i < 3; i++ {
+		before.register(Key{UserID: hot.UserID}, 1, before.tune().detector.Done)
+		before.CheckConcurrency(hot)
+	}
+	// cold enough to be dropped on restore
+	before.heatMap.LoadAndStore(Key{UserID: 2}, func(e *entry) {
+		before.tune().detector.Done(e, 1, time.Now().Add(-10*config.HalfLife))
+	})
+
+	if !before.CheckConcurrency(hot) {
+		t.Fatal("expected the hot user to be in bucket mode")
+	}
+	before.Stop()
+
+	if _, err := os.Stat(config.SnapshotPath); err != nil {
+		t.Fatalf("expected a snapshot to be saved on stop, got %v", err)
+	}
+
+	after, err := NewService(config, nil, logger.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer after.Stop()
+
+	states := after.UserStates(hot.UserID)
+	if len(states) != 1 || states[0].Mode != reserve.AllocationModes.Bucket || states[0].Score < 20 {
+		t.Fatalf("expected the hot user to be restored in bucket mode, got %+v", states)
+	}
+	if states := after.UserStates(2); len(states) != 0 {
+		t.Fatalf("expected the cold user to be dropped, got %+v", states)
+	}
+}
@@ -1,37 +1,548 @@
 package reserve
 
-import "time"
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Settings tagged reload:"live" are applied when the configuration is
+// reloaded, the others on restart.
 
 type AllocatorConfig struct {
-	MaxRetryAllocation int
-	OvershootFactor    int
-	ReserveLifetime    time.Duration
+	MaxRetryAllocation int           `reload:"live"`
+	OvershootFactor    int           `reload:"live"`
+	ReserveLifetime    time.Duration `reload:"live"`
+	LockShards         int
+	// CoalesceWindow groups the bucket allocations of a user and client
+	// arriving within it, up to CoalesceMaxBatch, into one upstream operation.
+	// Zero, the default, disables coalescing as it delays every allocation.
+	CoalesceWindow    time.Duration
+	CoalesceMaxBatch  int
+	MaxUserExposure   int64 `reload:"live"`
+	MaxClientExposure int64 `reload:"live"`
+	MaxGlobalExposure int64 `reload:"live"`
+	// Prewarm posts buckets in the background when a user enters bucket
+	// mode or its buckets hold less than PrewarmLowWaterRatio of the bucket
+	// the next request would post.
+	Prewarm              bool
+	PrewarmLowWaterRatio float64 `reload:"live"`
+	// RegistryCapacity bounds the number of users holding buckets, zero
+	// means unbounded. Every lock shard holds its share of it, so the bound
+	// is approximate: it is rounded up to a multiple of LockShards and a
+	// shard may evict before the registry is full.
+	RegistryCapacity int
 }
 
 type ConcurrencyConfig struct {
-	DecayDelay time.Duration
-	Decay      uint
-	Heat       int
-	ConcurrrentThresshold uint64
+	// Detector is one of heat, window, rate or inflight.
+	Detector string `reload:"live"`
+	// KeyBy is one of user, user_client or user_reason.
+	KeyBy          string
+	WeightByAmount bool `reload:"live"`
+	// AmountUnit is the amount, in cents, that weighs as much as one request.
+	AmountUnit    int64         `reload:"live"`
+	Window        time.Duration `reload:"live"`
+	HalfLife      time.Duration `reload:"live"`
+	SweepInterval time.Duration
+	ColdHeat      float64 `reload:"live"`
+	Heat          float64 `reload:"live"`
+	// ConcurrrentThresshold is the score above which a key enters bucket
+	// mode, ExitThreshold the one below which it goes back to standalone.
+	ConcurrrentThresshold uint64        `config:"concurrent_threshold" reload:"live"`
+	ExitThreshold         uint64        `reload:"live"`
+	MinDwell              time.Duration `reload:"live"`
+	LockShards            int
+	// Capacity bounds the number of keys tracked, zero means unbounded. It
+	// is approximate like AllocatorConfig.RegistryCapacity.
+	// EvictionPolicy is either lru or lfu.
+	Capacity       int
+	EvictionPolicy string
+	// SnapshotEnabled persists the heat map to SnapshotPath every
+	// SnapshotInterval and restores it on startup. The path has no default
+	// and must be set explicitly.
+	SnapshotEnabled  bool
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+}
+
+type AsyncConfig struct {
+	Workers   int
+	QueueSize int
+	ResultTTL time.Duration
+}
+
+type BalanceConfig struct {
+	Provider       string
+	DefaultBalance int64
+	URL            string
+	Timeout        time.Duration
+}
+
+type LoggingConfig struct {
+	// Level is one of debug, info, warn or error and Format either json or
+	// logfmt.
+	Level  string
+	Format string
+	// AccessLogSampleRate is the share of successful requests written to
+	// the access log; failed ones are always written.
+	AccessLogSampleRate float64
+}
+
+// TracingConfig exports the spans of a SampleRate share of the requests,
+// when Enabled, as JSON lines to stdout or, with the file Exporter, to Path.
+// Requests whose traceparent is sampled are always traced.
+type TracingConfig struct {
+	Enabled    bool
+	Exporter   string
+	Path       string
+	SampleRate float64
+}
+
+// OpenAPIConfig sets when requests and responses are validated against the
+// OpenAPI document, mismatches being answered with a 500: in gin test mode
+// only with test_mode, always or never.
+type OpenAPIConfig struct {
+	Validate string
+}
+
+// HealthConfig sets when the instance reports itself not ready: once more
+// than UpstreamMaxErrorRate of at least UpstreamMinCalls recent upstream
+// calls or balance lookups failed. It warns once the registry holds
+// RegistryMaxUsage of its capacity. On SIGTERM it stays up, not ready, for
+// DrainDelay before shutting down.
+type HealthConfig struct {
+	UpstreamMinCalls     int
+	UpstreamMaxErrorRate float64
+	RegistryMaxUsage     float64
+	DrainDelay           time.Duration
+}
+
+// AuthConfig requires, when Enabled, the callers creating reserves to
+// authenticate as one of Clients, listed as client_id:secret. Clients send
+// their secret as an API key, if AllowAPIKeys, or sign their requests with
+// it; signatures older or newer than MaxClockSkew are refused.
+type AuthConfig struct {
+	Enabled      bool
+	Clients      []string `reload:"live" secret:"true"`
+	AllowAPIKeys bool
+	MaxClockSkew time.Duration
+}
+
+// RateLimitConfig limits, when Enabled, the reserve requests of every client
+// to RequestsPerSecond with bursts of Burst, and to DailyRequests requests
+// for a DailyAmount total, in cents, per UTC day; zero means unlimited. Clients
+// overrides them for single clients, listed as
+// client_id:requests_per_second:burst:daily_requests:daily_amount.
+type RateLimitConfig struct {
+	Enabled           bool
+	RequestsPerSecond float64  `reload:"live"`
+	Burst             int      `reload:"live"`
+	DailyRequests     int64    `reload:"live"`
+	DailyAmount       int64    `reload:"live"`
+	Clients           []string `reload:"live"`
+}
+
+type AdminConfig struct {
+	// Token is the bearer token required by every admin endpoint; they are
+	// disabled while it is empty.
+	Token string `reload:"live" secret:"true"`
+}
+
+// ClusterConfig hashes user IDs to their owning instance among Peers when
+// Enabled. Self is the base URL, as listed in Peers, of this instance. Peers
+// sign the requests they forward with Secret, shared by the whole cluster.
+type ClusterConfig struct {
+	Enabled        bool
+	Self           string
+	Peers          []string
+	Secret         string `secret:"true"`
+	VirtualNodes   int
+	ForwardTimeout time.Duration
+}
+
+type ServerConfig struct {
+	Address string
+}
+
+// UpstreamConfig tunes the simulated reserves API: the percentage of calls
+// that fail and how long each call takes.
+type UpstreamConfig struct {
+	AllocationFailurePercentage int
+	SplitFailurePercentage      int
+	ReserveDelay                time.Duration
+	SplitDelay                  time.Duration
 }
 
 type Config struct {
+	Server      ServerConfig
 	Allocator   AllocatorConfig
 	Concurrency ConcurrencyConfig
+	Async       AsyncConfig
+	Balance     BalanceConfig
+	Cluster     ClusterConfig
+	Upstream    UpstreamConfig
+	Admin       AdminConfig
+	Logging     LoggingConfig
+	Tracing     TracingConfig
+	OpenAPI     OpenAPIConfig `config:"openapi"`
+	Health      HealthConfig
+	Auth        AuthConfig
+	RateLimit   RateLimitConfig
 }
 
 func NewConfig() Config {
 	return Config{
+		Server: ServerConfig{
+			Address: ":8080",
+		},
 		Allocator: AllocatorConfig{
-			MaxRetryAllocation: 5,
-			OvershootFactor:    10,
-			ReserveLifetime:    2 * time.Second,
+			MaxRetryAllocation:   5,
+			OvershootFactor:      10,
+			ReserveLifetime:      2 * time.Second,
+			LockShards:           64,
+			CoalesceWindow:       0,
+			CoalesceMaxBatch:     16,
+			MaxUserExposure:      5000000,
+			MaxClientExposure:    50000000,
+			MaxGlobalExposure:    500000000,
+			Prewarm:              false,
+			PrewarmLowWaterRatio: 0.2,
+			RegistryCapacity:     10000,
 		},
 		Concurrency: ConcurrencyConfig{
-			DecayDelay: 100 * time.Second,
-			Decay:      1,
-			Heat:       10,
+			Detector:              "heat",
+			KeyBy:                 "user",
+			WeightByAmount:        false,
+			AmountUnit:            10000,
+			Window:                time.Second,
+			HalfLife:              10 * time.Second,
+			SweepInterval:         time.Minute,
+			ColdHeat:              0.1,
+			Heat:                  10,
 			ConcurrrentThresshold: 10,
+			ExitThreshold:         5,
+			MinDwell:              5 * time.Second,
+			LockShards:            64,
+			Capacity:              100000,
+			EvictionPolicy:        "lru",
+			SnapshotEnabled:       false,
+			SnapshotPath:          "",
+			SnapshotInterval:      30 * time.Second,
+		},
+		Async: AsyncConfig{
+			Workers:   16,
+			QueueSize: 1024,
+			ResultTTL: 5 * time.Minute,
+		},
+		Balance: BalanceConfig{
+			Provider:       "memory",
+			DefaultBalance: 100000000,
+			Timeout:        time.Second,
+		},
+		Cluster: ClusterConfig{
+			Enabled:        false,
+			VirtualNodes:   128,
+			ForwardTimeout: 2 * time.Second,
+		},
+		Upstream: UpstreamConfig{
+			AllocationFailurePercentage: 0,
+			SplitFailurePercentage:      0,
+			ReserveDelay:                70 * time.Millisecond,
+			SplitDelay:                  35 * time.Millisecond,
+		},
+		Logging: LoggingConfig{
+			Level:               "info",
+			Format:              "json",
+			AccessLogSampleRate: 1,
 		},
+		Tracing: TracingConfig{
+			Enabled:    false,
+			Exporter:   "stdout",
+			Path:       "traces.jsonl",
+			SampleRate: 1,
+		},
+		OpenAPI: OpenAPIConfig{
+			Validate: "test_mode",
+		},
+		Health: HealthConfig{
+			UpstreamMinCalls:     20,
+			UpstreamMaxErrorRate: 0.5,
+			RegistryMaxUsage:     1,
+			DrainDelay:           5 * time.Second,
+		},
+		Auth: AuthConfig{
+			Enabled:      false,
+			Clients:      []string{},
+			AllowAPIKeys: true,
+			MaxClockSkew: 5 * time.Minute,
+		},
+		RateLimit: RateLimitConfig{
+			Enabled:           false,
+			RequestsPerSecond: 50,
+			Burst:             100,
+			DailyRequests:     0,
+			DailyAmount:       0,
+			Clients:           []string{},
+		},
+	}
+}
+
+// ConfigError lists every invalid setting, named by its key as in the
+// config file.
+type ConfigError struct {
+	Errors []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Errors, "\n  ")
+}
+
+func (e *ConfigError) add(key, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, key+": "+fmt.Sprintf(format, args...))
+}
+
+// Validate checks every setting and reports all the invalid ones at once.
+func (c Config) Validate() error {
+	e := &ConfigError{}
+
+	if c.Server.Address == "" {
+		e.add("server.address", "must not be empty")
+	}
+
+	a := c.Allocator
+	if a.MaxRetryAllocation <= 0 {
+		e.add("allocator.max_retry_allocation", "must be positive")
+	}
+	if a.OvershootFactor < 2 {
+		e.add("allocator.overshoot_factor", "must be at least 2")
+	}
+	if a.ReserveLifetime <= 0 {
+		e.add("allocator.reserve_lifetime", "must be positive")
+	}
+	if a.LockShards <= 0 {
+		e.add("allocator.lock_shards", "must be positive")
+	}
+	if a.CoalesceWindow < 0 {
+		e.add("allocator.coalesce_window", "must not be negative")
+	}
+	if a.CoalesceWindow > 0 && a.CoalesceMaxBatch <= 0 {
+		e.add("allocator.coalesce_max_batch", "must be positive when coalescing")
+	}
+	if a.MaxUserExposure < 0 {
+		e.add("allocator.max_user_exposure", "must not be negative")
+	}
+	if a.MaxClientExposure < 0 {
+		e.add("allocator.max_client_exposure", "must not be negative")
+	}
+	if a.MaxGlobalExposure < 0 {
+		e.add("allocator.max_global_exposure", "must not be negative")
+	}
+	if a.PrewarmLowWaterRatio < 0 || a.PrewarmLowWaterRatio >= 1 {
+		e.add("allocator.prewarm_low_water_ratio", "must be between 0 and 1")
+	}
+	if a.RegistryCapacity < 0 {
+		e.add("allocator.registry_capacity", "must not be negative")
+	}
+	if a.RegistryCapacity > 0 && a.RegistryCapacity < a.LockShards {
+		e.add("allocator.registry_capacity", "must be at least allocator.lock_shards when bounded")
+	}
+
+	cc := c.Concurrency
+	if !oneOf(cc.Detector, "heat", "window", "rate", "inflight") {
+		e.add("concurrency.detector", "must be one of heat, window, rate or inflight, got %q", cc.Detector)
+	}
+	if !oneOf(cc.KeyBy, "user", "user_client", "user_reason") {
+		e.add("concurrency.key_by", "must be one of user, user_client or user_reason, got %q", cc.KeyBy)
 	}
+	if cc.WeightByAmount && cc.AmountUnit <= 0 {
+		e.add("concurrency.amount_unit", "must be positive when weighting by amount")
+	}
+	// the window detector splits the window in slots of at least a nanosecond
+	if cc.Window < time.Millisecond {
+		e.add("concurrency.window", "must be at least 1ms")
+	}
+	if cc.HalfLife <= 0 {
+		e.add("concurrency.half_life", "must be positive")
+	}
+	if cc.SweepInterval <= 0 {
+		e.add("concurrency.sweep_interval", "must be positive")
+	}
+	if cc.ColdHeat < 0 {
+		e.add("concurrency.cold_heat", "must not be negative")
+	}
+	if cc.Heat <= 0 {
+		e.add("concurrency.heat", "must be positive")
+	}
+	if cc.ConcurrrentThresshold == 0 {
+		e.add("concurrency.concurrent_threshold", "must be positive")
+	}
+	if cc.ExitThreshold > cc.ConcurrrentThresshold {
+		e.add("concurrency.exit_threshold", "must not exceed concurrency.concurrent_threshold")
+	}
+	if cc.MinDwell < 0 {
+		e.add("concurrency.min_dwell", "must not be negative")
+	}
+	if cc.LockShards <= 0 {
+		e.add("concurrency.lock_shards", "must be positive")
+	}
+	if cc.Capacity < 0 {
+		e.add("concurrency.capacity", "must not be negative")
+	}
+	if cc.Capacity > 0 && cc.Capacity < cc.LockShards {
+		e.add("concurrency.capacity", "must be at least concurrency.lock_shards when bounded")
+	}
+	if !oneOf(cc.EvictionPolicy, "lru", "lfu") {
+		e.add("concurrency.eviction_policy", "must be either lru or lfu, got %q", cc.EvictionPolicy)
+	}
+	if cc.SnapshotEnabled && cc.SnapshotPath == "" {
+		e.add("concurrency.snapshot_path", "must not be empty when snapshots are enabled")
+	}
+	if cc.SnapshotEnabled && cc.SnapshotInterval <= 0 {
+		e.add("concurrency.snapshot_interval", "must be positive when snapshots are enabled")
+	}
+
+	if c.Async.Workers <= 0 {
+		e.add("async.workers", "must be positive")
+	}
+	if c.Async.QueueSize <= 0 {
+		e.add("async.queue_size", "must be positive")
+	}
+	if c.Async.ResultTTL <= 0 {
+		e.add("async.result_ttl", "must be positive")
+	}
+
+	if !oneOf(c.Balance.Provider, "memory", "http") {
+		e.add("balance.provider", "must be either memory or http, got %q", c.Balance.Provider)
+	}
+	if c.Balance.Provider == "http" && c.Balance.URL == "" {
+		e.add("balance.url", "must not be empty for the http provider")
+	}
+	if c.Balance.Timeout <= 0 {
+		e.add("balance.timeout", "must be positive")
+	}
+
+	if c.Cluster.Enabled {
+		if c.Cluster.Self == "" {
+			e.add("cluster.self", "must not be empty in cluster mode")
+		}
+		if len(c.Cluster.Peers) == 0 {
+			e.add("cluster.peers", "must not be empty in cluster mode")
+		}
+		if c.Cluster.Secret == "" {
+			e.add("cluster.secret", "must not be empty in cluster mode")
+		}
+		if c.Cluster.VirtualNodes <= 0 {
+			e.add("cluster.virtual_nodes", "must be positive")
+		}
+		if c.Cluster.ForwardTimeout <= 0 {
+			e.add("cluster.forward_timeout", "must be positive")
+		}
+	}
+
+	u := c.Upstream
+	if u.AllocationFailurePercentage < 0 || u.AllocationFailurePercentage > 100 {
+		e.add("upstream.allocation_failure_percentage", "must be between 0 and 100")
+	}
+	if u.SplitFailurePercentage < 0 || u.SplitFailurePercentage > 100 {
+		e.add("upstream.split_failure_percentage", "must be between 0 and 100")
+	}
+	if u.ReserveDelay < 0 {
+		e.add("upstream.reserve_delay", "must not be negative")
+	}
+	if u.SplitDelay < 0 {
+		e.add("upstream.split_delay", "must not be negative")
+	}
+
+	if !oneOf(c.Logging.Level, "debug", "info", "warn", "error") {
+		e.add("logging.level", "must be one of debug, info, warn or error, got %q", c.Logging.Level)
+	}
+	if !oneOf(c.Logging.Format, "json", "logfmt") {
+		e.add("logging.format", "must be either json or logfmt, got %q", c.Logging.Format)
+	}
+	if c.Logging.AccessLogSampleRate < 0 || c.Logging.AccessLogSampleRate > 1 {
+		e.add("logging.access_log_sample_rate", "must be between 0 and 1")
+	}
+
+	if !oneOf(c.Tracing.Exporter, "stdout", "file") {
+		e.add("tracing.exporter", "must be either stdout or file, got %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.Exporter == "file" && c.Tracing.Path == "" {
+		e.add("tracing.path", "must be set for the file exporter")
+	}
+	if c.Tracing.SampleRate < 0 || c.Tracing.SampleRate > 1 {
+		e.add("tracing.sample_rate", "must be between 0 and 1")
+	}
+
+	if !oneOf(c.OpenAPI.Validate, "test_mode", "always", "never") {
+		e.add("openapi.validate", "must be one of test_mode, always or never, got %q", c.OpenAPI.Validate)
+	}
+
+	if c.Health.UpstreamMinCalls < 0 {
+		e.add("health.upstream_min_calls", "must not be negative")
+	}
+	if c.Health.UpstreamMaxErrorRate < 0 || c.Health.UpstreamMaxErrorRate > 1 {
+		e.add("health.upstream_max_error_rate", "must be between 0 and 1")
+	}
+	if c.Health.RegistryMaxUsage <= 0 {
+		e.add("health.registry_max_usage", "must be positive")
+	}
+	if c.Health.DrainDelay < 0 {
+		e.add("health.drain_delay", "must not be negative")
+	}
+
+	if c.Auth.Enabled && len(c.Auth.Clients) == 0 {
+		e.add("auth.clients", "must list at least one client when auth is enabled")
+	}
+	clientIDs := map[string]bool{}
+	for _, client := range c.Auth.Clients {
+		parts := strings.SplitN(client, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			// the entry holds a secret, it is not echoed back
+			e.add("auth.clients", "must be listed as client_id:secret")
+			continue
+		}
+		if clientIDs[parts[0]] {
+			e.add("auth.clients", "lists client %q twice", parts[0])
+		}
+		clientIDs[parts[0]] = true
+	}
+	if c.Auth.MaxClockSkew <= 0 {
+		e.add("auth.max_clock_skew", "must be positive")
+	}
+
+	r := c.RateLimit
+	if r.RequestsPerSecond < 0 {
+		e.add("rate_limit.requests_per_second", "must not be negative")
+	}
+	if r.Burst < 0 || (r.RequestsPerSecond > 0 && r.Burst < 1) {
+		e.add("rate_limit.burst", "must be at least 1 when requests are rate limited")
+	}
+	if r.DailyRequests < 0 {
+		e.add("rate_limit.daily_requests", "must not be negative")
+	}
+	if r.DailyAmount < 0 {
+		e.add("rate_limit.daily_amount", "must not be negative")
+	}
+	for _, client := range r.Clients {
+		if parts := strings.Split(client, ":"); len(parts) != 5 || parts[0] == "" {
+			e.add("rate_limit.clients", "must be listed as client_id:requests_per_second:burst:daily_requests:daily_amount, got %q", client)
+		}
+	}
+
+	if len(e.Errors) > 0 {
+		return e
+	}
+
+	return nil
+}
+
+func oneOf(value string, options ...string) bool {
+	for _, option := range options {
+		if value == option {
+			return true
+		}
+	}
+
+	return false
 }
@@ -1,6 +1,13 @@
 package reserve
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	InsufficientFundsError = errors.New("insufficient funds")
+)
 
 type validationError struct {
 	Code    string `json:"code"`
@@ -0,0 +1,194 @@
+package health
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"os/signal"
+	"reserve/reserve"
+	"sync/atomic"
+	"syscall"
+)
+
+type Status string
+
+var Statuses = struct {
+	Pass Status
+	Warn Status
+	Fail Status
+}{
+	Pass: "pass",
+	Warn: "warn",
+	Fail: "fail",
+}
+
+// Check is the outcome of one readiness check. Only failing checks make the
+// instance not ready; warnings are reported for operators.
+type Check struct {
+	Status  Status                 `json:"status"`
+	Message string                 `json:"message,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+type Readiness struct {
+	Ready    bool             `json:"ready"`
+	Draining bool             `json:"draining"`
+	Checks   map[string]Check `json:"checks"`
+}
+
+// Service answers the liveness and readiness probes. Readiness checks the
+// recent upstream and balance provider error rates, the heat map snapshot
+// store, the registry size against its capacity and whether the instance is
+// draining.
+type Service struct {
+	config        reserve.HealthConfig
+	upstream      func() (int64, float64)
+	balance       func() (int64, float64)
+	registry      func() (int, int)
+	snapshotError func() error
+	draining      *int32
+}
+
+func NewService(
+	config reserve.HealthConfig,
+	upstream func() (int64, float64),
+	balance func() (int64, float64),
+	registry func() (int, int),
+	snapshotError func() error,
+) Service {
+	return Service{
+		config:        config,
+		upstream:      upstream,
+		balance:       balance,
+		registry:      registry,
+		snapshotError: snapshotError,
+		draining:      new(int32),
+	}
+}
+
+// Drain makes the instance not ready so that it is taken out of rotation
+// before it stops.
+func (s *Service) Drain() {
+	atomic.StoreInt32(s.draining, 1)
+}
+
+// WatchSignals drains the instance on SIGTERM.
+func (s *Service) WatchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		s.Drain()
+	}()
+}
+
+func (s *Service) Draining() bool {
+	return atomic.LoadInt32(s.draining) == 1
+}
+
+func (s *Service) Readiness() Readiness {
+	readiness := Readiness{
+		Draining: s.Draining(),
+		Checks: map[string]Check{
+			"upstream": s.checkUpstream(),
+			"balance":  s.checkBalance(),
+			"snapshot": s.checkSnapshot(),
+			"registry": s.checkRegistry(),
+		},
+	}
+
+	readiness.Ready = !readiness.Draining
+	for _, check := range readiness.Checks {
+		if check.Status == Statuses.Fail {
+			readiness.Ready = false
+		}
+	}
+
+	return readiness
+}
+
+func (s *Service) checkUpstream() Check {
+	calls, errorRate := s.upstream()
+
+	return s.checkErrorRate(calls, errorRate, "upstream calls")
+}
+
+// checkBalance fails like checkUpstream, as no reserve can be created while
+// the balance provider cannot be reached.
+func (s *Service) checkBalance() Check {
+	lookups, errorRate := s.balance()
+
+	return s.checkErrorRate(lookups, errorRate, "balance lookups")
+}
+
+func (s *Service) checkErrorRate(calls int64, errorRate float64, name string) Check {
+	check := Check{
+		Status: Statuses.Pass,
+		Details: map[string]interface{}{
+			"calls":      calls,
+			"error_rate": errorRate,
+		},
+	}
+
+	if calls >= int64(s.config.UpstreamMinCalls) && errorRate > s.config.UpstreamMaxErrorRate {
+		check.Status = Statuses.Fail
+		check.Message = fmt.Sprintf("%.0f%% of the recent %s failed", errorRate*100, name)
+	}
+
+	return check
+}
+
+// checkSnapshot only warns: the heat map is rebuilt from traffic when it
+// cannot be restored.
+func (s *Service) checkSnapshot() Check {
+	if err := s.snapshotError(); err != nil {
+		return Check{
+			Status:  Statuses.Warn,
+			Message: err.Error(),
+		}
+	}
+
+	return Check{Status: Statuses.Pass}
+}
+
+// checkRegistry only warns: a full registry evicts its least recently used
+// users to make room, which is its normal operation under load.
+func (s *Service) checkRegistry() Check {
+	size, capacity := s.registry()
+	check := Check{
+		Status: Statuses.Pass,
+		Details: map[string]interface{}{
+			"size":     size,
+			"capacity": capacity,
+		},
+	}
+
+	if capacity > 0 && float64(size) >= float64(capacity)*s.config.RegistryMaxUsage {
+		check.Status = Statuses.Warn
+		check.Message = fmt.Sprintf("registry holds %d of %d users", size, capacity)
+	}
+
+	return check
+}
+
+// HandleLiveness answers as long as the process serves requests.
+func (s *Service) HandleLiveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": Statuses.Pass,
+	})
+	return
+}
+
+func (s *Service) HandleReadiness(c *gin.Context) {
+	readiness := s.Readiness()
+
+	status := http.StatusOK
+	if !readiness.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	c.JSON(status, readiness)
+	return
+}
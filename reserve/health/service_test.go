@@ -0,0 +1,119 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"reserve/reserve"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	config := reserve.NewConfig().Health
+
+	var (
+		calls       int64
+		errorRate   float64
+		lookups     int64
+		lookupRate  float64
+		size        = 10
+		capacity    = 100
+		snapshotErr error
+	)
+	s := NewService(
+		config,
+		func() (int64, float64) { return calls, errorRate },
+		func() (int64, float64) { return lookups, lookupRate },
+		func() (int, int) { return size, capacity },
+		func() error { return snapshotErr },
+	)
+
+	readiness := s.Readiness()
+	if !readiness.Ready {
+		t.Fatalf("expected ready, got %+v", readiness)
+	}
+
+	// too few calls to judge the upstream
+	calls, errorRate = 5, 1
+	snapshotErr = errors.New("disk full")
+	readiness = s.Readiness()
+	if !readiness.Ready || readiness.Checks["snapshot"].Status != Statuses.Warn {
+		t.Errorf("expected a snapshot warning only, got %+v", readiness)
+	}
+
+	calls = 50
+	readiness = s.Readiness()
+	if readiness.Ready || readiness.Checks["upstream"].Status != Statuses.Fail {
+		t.Errorf("expected the upstream check to fail, got %+v", readiness)
+	}
+
+	calls, errorRate = 0, 0
+	lookups, lookupRate = 50, 1
+	readiness = s.Readiness()
+	if readiness.Ready || readiness.Checks["balance"].Status != Statuses.Fail {
+		t.Errorf("expected the balance check to fail, got %+v", readiness)
+	}
+
+	lookups, lookupRate = 0, 0
+	size = 100
+	readiness = s.Readiness()
+	if !readiness.Ready || readiness.Checks["registry"].Status != Statuses.Warn {
+		t.Errorf("expected a full registry to warn only, got %+v", readiness)
+	}
+
+	capacity = 0
+	readiness = s.Readiness()
+	if !readiness.Ready || readiness.Checks["registry"].Status != Statuses.Pass {
+		t.Errorf("expected an unbounded registry to pass, got %+v", readiness)
+	}
+
+	s.Drain()
+	readiness = s.Readiness()
+	if readiness.Ready || !readiness.Draining {
+		t.Errorf("expected a draining instance not to be ready, got %+v", readiness)
+	}
+}
+
+func TestHandleReadiness(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := NewService(
+		reserve.NewConfig().Health,
+		func() (int64, float64) { return 0, 0 },
+		func() (int64, float64) { return 0, 0 },
+		func() (int, int) { return 0, 0 },
+		func() error { return nil },
+	)
+
+	router := gin.New()
+	router.GET("/health", s.HandleLiveness)
+	router.GET("/ready", s.HandleReadiness)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	s.Drain()
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+
+	var readiness Readiness
+	json.Unmarshal(w.Body.Bytes(), &readiness)
+	if len(readiness.Checks) != 4 || readiness.Checks["upstream"].Status != Statuses.Pass {
+		t.Errorf("expected the breakdown of every check, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected a draining instance to be live, got %d", w.Code)
+	}
+}
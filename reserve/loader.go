@@ -0,0 +1,334 @@
+package reserve
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// EnvPrefix prefixes the environment variable of every setting, e.g.
+// RESERVE_ALLOCATOR_OVERSHOOT_FACTOR for allocator.overshoot_factor.
+const EnvPrefix = "RESERVE_"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setting is a leaf of Config, addressed by its dotted snake_case key.
+type setting struct {
+	key    string
+	value  reflect.Value
+	live   bool
+	secret bool
+}
+
+func (s setting) env() string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(s.key, ".", "_", -1))
+}
+
+func (s setting) set(raw string) error {
+	raw = strings.TrimSpace(raw)
+
+	switch {
+	case s.value.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		s.value.SetInt(int64(d))
+	case s.value.Kind() == reflect.String:
+		s.value.SetString(raw)
+	case s.value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		s.value.SetBool(b)
+	case s.value.Kind() == reflect.Int || s.value.Kind() == reflect.Int64:
+		i, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		s.value.SetInt(i)
+	case s.value.Kind() == reflect.Uint64:
+		u, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		s.value.SetUint(u)
+	case s.value.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		s.value.SetFloat(f)
+	case s.value.Kind() == reflect.Slice && s.value.Type().Elem().Kind() == reflect.String:
+		items := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		s.value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", s.value.Type())
+	}
+
+	return nil
+}
+
+func (s setting) String() string {
+	if !s.value.IsValid() {
+		return ""
+	}
+	if s.value.Kind() == reflect.Slice {
+		return strings.Join(s.value.Interface().([]string), ",")
+	}
+
+	return fmt.Sprint(s.value.Interface())
+}
+
+// settings lists every leaf of config, pointing into it.
+func settings(config *Config) []setting {
+	return appendSettings(nil, "", reflect.ValueOf(config).Elem())
+}
+
+func appendSettings(list []setting, prefix string, v reflect.Value) []setting {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key := field.Tag.Get("config")
+		if key == "" {
+			key = snakeCase(field.Name)
+		}
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			list = appendSettings(list, key, v.Field(i))
+			continue
+		}
+		list = append(list, setting{
+			key:    key,
+			value:  v.Field(i),
+			live:   field.Tag.Get("reload") == "live",
+			secret: field.Tag.Get("secret") == "true",
+		})
+	}
+
+	return list
+}
+
+// ConfigChange is a setting that differs between two configurations. Live
+// changes are applied on reload, the others on restart.
+type ConfigChange struct {
+	Key  string `json:"key"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	Live bool   `json:"live"`
+}
+
+func (c ConfigChange) String() string {
+	applied := "applied"
+	if !c.Live {
+		applied = "requires restart"
+	}
+
+	return fmt.Sprintf("%s: %s -> %s (%s)", c.Key, c.From, c.To, applied)
+}
+
+// DiffConfig lists the settings changed from from to to. Secrets are
+// reported as changed without their values.
+func DiffConfig(from, to Config) []ConfigChange {
+	fromSettings, toSettings := settings(&from), settings(&to)
+
+	changes := []ConfigChange{}
+	for i, s := range fromSettings {
+		if reflect.DeepEqual(s.value.Interface(), toSettings[i].value.Interface()) {
+			continue
+		}
+
+		change := ConfigChange{
+			Key:  s.key,
+			From: s.String(),
+			To:   toSettings[i].String(),
+			Live: s.live,
+		}
+		if s.secret {
+			change.From, change.To = "***", "***"
+		}
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+func snakeCase(name string) string {
+	runes := []rune(name)
+
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// flagValue defers a flag until the file and environment are applied, so
+// flags win over both.
+type flagValue struct {
+	setting setting
+	raw     *[]flagSet
+}
+
+type flagSet struct {
+	setting setting
+	raw     string
+}
+
+func (f flagValue) String() string {
+	return f.setting.String()
+}
+
+func (f flagValue) Set(raw string) error {
+	*f.raw = append(*f.raw, flagSet{f.setting, raw})
+	return nil
+}
+
+// LoadConfig layers, from lowest to highest precedence, the defaults of
+// NewConfig, a YAML or JSON file named by -config or RESERVE_CONFIG,
+// RESERVE_* environment variables and command line flags, named after the
+// keys of the file. It fails listing every invalid setting.
+func LoadConfig(args []string, environ []string) (Config, error) {
+	config := NewConfig()
+	list := settings(&config)
+
+	env := map[string]string{}
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	var flags []flagSet
+	fs := flag.NewFlagSet("reserve", flag.ContinueOnError)
+	path := fs.String("config", env[EnvPrefix+"CONFIG"], "YAML or JSON config file")
+	for _, s := range list {
+		fs.Var(flagValue{s, &flags}, s.key, "overrides "+s.env())
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	e := &ConfigError{}
+
+	if *path != "" {
+		if err := loadFile(*path, list, e); err != nil {
+			return Config{}, err
+		}
+	}
+
+	for _, s := range list {
+		if raw, ok := env[s.env()]; ok {
+			if err := s.set(raw); err != nil {
+				e.add(s.key, "invalid value %q from %s", raw, s.env())
+			}
+		}
+	}
+
+	for _, f := range flags {
+		if err := f.setting.set(f.raw); err != nil {
+			e.add(f.setting.key, "invalid value %q from -%s", f.raw, f.setting.key)
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		e.Errors = append(e.Errors, err.(*ConfigError).Errors...)
+	}
+	if len(e.Errors) > 0 {
+		return Config{}, e
+	}
+
+	return config, nil
+}
+
+func loadFile(path string, list []setting, e *ConfigError) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// JSON is valid YAML
+	var tree map[string]interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	values := map[string]string{}
+	flatten("", tree, values)
+
+	byKey := map[string]setting{}
+	for _, s := range list {
+		byKey[s.key] = s
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s, ok := byKey[key]
+		if !ok {
+			e.add(key, "unknown setting in %s", path)
+			continue
+		}
+		if err := s.set(values[key]); err != nil {
+			e.add(key, "invalid value %q in %s", values[key], path)
+		}
+	}
+
+	return nil
+}
+
+func flatten(prefix string, node interface{}, values map[string]string) {
+	join := func(key interface{}) string {
+		if prefix == "" {
+			return fmt.Sprint(key)
+		}
+		return prefix + "." + fmt.Sprint(key)
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for key, child := range n {
+			flatten(join(key), child, values)
+		}
+	case map[interface{}]interface{}:
+		for key, child := range n {
+			flatten(join(key), child, values)
+		}
+	case []interface{}:
+		items := make([]string, len(n))
+		for i, item := range n {
+			items[i] = fmt.Sprint(item)
+		}
+		values[prefix] = strings.Join(items, ",")
+	case nil:
+		values[prefix] = ""
+	default:
+		values[prefix] = fmt.Sprint(n)
+	}
+}
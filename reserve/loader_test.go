@@ -0,0 +1,94 @@
+package reserve
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	ioutil.WriteFile(path, []byte(`
+server:
+  address: ":9090"
+allocator:
+  overshoot_factor: 20
+  reserve_lifetime: 3s
+concurrency:
+  concurrent_threshold: 30
+  cold_heat: 0.5
+cluster:
+  peers: [http://a:8080, http://b:8080]
+`), 0644)
+
+	config, err := LoadConfig(
+		[]string{"-config", path, "-allocator.reserve_lifetime=4s"},
+		[]string{"RESERVE_ALLOCATOR_OVERSHOOT_FACTOR=15", "RESERVE_ALLOCATOR_RESERVE_LIFETIME=5s"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Server.Address != ":9090" {
+		t.Errorf("expected the file address, got %s", config.Server.Address)
+	}
+	if config.Allocator.OvershootFactor != 15 {
+		t.Errorf("expected the environment to win over the file, got %d", config.Allocator.OvershootFactor)
+	}
+	if config.Allocator.ReserveLifetime != 4*time.Second {
+		t.Errorf("expected flags to win over the environment, got %s", config.Allocator.ReserveLifetime)
+	}
+	if config.Concurrency.ConcurrrentThresshold != 30 || config.Concurrency.ColdHeat != 0.5 {
+		t.Errorf("unexpected concurrency config %+v", config.Concurrency)
+	}
+	if !reflect.DeepEqual(config.Cluster.Peers, []string{"http://a:8080", "http://b:8080"}) {
+		t.Errorf("unexpected peers %v", config.Cluster.Peers)
+	}
+	if config.Async != NewConfig().Async {
+		t.Errorf("expected defaults to be kept, got %+v", config.Async)
+	}
+}
+
+func TestLoadConfigListsEveryInvalidField(t *testing.T) {
+	_, err := LoadConfig(
+		[]string{"-allocator.reserve_lifetime=0s", "-concurrency.detector=magic", "-concurrency.window=5ns", "-allocator.registry_capacity=10", "-openapi.validate=sometimes"},
+		[]string{"RESERVE_CONCURRENCY_CONCURRENT_THRESHOLD=0", "RESERVE_ASYNC_WORKERS=many"},
+	)
+
+	configErr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("expected a config error, got %v", err)
+	}
+
+	message := configErr.Error()
+	for _, key := range []string{
+		"allocator.reserve_lifetime",
+		"concurrency.detector",
+		"concurrency.concurrent_threshold",
+		"concurrency.exit_threshold",
+		"concurrency.window",
+		"allocator.registry_capacity",
+		"openapi.validate",
+		"async.workers",
+	} {
+		if !strings.Contains(message, key+":") {
+			t.Errorf("expected %s to be reported in:\n%s", key, message)
+		}
+	}
+}
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	if err := NewConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
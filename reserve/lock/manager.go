@@ -0,0 +1,126 @@
+package lock
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultShards = 64
+
+// Manager hands out per-key mutexes spread across a fixed number of shards.
+// Entries are reference counted and dropped as soon as the last holder or
+// waiter releases them, so the manager only keeps state for keys in use.
+type Manager struct {
+	// accessed atomically, kept first for 64-bit alignment
+	acquisitions uint64
+	contended    uint64
+	totalWait    int64
+	maxWait      int64
+
+	shards []shard
+}
+
+type shard struct {
+	mu      sync.Mutex
+	entries map[uint64]*entry
+}
+
+type entry struct {
+	mu   sync.Mutex
+	refs int
+}
+
+type Stats struct {
+	Shards       int           `json:"shards"`
+	Keys         int           `json:"keys"`
+	Acquisitions uint64        `json:"acquisitions"`
+	Contended    uint64        `json:"contended"`
+	TotalWait    time.Duration `json:"total_wait"`
+	MaxWait      time.Duration `json:"max_wait"`
+}
+
+func NewManager(shards int) *Manager {
+	if shards <= 0 {
+		shards = DefaultShards
+	}
+
+	m := &Manager{
+		shards: make([]shard, shards),
+	}
+	for i := range m.shards {
+		m.shards[i].entries = map[uint64]*entry{}
+	}
+
+	return m
+}
+
+// ShardIndex spreads sequential keys (user IDs) evenly across shards.
+func ShardIndex(key uint64, shards int) int {
+	return int(((key * 0x9E3779B97F4A7C15) >> 32) % uint64(shards))
+}
+
+// Lock blocks until the caller holds the mutex for key and returns the
+// function that releases it.
+func (m *Manager) Lock(key uint64) func() {
+	s := &m.shards[ShardIndex(key, len(m.shards))]
+
+	s.mu.Lock()
+	e, ok := s.entries[key]
+	if !ok {
+		e = &entry{}
+		s.entries[key] = e
+	}
+	e.refs++
+	contended := e.refs > 1
+	s.mu.Unlock()
+
+	start := time.Now()
+	e.mu.Lock()
+	m.record(time.Since(start), contended)
+
+	return func() {
+		e.mu.Unlock()
+
+		s.mu.Lock()
+		e.refs--
+		if e.refs == 0 {
+			delete(s.entries, key)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (m *Manager) record(wait time.Duration, contended bool) {
+	atomic.AddUint64(&m.acquisitions, 1)
+	if !contended {
+		return
+	}
+
+	atomic.AddUint64(&m.contended, 1)
+	atomic.AddInt64(&m.totalWait, int64(wait))
+	for {
+		max := atomic.LoadInt64(&m.maxWait)
+		if int64(wait) <= max || atomic.CompareAndSwapInt64(&m.maxWait, max, int64(wait)) {
+			return
+		}
+	}
+}
+
+func (m *Manager) Stats() Stats {
+	keys := 0
+	for i := range m.shards {
+		m.shards[i].mu.Lock()
+		keys += len(m.shards[i].entries)
+		m.shards[i].mu.Unlock()
+	}
+
+	return Stats{
+		Shards:       len(m.shards),
+		Keys:         keys,
+		Acquisitions: atomic.LoadUint64(&m.acquisitions),
+		Contended:    atomic.LoadUint64(&m.contended),
+		TotalWait:    time.Duration(atomic.LoadInt64(&m.totalWait)),
+		MaxWait:      time.Duration(atomic.LoadInt64(&m.maxWait)),
+	}
+}
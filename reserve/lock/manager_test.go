@@ -0,0 +1,91 @@
+package lock
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestManagerSerializesPerKey(t *testing.T) {
+	const (
+		keys       = 16
+		goroutines = 64
+		iterations = 500
+	)
+
+	m := NewManager(4)
+	counters := make([]int, keys)
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				key := uint64((g + i) % keys)
+				unlock := m.Lock(key)
+				counters[key]++
+				unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, c := range counters {
+		total += c
+	}
+	if total != goroutines*iterations {
+		t.Fatalf("expected %d increments, got %d", goroutines*iterations, total)
+	}
+
+	stats := m.Stats()
+	if stats.Keys != 0 {
+		t.Fatalf("expected every entry to be cleaned up, %d left", stats.Keys)
+	}
+	if stats.Acquisitions != goroutines*iterations {
+		t.Fatalf("expected %d acquisitions, got %d", goroutines*iterations, stats.Acquisitions)
+	}
+}
+
+func TestManagerAllowsParallelismAcrossKeys(t *testing.T) {
+	m := NewManager(1)
+
+	unlock := m.Lock(1)
+	defer unlock()
+
+	acquired := make(chan struct{})
+	go func() {
+		m.Lock(2)()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("lock on a different key blocked behind a held key")
+	}
+}
+
+func TestManagerRecordsWaitTime(t *testing.T) {
+	m := NewManager(1)
+
+	unlock := m.Lock(1)
+	done := make(chan struct{})
+	go func() {
+		m.Lock(1)()
+		close(done)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	unlock()
+	<-done
+
+	stats := m.Stats()
+	if stats.Contended != 1 {
+		t.Fatalf("expected one contended acquisition, got %d", stats.Contended)
+	}
+	if stats.MaxWait <= 0 || stats.TotalWait < stats.MaxWait {
+		t.Fatalf("unexpected wait times: %+v", stats)
+	}
+}
@@ -0,0 +1,212 @@
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var (
+	UnknownLevelError  = errors.New("unknown log level")
+	UnknownFormatError = errors.New("unknown log format")
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if name == levelName {
+			return Level(i), nil
+		}
+	}
+
+	return 0, UnknownLevelError
+}
+
+type output struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// Logger writes one structured line, JSON or logfmt, per call. Fields are
+// given as alternating keys and values; loggers derived With more fields
+// share the output of their parent. A nil Logger discards everything.
+type Logger struct {
+	out    *output
+	level  Level
+	fields []interface{}
+}
+
+func New(w io.Writer, level, format string) (*Logger, error) {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	if format != "json" && format != "logfmt" {
+		return nil, UnknownFormatError
+	}
+
+	return &Logger{
+		out:   &output{w: w, format: format},
+		level: l,
+	}, nil
+}
+
+// Discard is a logger writing nowhere, for tests.
+func Discard() *Logger {
+	l, _ := New(ioutil.Discard, "error", "logfmt")
+	return l
+}
+
+// With returns a logger adding fields to every line.
+func (l *Logger) With(fields ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+
+	return &Logger{
+		out:    l.out,
+		level:  l.level,
+		fields: append(append([]interface{}(nil), l.fields...), fields...),
+	}
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && level >= l.level
+}
+
+func (l *Logger) Debug(msg string, fields ...interface{}) {
+	l.log(Debug, msg, fields)
+}
+
+func (l *Logger) Info(msg string, fields ...interface{}) {
+	l.log(Info, msg, fields)
+}
+
+func (l *Logger) Warn(msg string, fields ...interface{}) {
+	l.log(Warn, msg, fields)
+}
+
+func (l *Logger) Error(msg string, fields ...interface{}) {
+	l.log(Error, msg, fields)
+}
+
+func (l *Logger) log(level Level, msg string, fields []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	all := make([]interface{}, 0, 6+len(l.fields)+len(fields))
+	all = append(all, "time", time.Now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg)
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+
+	var line string
+	if l.out.format == "json" {
+		line = formatJSON(all)
+	} else {
+		line = formatLogfmt(all)
+	}
+
+	l.out.mu.Lock()
+	io.WriteString(l.out.w, line)
+	l.out.mu.Unlock()
+}
+
+func pairs(fields []interface{}, fn func(key string, value interface{})) {
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		if i+1 == len(fields) {
+			fn("!BADKEY", key)
+			return
+		}
+
+		value := fields[i+1]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		fn(key, value)
+	}
+}
+
+func formatJSON(fields []interface{}) string {
+	var b strings.Builder
+	b.WriteByte('{')
+
+	first := true
+	pairs(fields, func(key string, value interface{}) {
+		if !first {
+			b.WriteByte(',')
+		}
+		first = false
+
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	})
+
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+func formatLogfmt(fields []interface{}) string {
+	var b strings.Builder
+
+	first := true
+	pairs(fields, func(key string, value interface{}) {
+		if !first {
+			b.WriteByte(' ')
+		}
+		first = false
+
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(fmt.Sprint(value)))
+	})
+
+	b.WriteByte('\n')
+
+	return b.String()
+}
+
+func logfmtValue(value string) string {
+	if value == "" {
+		return `""`
+	}
+
+	for _, r := range value {
+		if r == '=' || r == '"' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return strconv.Quote(value)
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,113 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJSONLines(t *testing.T) {
+	var b bytes.Buffer
+	l, err := New(&b, "info", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.With("request_id", "abc", "user_id", uint64(7)).Error("could not post bucket", "error", errors.New("upstream down"))
+	l.Debug("not written")
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 line, got %q", b.String())
+	}
+
+	var line map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"level":      "error",
+		"msg":        "could not post bucket",
+		"request_id": "abc",
+		"user_id":    float64(7),
+		"error":      "upstream down",
+	}
+	for key, value := range expected {
+		if line[key] != value {
+			t.Errorf("expected %s=%v, got %v", key, value, line[key])
+		}
+	}
+	if _, ok := line["time"]; !ok {
+		t.Error("expected a time field")
+	}
+}
+
+func TestLogfmtLines(t *testing.T) {
+	var b bytes.Buffer
+	l, err := New(&b, "debug", "logfmt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Debug("bucket expired", "reserve_id", "r-1", "reason", "lifetime over", "empty", "")
+
+	line := b.String()
+	for _, part := range []string{"level=debug", `msg="bucket expired"`, "reserve_id=r-1", `reason="lifetime over"`, `empty=""`} {
+		if !strings.Contains(line, part) {
+			t.Errorf("expected %s in %q", part, line)
+		}
+	}
+}
+
+func TestNewRejectsUnknownSettings(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "verbose", "json"); err != UnknownLevelError {
+		t.Errorf("expected UnknownLevelError, got %v", err)
+	}
+	if _, err := New(&bytes.Buffer{}, "info", "xml"); err != UnknownFormatError {
+		t.Errorf("expected UnknownFormatError, got %v", err)
+	}
+
+	var l *Logger
+	l.With("user_id", 1).Error("discarded")
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var b bytes.Buffer
+	l, _ := New(&b, "info", "json")
+	accessLog := NewAccessLog(l, 0)
+
+	router := gin.New()
+	router.Use(RegisterRequestIDMiddleware, accessLog.RegisterMiddleware)
+	router.GET("/ok", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	router.GET("/fail/:user_id", func(c *gin.Context) {
+		c.Status(http.StatusBadGateway)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/ok", nil)
+	router.ServeHTTP(httptest.NewRecorder(), request)
+	if b.Len() != 0 {
+		t.Fatalf("expected successful requests to be sampled out, got %q", b.String())
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/fail/42", nil)
+	request.Header.Set(RequestIDHeader, "req-1")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["level"] != "error" || line["status"] != float64(http.StatusBadGateway) ||
+		line["request_id"] != "req-1" || line["user_id"] != "42" {
+		t.Errorf("unexpected access log line %v", line)
+	}
+}
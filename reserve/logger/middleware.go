@@ -0,0 +1,106 @@
+package logger
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	mathrand "math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	RequestIDHeader = "X-Request-Id"
+	// RequestIDKey holds the request ID in the gin context.
+	RequestIDKey = "request_id"
+
+	maxRequestIDLength = 128
+)
+
+// RequestID is the ID of the request being served, empty outside of
+// RegisterRequestIDMiddleware.
+func RequestID(c *gin.Context) string {
+	return c.GetString(RequestIDKey)
+}
+
+// RegisterRequestIDMiddleware keeps the X-Request-Id sent by the caller, or
+// generates one, so every line logged for the request can carry it. The ID
+// is echoed back in the response.
+func RegisterRequestIDMiddleware(c *gin.Context) {
+	requestID := c.GetHeader(RequestIDHeader)
+	if !validRequestID(requestID) {
+		requestID = NewRequestID()
+	}
+	c.Set(RequestIDKey, requestID)
+	c.Header(RequestIDHeader, requestID)
+
+	c.Next()
+	return
+}
+
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+
+	for _, r := range requestID {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AccessLog logs one line per request. Requests answered below 400 are
+// logged with probability sampleRate, the others always.
+type AccessLog struct {
+	logger     *Logger
+	sampleRate float64
+}
+
+func NewAccessLog(logger *Logger, sampleRate float64) AccessLog {
+	return AccessLog{logger, sampleRate}
+}
+
+func (a *AccessLog) RegisterMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	status := c.Writer.Status()
+	if status < http.StatusBadRequest && (a.sampleRate <= 0 || mathrand.Float64() >= a.sampleRate) {
+		return
+	}
+
+	fields := []interface{}{
+		"request_id", RequestID(c),
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", status,
+		"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+		"client_ip", c.ClientIP(),
+		"user_agent", c.Request.UserAgent(),
+	}
+	if userID := c.Param("user_id"); userID != "" {
+		fields = append(fields, "user_id", userID)
+	}
+	if errors := c.Errors.String(); errors != "" {
+		fields = append(fields, "errors", errors)
+	}
+
+	switch {
+	case status >= http.StatusInternalServerError:
+		a.logger.Error("request served", fields...)
+	case status >= http.StatusBadRequest:
+		a.logger.Warn("request served", fields...)
+	default:
+		a.logger.Info("request served", fields...)
+	}
+}
@@ -0,0 +1,313 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets suit latencies in seconds, from a millisecond to ten
+// seconds.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry every metric created with NewCounterVec or
+// NewHistogramVec belongs to.
+var Default = NewRegistry()
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry renders its metrics in the Prometheus text exposition format.
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: map[string]collector{},
+	}
+}
+
+func (r *Registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors[name] = c
+}
+
+// GaugeFunc registers a gauge read from fn on every scrape, replacing any
+// metric of the same name.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(name, funcCollector{desc{name, help, "gauge"}, fn})
+}
+
+// CounterFunc registers a counter read from fn on every scrape, replacing
+// any metric of the same name.
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	r.register(name, funcCollector{desc{name, help, "counter"}, fn})
+}
+
+func (r *Registry) WriteTo(w *bufio.Writer) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	collectors := make([]collector, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		collectors[i] = r.collectors[name]
+	}
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+func (r *Registry) Handle(c *gin.Context) {
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	w := bufio.NewWriter(c.Writer)
+	r.WriteTo(w)
+	w.Flush()
+}
+
+type desc struct {
+	name string
+	help string
+	kind string
+}
+
+func (d desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.kind)
+}
+
+type funcCollector struct {
+	desc
+	fn func() float64
+}
+
+func (f funcCollector) write(w *bufio.Writer) {
+	f.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", f.name, formatFloat(f.fn()))
+}
+
+// vec keeps one child per combination of label values.
+type vec struct {
+	desc
+	labels   []string
+	mu       sync.RWMutex
+	children map[string]interface{}
+	order    []string
+	values   map[string][]string
+}
+
+func newVec(name, help, kind string, labels []string) vec {
+	return vec{
+		desc:     desc{name, help, kind},
+		labels:   labels,
+		children: map[string]interface{}{},
+		values:   map[string][]string{},
+	}
+}
+
+func (v *vec) with(values []string, create func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	child, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return child
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if child, ok := v.children[key]; ok {
+		return child
+	}
+	child = create()
+	v.children[key] = child
+	v.order = append(v.order, key)
+	v.values[key] = append([]string(nil), values...)
+
+	return child
+}
+
+func (v *vec) each(fn func(labels string, child interface{})) {
+	v.mu.RLock()
+	keys := append([]string(nil), v.order...)
+	v.mu.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v.mu.RLock()
+		child, values := v.children[key], v.values[key]
+		v.mu.RUnlock()
+
+		fn(formatLabels(v.labels, values), child)
+	}
+}
+
+type Counter struct {
+	bits uint64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increases the counter by delta, which must not be negative.
+func (c *Counter) Add(delta float64) {
+	addFloat(&c.bits, delta)
+}
+
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+type CounterVec struct {
+	vec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labels)}
+	Default.register(name, c)
+
+	return c
+}
+
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.with(values, func() interface{} {
+		return &Counter{}
+	}).(*Counter)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.each(func(labels string, child interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labels, formatFloat(child.(*Counter).Value()))
+	})
+}
+
+type Histogram struct {
+	// 64-bit atomics first, for alignment on 32-bit platforms
+	count       uint64
+	sumBits     uint64
+	upperBounds []float64
+	counts      []uint64
+}
+
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.upperBounds, value)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	addFloat(&h.sumBits, value)
+	atomic.AddUint64(&h.count, 1)
+}
+
+type HistogramVec struct {
+	vec
+	upperBounds []float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	upperBounds := append([]float64(nil), buckets...)
+	sort.Float64s(upperBounds)
+
+	h := &HistogramVec{newVec(name, help, "histogram", labels), upperBounds}
+	Default.register(name, h)
+
+	return h
+}
+
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.with(values, func() interface{} {
+		return &Histogram{
+			upperBounds: h.upperBounds,
+			counts:      make([]uint64, len(h.upperBounds)),
+		}
+	}).(*Histogram)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.each(func(labels string, child interface{}) {
+		histogram := child.(*Histogram)
+
+		count := atomic.LoadUint64(&histogram.count)
+		var cumulative uint64
+		for i, upperBound := range h.upperBounds {
+			cumulative += atomic.LoadUint64(&histogram.counts[i])
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(labels, "le", formatFloat(upperBound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(labels, "le", "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(math.Float64frombits(atomic.LoadUint64(&histogram.sumBits))))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, count)
+	})
+}
+
+func addFloat(bits *uint64, delta float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(bits, old, next) {
+			return
+		}
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escape(values[i]) + `"`
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func withLabel(labels, name, value string) string {
+	pair := name + `="` + escape(value) + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(value string) string {
+	return escaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTextExposition(t *testing.T) {
+	r := NewRegistry()
+
+	counter := &CounterVec{newVec("test_requests_total", "Requests.", "counter", []string{"path"})}
+	r.register(counter.name, counter)
+	counter.With(`say "hi"`).Inc()
+	counter.With("plain").Add(2.5)
+
+	histogram := &HistogramVec{newVec("test_duration_seconds", "Durations.", "histogram", []string{"op"}), []float64{0.1, 1}}
+	r.register(histogram.name, histogram)
+	histogram.With("post").Observe(0.05)
+	histogram.With("post").Observe(0.5)
+	histogram.With("post").Observe(5)
+
+	r.GaugeFunc("test_size", "Size.", func() float64 {
+		return 3
+	})
+
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	r.WriteTo(w)
+	w.Flush()
+
+	expected := `# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{op="post",le="0.1"} 1
+test_duration_seconds_bucket{op="post",le="1"} 2
+test_duration_seconds_bucket{op="post",le="+Inf"} 3
+test_duration_seconds_sum{op="post"} 5.55
+test_duration_seconds_count{op="post"} 3
+# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{path="plain"} 2.5
+test_requests_total{path="say \"hi\""} 1
+# HELP test_size Size.
+# TYPE test_size gauge
+test_size 3
+`
+	if b.String() != expected {
+		t.Fatalf("unexpected exposition:\n%s\nexpected:\n%s", b.String(), expected)
+	}
+}
+
+func TestWithChecksLabelCount(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(r.(string), "takes 1 label values") {
+			t.Fatalf("expected a panic on a wrong label count, got %v", r)
+		}
+	}()
+
+	counter := &CounterVec{newVec("test_total", "Test.", "counter", []string{"path"})}
+	counter.With("a", "b")
+}
@@ -0,0 +1,221 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reserve/reserve/logger"
+	"strconv"
+	"strings"
+)
+
+// Handle serves the document.
+func (d *Document) Handle(c *gin.Context) {
+	c.JSON(http.StatusOK, d)
+	return
+}
+
+// Operation finds the operation of a gin route, as returned by FullPath.
+func (d *Document) Operation(method, route string) (*Operation, bool) {
+	segments := strings.Split(route, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+
+	operation, ok := d.Paths[strings.Join(segments, "/")][strings.ToLower(method)]
+	return operation, ok && operation != nil
+}
+
+// Validator checks the requests and responses of the documented routes
+// against the document, so that tests catch the handlers and the document
+// drifting apart. A response that does not match, or that accepts a request
+// the document refuses, is replaced by a 500 listing why. Every response is
+// buffered, so it is only registered in test mode.
+type Validator struct {
+	document *Document
+	logger   *logger.Logger
+}
+
+func NewValidator(document *Document, logger *logger.Logger) Validator {
+	return Validator{document, logger}
+}
+
+func (v *Validator) RegisterMiddleware(c *gin.Context) {
+	operation, ok := v.document.Operation(c.Request.Method, c.FullPath())
+	if !ok {
+		c.Next()
+		return
+	}
+
+	requestErrors := v.validateRequest(c, operation)
+
+	writer := &bufferedWriter{ResponseWriter: c.Writer, status: http.StatusOK}
+	c.Writer = writer
+	c.Next()
+	c.Writer = writer.ResponseWriter
+
+	errors := v.validateResponse(operation, writer)
+	if len(requestErrors) > 0 && writer.status < http.StatusBadRequest {
+		errors = append(errors, fmt.Sprintf("status %d accepts an invalid request", writer.status))
+		errors = append(errors, requestErrors...)
+	}
+	if len(errors) == 0 {
+		writer.flush()
+		return
+	}
+
+	v.logger.Error("response does not match the OpenAPI document",
+		"request_id", logger.RequestID(c),
+		"route", c.Request.Method+" "+c.FullPath(),
+		"status", writer.status,
+		"errors", strings.Join(errors, "; "),
+	)
+	c.Writer.Header().Del("Content-Length")
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"message": "Response does not match the OpenAPI document!",
+		"code":    "openapi_mismatch",
+		"errors":  errors,
+	})
+	return
+}
+
+func (v *Validator) validateRequest(c *gin.Context, operation *Operation) []string {
+	var errors []string
+	for _, parameter := range operation.Parameters {
+		var raw string
+		var found bool
+		switch parameter.In {
+		case "path":
+			raw = c.Param(parameter.Name)
+			found = raw != ""
+		case "query":
+			raw, found = c.GetQuery(parameter.Name)
+		case "header":
+			raw = c.GetHeader(parameter.Name)
+			found = raw != ""
+		}
+
+		if !found {
+			if parameter.Required {
+				errors = append(errors, fmt.Sprintf("%s.%s: is required", parameter.In, parameter.Name))
+			}
+			continue
+		}
+		errors = append(errors, v.document.validateParameter(parameter, raw)...)
+	}
+
+	if operation.RequestBody == nil {
+		return errors
+	}
+
+	var raw []byte
+	if c.Request.Body != nil {
+		raw, _ = ioutil.ReadAll(c.Request.Body)
+		c.Request.Body.Close()
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(raw))
+	}
+	if len(raw) == 0 {
+		if operation.RequestBody.Required {
+			errors = append(errors, "body: is required")
+		}
+		return errors
+	}
+
+	var body interface{}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return append(errors, "body: must be JSON")
+	}
+
+	return append(errors, v.document.validate(operation.RequestBody.Content[gin.MIMEJSON].Schema, body, "body")...)
+}
+
+func (v *Validator) validateResponse(operation *Operation, writer *bufferedWriter) []string {
+	response, ok := operation.Responses[strconv.Itoa(writer.status)]
+	if !ok {
+		response, ok = operation.Responses["default"]
+	}
+	if !ok {
+		return []string{fmt.Sprintf("status %d is not documented", writer.status)}
+	}
+
+	if writer.body.Len() == 0 {
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(writer.Header().Get("Content-Type"))
+	content, ok := response.Content[mediaType]
+	if !ok {
+		return []string{fmt.Sprintf("content type %q of status %d is not documented", mediaType, writer.status)}
+	}
+	if mediaType != gin.MIMEJSON {
+		return nil
+	}
+
+	var body interface{}
+	if err := json.Unmarshal(writer.body.Bytes(), &body); err != nil {
+		return []string{"response: must be JSON"}
+	}
+
+	return v.document.validate(content.Schema, body, "response")
+}
+
+// bufferedWriter holds the response back until it has been validated.
+type bufferedWriter struct {
+	gin.ResponseWriter
+	status  int
+	written bool
+	body    bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(code int) {
+	if code > 0 && !w.written {
+		w.status = code
+	}
+}
+
+func (w *bufferedWriter) WriteHeaderNow() {
+	w.written = true
+}
+
+func (w *bufferedWriter) Write(data []byte) (int, error) {
+	w.written = true
+	return w.body.Write(data)
+}
+
+func (w *bufferedWriter) WriteString(s string) (int, error) {
+	w.written = true
+	return w.body.WriteString(s)
+}
+
+func (w *bufferedWriter) Status() int {
+	return w.status
+}
+
+func (w *bufferedWriter) Size() int {
+	if !w.written {
+		return -1
+	}
+	return w.body.Len()
+}
+
+func (w *bufferedWriter) Written() bool {
+	return w.written
+}
+
+// Flush does nothing, the response is written once validated.
+func (w *bufferedWriter) Flush() {}
+
+func (w *bufferedWriter) flush() {
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.body.Len() == 0 {
+		w.ResponseWriter.WriteHeaderNow()
+		return
+	}
+	w.ResponseWriter.Write(w.body.Bytes())
+}
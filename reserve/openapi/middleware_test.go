@@ -0,0 +1,89 @@
+package openapi
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"reserve/reserve"
+	"reserve/reserve/logger"
+	"strings"
+	"testing"
+)
+
+func TestSchemas(t *testing.T) {
+	s := newSchemas()
+	s.enum(reserve.AllocationMode(""), "standalone", "bucket")
+	pending := s.of(reserve.PendingReserve{})
+
+	if pending.Ref != "#/components/schemas/PendingReserve" {
+		t.Fatalf("expected a reference, got %+v", pending)
+	}
+	schema := s.components["PendingReserve"]
+	if strings.Join(schema.Required, ",") != "id,status,date_created,last_modified" {
+		t.Errorf("expected the fields always encoded to be required, got %v", schema.Required)
+	}
+	if _, ok := schema.Properties["UserID"]; ok {
+		t.Error("expected the fields not encoded to be left out")
+	}
+	if schema.Properties["reserve"].Ref != "#/components/schemas/Reserve" {
+		t.Errorf("expected an omitted pointer to reference its type, got %+v", schema.Properties["reserve"])
+	}
+	if version := s.components["Reserve"].Properties["version"]; !version.Nullable || version.Type != "string" {
+		t.Errorf("expected a pointer to be nullable, got %+v", version)
+	}
+	if mode := s.components["Diagnostics"].Properties["allocation_mode"]; len(mode.Enum) != 2 {
+		t.Errorf("expected the allocation mode to be an enum, got %+v", mode)
+	}
+}
+
+func TestValidator(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	document := NewDocument()
+	validator := NewValidator(document, logger.Discard())
+
+	router := gin.New()
+	router.Use(validator.RegisterMiddleware)
+	router.GET("/admin/overrides/:user_id", func(c *gin.Context) {
+		switch c.Query("respond") {
+		case "override":
+			c.JSON(http.StatusOK, reserve.Override{UserID: 1, Mode: reserve.AllocationModes.Bucket, Reason: "incident"})
+		case "invalid_mode":
+			c.JSON(http.StatusOK, reserve.Override{UserID: 1, Mode: "hot", Reason: "incident"})
+		case "undocumented_status":
+			c.Status(http.StatusTeapot)
+		default:
+			c.JSON(http.StatusOK, gin.H{"message": "not an override"})
+		}
+	})
+
+	serve := func(path string) (int, []string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+		var body struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+
+		return w.Code, body.Errors
+	}
+
+	if status, errors := serve("/admin/overrides/1?respond=override"); status != http.StatusOK {
+		t.Errorf("expected a documented response to go through, got %d %v", status, errors)
+	}
+
+	cases := map[string]string{
+		"/admin/overrides/1?respond=invalid_mode":        "response.mode: must be one of [standalone bucket]",
+		"/admin/overrides/1?respond=undocumented_status": "status 418 is not documented",
+		"/admin/overrides/1":                             "response.message: is not documented",
+		"/admin/overrides/abc?respond=override":          "status 200 accepts an invalid request",
+	}
+	for path, expected := range cases {
+		status, errors := serve(path)
+		if status != http.StatusInternalServerError || !strings.Contains(strings.Join(errors, "; "), expected) {
+			t.Errorf("%s: expected %q, got %d %v", path, expected, status, errors)
+		}
+	}
+}
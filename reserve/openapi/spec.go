@@ -0,0 +1,519 @@
+package openapi
+
+import (
+	"net/http"
+	"reflect"
+	"reserve/reserve"
+	"reserve/reserve/allocator"
+	"reserve/reserve/cluster"
+	"reserve/reserve/concurrency"
+	"reserve/reserve/health"
+	"reserve/reserve/override"
+	"reserve/reserve/ratelimit"
+	"reserve/reserve/reload"
+	"strconv"
+	"strings"
+)
+
+const version = "1.0.0"
+
+var tags = struct {
+	Reserves    string
+	Diagnostics string
+	Admin       string
+	Operations  string
+}{
+	"reserves",
+	"diagnostics",
+	"admin",
+	"operations",
+}
+
+// NewDocument describes every route of the service. The schemas are derived
+// from the types the handlers bind and render.
+func NewDocument() *Document {
+	s := newSchemas()
+	s.enum(reserve.Mode(""), stringsOf(reserve.PossibleModes)...)
+	s.enum(reserve.Reason(""), stringsOf(reserve.PossibleReasons)...)
+	s.enum(reserve.AllocationMode(""), stringsOf(reserve.PossibleAllocationModes)...)
+	s.enum(reserve.PendingStatus(""),
+		string(reserve.PendingStatuses.Pending),
+		string(reserve.PendingStatuses.Reserved),
+		string(reserve.PendingStatuses.Failed),
+	)
+	s.enum(health.Status(""), string(health.Statuses.Pass), string(health.Statuses.Warn), string(health.Statuses.Fail))
+
+	validationError := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"code":    {Type: "string"},
+			"message": {Type: "string"},
+		},
+		Required: []string{"code", "message"},
+	}
+	s.components["ValidationError"] = validationError
+	s.components["Error"] = &Schema{
+		Type:        "object",
+		Description: "Every error is answered with a message for humans and a code for programs.",
+		Properties: map[string]*Schema{
+			"message": {Type: "string"},
+			"code":    {Type: "string"},
+			"errors":  {Type: "array", Items: ref("ValidationError"), Nullable: true},
+		},
+		Required: []string{"message", "code"},
+	}
+
+	// Body encodes its amount in currency units, not in cents
+	body := s.define("ReserveBody", reserve.Body{}, &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"amount":             {Type: "number", Format: "double", Description: "Amount to reserve, in currency units."},
+			"mode":               s.of(reserve.Mode("")),
+			"reason":             s.of(reserve.Reason("")),
+			"external_reference": {Type: "string"},
+		},
+		Required: []string{"amount", "mode", "reason"},
+	})
+	reserveSchema := s.of(reserve.Reserve{})
+	s.components["Reserve"].Properties["amount"].Description = "Amount reserved, in cents."
+	pending := s.of(reserve.PendingReserve{})
+
+	overrideBody := s.define("OverrideBody", override.Body{}, nil)
+	s.components["OverrideBody"].Required = []string{"mode", "reason"}
+	peersBody := s.of(cluster.PeersBody{})
+	bucketModeBody := s.of(allocator.BucketModeBody{})
+	bucketMode := &Schema{
+		Type:       "object",
+		Properties: map[string]*Schema{"bucket_mode_paused": {Type: "boolean"}},
+		Required:   []string{"bucket_mode_paused"},
+	}
+
+	userID := pathParameter("user_id", s.of(uint64(0)))
+	clientID := pathParameter("client_id", s.of(""))
+
+	forwarded := Response{
+		Description: "The instance owning the user could not be reached.",
+		Content:     jsonContent(ref("Error")),
+	}
+
+	d := &Document{
+		OpenAPI: "3.0.3",
+		Info: Info{
+			Title:   "Reserve API",
+			Version: version,
+			Description: "Reserves amounts of a user's balance for payments, allocating them " +
+				"from the upstream one by one or from buckets for users under high concurrency.",
+		},
+		Paths: map[string]PathItem{},
+		Components: Components{
+			Schemas: s.components,
+			SecuritySchemes: map[string]SecurityScheme{
+				"apiKey": {
+					Type:        "apiKey",
+					Description: "The client secret, when API keys are allowed.",
+					In:          "header",
+					Name:        "X-Api-Key",
+				},
+				"clientId":  {Type: "apiKey", In: "header", Name: "X-Client-Id", Description: "Signed requests: the client ID."},
+				"timestamp": {Type: "apiKey", In: "header", Name: "X-Timestamp", Description: "Signed requests: unix seconds, within the allowed clock skew."},
+				"nonce":     {Type: "apiKey", In: "header", Name: "X-Nonce", Description: "Signed requests: unique per client and request."},
+				"signature": {
+					Type: "apiKey",
+					In:   "header",
+					Name: "X-Signature",
+					Description: "Signed requests: the hex HMAC-SHA256, keyed with the client secret, of the method, " +
+						"path, raw query, timestamp, nonce and hex SHA-256 of the body joined by newlines.",
+				},
+				"adminToken": {Type: "http", Scheme: "bearer", Description: "The admin token."},
+			},
+		},
+	}
+
+	d.add(http.MethodGet, "/openapi.json", &Operation{
+		OperationID: "getOpenAPI",
+		Summary:     "This document",
+		Tags:        []string{tags.Operations},
+		Responses:   map[string]Response{"200": jsonResponse("The OpenAPI document.", &Schema{Type: "object"})},
+	})
+	d.add(http.MethodGet, "/metrics", &Operation{
+		OperationID: "getMetrics",
+		Summary:     "Prometheus metrics",
+		Tags:        []string{tags.Operations},
+		Responses: map[string]Response{"200": {
+			Description: "The metrics in the Prometheus text format.",
+			Content:     map[string]MediaType{"text/plain": {Schema: &Schema{Type: "string"}}},
+		}},
+	})
+	d.add(http.MethodGet, "/health", &Operation{
+		OperationID: "getLiveness",
+		Summary:     "Liveness probe",
+		Tags:        []string{tags.Operations},
+		Responses: map[string]Response{"200": jsonResponse("The process serves requests.", &Schema{
+			Type:       "object",
+			Properties: map[string]*Schema{"status": s.of(health.Status(""))},
+			Required:   []string{"status"},
+		})},
+	})
+	readiness := s.of(health.Readiness{})
+	d.add(http.MethodGet, "/ready", &Operation{
+		OperationID: "getReadiness",
+		Summary:     "Readiness probe",
+		Tags:        []string{tags.Operations},
+		Responses: map[string]Response{
+			"200": jsonResponse("The instance is ready.", readiness),
+			"503": jsonResponse("A check failed or the instance is draining.", readiness),
+		},
+	})
+
+	d.add(http.MethodPost, "/api/users/{user_id}/reserve", &Operation{
+		OperationID: "createReserve",
+		Summary:     "Reserve an amount of a user's balance",
+		Description: "Allocates the reserve right away, or queues it when the request carries " +
+			"`Prefer: respond-async`. The client is identified by `X-Client-Id` or `client.id`, or " +
+			"by its credentials when client authentication is enabled.",
+		Tags: []string{tags.Reserves},
+		Parameters: []Parameter{
+			userID,
+			{Name: "X-Idempotency-Key", In: "header", Required: true, Schema: s.of(""), Description: "Identifies retries of the same reserve."},
+			{Name: "X-Client-Id", In: "header", Schema: s.of(""), Description: "The client reserving; must be the authenticated one if any."},
+			{Name: "client.id", In: "query", Schema: s.of(""), Description: "The client reserving, when not sent as header."},
+			{Name: "Prefer", In: "header", Schema: s.of(""), Description: "`respond-async` queues the reserve."},
+		},
+		RequestBody: &RequestBody{Required: true, Content: jsonContent(body)},
+		Responses: map[string]Response{
+			"200": jsonResponse("The reserve was allocated.", reserveSchema),
+			"202": {
+				Description: "The reserve was queued; poll its Location.",
+				Headers: map[string]Header{
+					"Location":           {Description: "The pending reserve.", Schema: s.of("")},
+					"Preference-Applied": {Schema: s.of("")},
+				},
+				Content: jsonContent(pending),
+			},
+			"400": errorResponse("The request is invalid, the funds insufficient or the allocation failed."),
+			"401": errorResponse("Client authentication is enabled and the credentials are missing or invalid.", "WWW-Authenticate"),
+			"403": errorResponse("The client ID sent is not the authenticated one."),
+			"429": errorResponse("The client is over its rate limit or daily quotas.", "Retry-After"),
+			"502": forwarded,
+			"503": errorResponse("The reserve could not be queued."),
+		},
+		Security: []map[string][]string{
+			{},
+			{"apiKey": {}},
+			{"clientId": {}, "timestamp": {}, "nonce": {}, "signature": {}},
+		},
+	})
+	d.add(http.MethodGet, "/api/users/{user_id}/reserve/{reserve_id}", &Operation{
+		OperationID: "getPendingReserve",
+		Summary:     "A reserve queued with respond-async",
+		Tags:        []string{tags.Reserves},
+		Parameters:  []Parameter{userID, pathParameter("reserve_id", s.of(""))},
+		Responses: map[string]Response{
+			"200": jsonResponse("The pending reserve.", pending),
+			"400": errorResponse("The URI is invalid."),
+			"404": errorResponse("No such pending reserve."),
+			"502": forwarded,
+		},
+	})
+
+	reserves := s.of([]reserve.Reserve{})
+	d.add(http.MethodGet, "/db/{user_id}", &Operation{
+		OperationID: "listStoredReserves",
+		Summary:     "The reserves of a user in the upstream store",
+		Tags:        []string{tags.Diagnostics},
+		Parameters:  []Parameter{userID},
+		Responses: map[string]Response{
+			"200": jsonResponse("The reserves.", reserves),
+			"400": errorResponse("The URI is invalid."),
+		},
+	})
+	d.add(http.MethodGet, "/registry/{user_id}", &Operation{
+		OperationID: "listBuckets",
+		Summary:     "The buckets a user holds",
+		Tags:        []string{tags.Diagnostics},
+		Parameters:  []Parameter{userID},
+		Responses: map[string]Response{
+			"200": jsonResponse("The buckets.", reserves),
+			"400": errorResponse("The URI is invalid."),
+			"502": forwarded,
+		},
+	})
+
+	keyStates := s.of([]concurrency.KeyState{})
+	d.add(http.MethodGet, "/admin/heat", &Operation{
+		OperationID: "listHottestKeys",
+		Summary:     "The hottest concurrency keys",
+		Tags:        []string{tags.Diagnostics},
+		Parameters: []Parameter{{
+			Name:        "limit",
+			In:          "query",
+			Description: "How many keys to list, 10 by default.",
+			Schema:      &Schema{Type: "integer", Format: "int32", Minimum: one()},
+		}},
+		Responses: map[string]Response{
+			"200": jsonResponse("The keys, hottest first.", keyStates),
+			"400": errorResponse("The limit is invalid."),
+		},
+	})
+	d.add(http.MethodGet, "/admin/heat/{user_id}", &Operation{
+		OperationID: "listUserKeys",
+		Summary:     "The concurrency keys of a user",
+		Tags:        []string{tags.Diagnostics},
+		Parameters:  []Parameter{userID},
+		Responses: map[string]Response{
+			"200": jsonResponse("The keys.", keyStates),
+			"400": errorResponse("The URI is invalid."),
+		},
+	})
+	d.add(http.MethodGet, "/admin/exposure", &Operation{
+		OperationID: "getExposure",
+		Summary:     "The amounts held in buckets against their caps",
+		Tags:        []string{tags.Diagnostics},
+		Responses:   map[string]Response{"200": jsonResponse("The exposure.", s.of(allocator.Exposure{}))},
+	})
+	d.add(http.MethodGet, "/admin/stats/registry", &Operation{
+		OperationID: "getRegistryStats",
+		Summary:     "Size and lock contention of the bucket registry",
+		Tags:        []string{tags.Diagnostics},
+		Responses:   map[string]Response{"200": jsonResponse("The statistics.", s.of(allocator.RegistryStats{}))},
+	})
+	d.add(http.MethodGet, "/admin/stats/heat", &Operation{
+		OperationID: "getHeatMapStats",
+		Summary:     "Size and lock contention of the heat map",
+		Tags:        []string{tags.Diagnostics},
+		Responses:   map[string]Response{"200": jsonResponse("The statistics.", s.of(concurrency.HeatMapStats{}))},
+	})
+
+	overrideSchema := s.of(reserve.Override{})
+	d.add(http.MethodGet, "/admin/overrides", &Operation{
+		OperationID: "listOverrides",
+		Summary:     "The allocation mode overrides",
+		Tags:        []string{tags.Admin},
+		Responses:   map[string]Response{"200": jsonResponse("The overrides in effect.", s.of([]reserve.Override{}))},
+	})
+	d.add(http.MethodGet, "/admin/overrides/{user_id}", &Operation{
+		OperationID: "getOverride",
+		Summary:     "The allocation mode override of a user",
+		Tags:        []string{tags.Admin},
+		Parameters:  []Parameter{userID},
+		Responses: map[string]Response{
+			"200": jsonResponse("The override.", overrideSchema),
+			"400": errorResponse("The URI is invalid."),
+			"404": errorResponse("The user has no override."),
+			"502": forwarded,
+		},
+	})
+	d.add(http.MethodPut, "/admin/overrides/{user_id}", &Operation{
+		OperationID: "setOverride",
+		Summary:     "Force the allocation mode of a user",
+		Tags:        []string{tags.Admin},
+		Parameters:  []Parameter{userID},
+		RequestBody: &RequestBody{Required: true, Content: jsonContent(overrideBody)},
+		Responses: map[string]Response{
+			"200": jsonResponse("The override.", overrideSchema),
+			"400": errorResponse("The URI or the override is invalid."),
+			"502": forwarded,
+		},
+	})
+	d.add(http.MethodDelete, "/admin/overrides/{user_id}", &Operation{
+		OperationID: "clearOverride",
+		Summary:     "Clear the allocation mode override of a user",
+		Tags:        []string{tags.Admin},
+		Parameters:  []Parameter{userID},
+		Responses: map[string]Response{
+			"204": {Description: "The override is cleared."},
+			"400": errorResponse("The URI is invalid."),
+			"502": forwarded,
+		},
+	})
+
+	d.add(http.MethodGet, "/admin/usage", &Operation{
+		OperationID: "listUsage",
+		Summary:     "What clients used of their rate limits and quotas",
+		Tags:        []string{tags.Admin},
+		Responses:   map[string]Response{"200": jsonResponse("The usage of every client seen today or configured.", s.of([]ratelimit.Usage{}))},
+	})
+	d.add(http.MethodGet, "/admin/usage/{client_id}", &Operation{
+		OperationID: "getUsage",
+		Summary:     "What a client used of its rate limits and quotas",
+		Tags:        []string{tags.Admin},
+		Parameters:  []Parameter{clientID},
+		Responses:   map[string]Response{"200": jsonResponse("The usage.", s.of(ratelimit.Usage{}))},
+	})
+
+	d.add(http.MethodGet, "/admin/cluster", &Operation{
+		OperationID: "getMembership",
+		Summary:     "The instances of the cluster",
+		Tags:        []string{tags.Admin},
+		Responses:   map[string]Response{"200": jsonResponse("The membership.", s.of(cluster.Membership{}))},
+	})
+	d.add(http.MethodPut, "/admin/cluster/peers", &Operation{
+		OperationID: "setPeers",
+		Summary:     "Replace the instances of the cluster",
+		Description: "Buckets of the users now owned by another instance are released.",
+		Tags:        []string{tags.Admin},
+		RequestBody: &RequestBody{Required: true, Content: jsonContent(peersBody)},
+		Responses: map[string]Response{
+			"200": jsonResponse("The new membership and how many users were handed off.", s.of(cluster.Handoff{})),
+			"400": errorResponse("The peers are invalid."),
+			"409": errorResponse("Cluster mode is disabled."),
+		},
+	})
+
+	d.add(http.MethodPost, "/admin/config/reload", &Operation{
+		OperationID: "reloadConfig",
+		Summary:     "Reload the configuration",
+		Description: "Settings that cannot change at runtime are reported and applied on restart.",
+		Tags:        []string{tags.Admin},
+		Responses: map[string]Response{
+			"200": jsonResponse("The changed settings.", s.of(reload.Result{})),
+			"422": errorResponse("The configuration is invalid; nothing was applied."),
+		},
+	})
+	d.add(http.MethodPut, "/admin/bucket-mode", &Operation{
+		OperationID: "setBucketMode",
+		Summary:     "Pause or resume bucket allocation",
+		Tags:        []string{tags.Admin},
+		RequestBody: &RequestBody{Required: true, Content: jsonContent(bucketModeBody)},
+		Responses: map[string]Response{
+			"200": jsonResponse("Whether bucket mode is paused.", bucketMode),
+			"400": errorResponse("The body is invalid."),
+		},
+	})
+
+	released := s.of(allocator.Released{})
+	d.add(http.MethodGet, "/admin/registry", &Operation{
+		OperationID: "getRegistry",
+		Summary:     "Every bucket held",
+		Tags:        []string{tags.Admin},
+		Responses: map[string]Response{
+			"200": jsonResponse("The buckets by user.", s.of(allocator.RegistryState{})),
+		},
+	})
+	d.add(http.MethodDelete, "/admin/registry", &Operation{
+		OperationID: "flushRegistry",
+		Summary:     "Release every bucket",
+		Tags:        []string{tags.Admin},
+		Responses: map[string]Response{
+			"200": jsonResponse("What was released.", released),
+		},
+	})
+	d.add(http.MethodGet, "/admin/registry/{user_id}", &Operation{
+		OperationID: "getUserBuckets",
+		Summary:     "The buckets of a user",
+		Tags:        []string{tags.Admin},
+		Parameters:  []Parameter{userID},
+		Responses: map[string]Response{
+			"200": jsonResponse("The buckets.", s.of(allocator.UserState{})),
+			"400": errorResponse("The URI is invalid."),
+			"502": forwarded,
+		},
+	})
+	d.add(http.MethodDelete, "/admin/registry/{user_id}", &Operation{
+		OperationID: "releaseUserBuckets",
+		Summary:     "Release the buckets of a user",
+		Tags:        []string{tags.Admin},
+		Parameters:  []Parameter{userID},
+		Responses: map[string]Response{
+			"200": jsonResponse("What was released.", released),
+			"400": errorResponse("The URI is invalid."),
+			"502": forwarded,
+		},
+	})
+	d.add(http.MethodDelete, "/admin/registry/{user_id}/buckets/{reserve_id}", &Operation{
+		OperationID: "releaseBucket",
+		Summary:     "Release one bucket of a user",
+		Tags:        []string{tags.Admin},
+		Parameters:  []Parameter{userID, pathParameter("reserve_id", s.of(int64(0)))},
+		Responses: map[string]Response{
+			"204": {Description: "The bucket was released."},
+			"400": errorResponse("The URI is invalid."),
+			"404": errorResponse("The user holds no such bucket."),
+			"502": forwarded,
+		},
+	})
+
+	return d
+}
+
+// add documents an operation. Every operation may be answered with a 500
+// and echoes the request ID.
+func (d *Document) add(method, path string, operation *Operation) {
+	requestID := Parameter{
+		Name:        "X-Request-Id",
+		In:          "header",
+		Description: "Identifies the request in logs and traces; generated when absent.",
+		Schema:      &Schema{Type: "string"},
+	}
+	traceParent := Parameter{
+		Name:        "traceparent",
+		In:          "header",
+		Description: "W3C trace context the request is traced under.",
+		Schema:      &Schema{Type: "string"},
+	}
+	operation.Parameters = append(operation.Parameters, requestID, traceParent)
+
+	// every admin route requires the admin token
+	if strings.HasPrefix(path, "/admin/") {
+		operation.Security = []map[string][]string{{"adminToken": {}}}
+		operation.Responses["401"] = errorResponse("The admin token is missing or wrong.", "WWW-Authenticate")
+		operation.Responses["403"] = errorResponse("No admin token is configured.")
+	}
+
+	if _, ok := operation.Responses[strconv.Itoa(http.StatusInternalServerError)]; !ok {
+		operation.Responses["500"] = errorResponse("Unexpected failure.")
+	}
+	for status, response := range operation.Responses {
+		if response.Headers == nil {
+			response.Headers = map[string]Header{}
+		}
+		response.Headers["X-Request-Id"] = Header{Schema: &Schema{Type: "string"}}
+		operation.Responses[status] = response
+	}
+
+	if d.Paths[path] == nil {
+		d.Paths[path] = PathItem{}
+	}
+	d.Paths[path][strings.ToLower(method)] = operation
+}
+
+func pathParameter(name string, schema *Schema) Parameter {
+	return Parameter{Name: name, In: "path", Required: true, Schema: schema}
+}
+
+func jsonContent(schema *Schema) map[string]MediaType {
+	return map[string]MediaType{"application/json": {Schema: schema}}
+}
+
+func jsonResponse(description string, schema *Schema) Response {
+	return Response{Description: description, Content: jsonContent(schema)}
+}
+
+// errorResponse is an Error response, with the headers it sets.
+func errorResponse(description string, headers ...string) Response {
+	response := Response{Description: description, Content: jsonContent(ref("Error"))}
+	if len(headers) > 0 {
+		response.Headers = map[string]Header{}
+		for _, header := range headers {
+			response.Headers[header] = Header{Schema: &Schema{Type: "string"}}
+		}
+	}
+
+	return response
+}
+
+func one() *float64 {
+	value := 1.0
+	return &value
+}
+
+// stringsOf lists the values of a slice of named strings.
+func stringsOf(values interface{}) []string {
+	v := reflect.ValueOf(values)
+	names := make([]string, v.Len())
+	for i := range names {
+		names[i] = v.Index(i).String()
+	}
+
+	return names
+}
@@ -0,0 +1,144 @@
+package openapi
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// validate checks value, as decoded by encoding/json, against schema and
+// returns one message per mismatch, prefixed with where it was found.
+func (d *Document) validate(schema *Schema, value interface{}, at string) []string {
+	if schema == nil {
+		return nil
+	}
+	if schema.Ref != "" {
+		resolved, ok := d.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+		if !ok {
+			return []string{fmt.Sprintf("%s: unknown schema %s", at, schema.Ref)}
+		}
+		return d.validate(resolved, value, at)
+	}
+
+	if value == nil {
+		if schema.Nullable || (schema.Type == "" && len(schema.OneOf) == 0) {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s: must not be null", at)}
+	}
+
+	if len(schema.OneOf) > 0 {
+		matches := 0
+		for _, option := range schema.OneOf {
+			if len(d.validate(option, value, at)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return []string{fmt.Sprintf("%s: must match exactly one schema, matches %d", at, matches)}
+		}
+		return nil
+	}
+
+	var errors []string
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: must be an object", at)}
+		}
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				errors = append(errors, fmt.Sprintf("%s.%s: is required", at, name))
+			}
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := schema.Properties[name]
+			if !ok {
+				property = schema.AdditionalProperties
+			}
+			if property == nil && schema.Properties != nil {
+				errors = append(errors, fmt.Sprintf("%s.%s: is not documented", at, name))
+				continue
+			}
+			errors = append(errors, d.validate(property, object[name], at+"."+name)...)
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: must be an array", at)}
+		}
+		for i, item := range array {
+			errors = append(errors, d.validate(schema.Items, item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s: must be a string", at)}
+		}
+		if schema.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				errors = append(errors, fmt.Sprintf("%s: must be a date-time", at))
+			}
+		}
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok {
+			return []string{fmt.Sprintf("%s: must be a %s", at, schema.Type)}
+		}
+		if schema.Type == "integer" && n != math.Trunc(n) {
+			errors = append(errors, fmt.Sprintf("%s: must be an integer", at))
+		}
+		if schema.Minimum != nil && n < *schema.Minimum {
+			errors = append(errors, fmt.Sprintf("%s: must be at least %v", at, *schema.Minimum))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return []string{fmt.Sprintf("%s: must be a boolean", at)}
+		}
+	}
+
+	if len(schema.Enum) > 0 {
+		found := false
+		for _, allowed := range schema.Enum {
+			found = found || allowed == value
+		}
+		if !found {
+			errors = append(errors, fmt.Sprintf("%s: must be one of %v", at, schema.Enum))
+		}
+	}
+
+	return errors
+}
+
+// validateParameter checks the raw value of a path, query or header
+// parameter against its schema.
+func (d *Document) validateParameter(parameter Parameter, raw string) []string {
+	at := parameter.In + "." + parameter.Name
+
+	var value interface{} = raw
+	switch parameter.Schema.Type {
+	case "integer", "number":
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return []string{fmt.Sprintf("%s: must be a %s", at, parameter.Schema.Type)}
+		}
+		value = n
+	case "boolean":
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return []string{fmt.Sprintf("%s: must be a boolean", at)}
+		}
+		value = b
+	}
+
+	return d.validate(parameter.Schema, value, at)
+}
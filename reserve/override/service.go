@@ -0,0 +1,171 @@
+package override
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"reserve/reserve"
+	"sort"
+	"sync"
+	"time"
+)
+
+type store struct {
+	mu        sync.Mutex
+	overrides map[uint64]reserve.Override
+}
+
+// Service keeps the allocation mode overrides set by support and risk teams.
+// Expired overrides are dropped the next time they are looked up.
+type Service struct {
+	store *store
+}
+
+func NewService() Service {
+	return Service{
+		&store{overrides: map[uint64]reserve.Override{}},
+	}
+}
+
+type Body struct {
+	Mode      reserve.AllocationMode `json:"mode"`
+	Reason    string                 `json:"reason"`
+	ExpiresAt *time.Time             `json:"expires_at"`
+}
+
+func (s *Service) Lookup(userID uint64) (reserve.Override, bool) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	override, ok := s.store.overrides[userID]
+	if !ok {
+		return reserve.Override{}, false
+	}
+
+	if override.Expired(time.Now()) {
+		delete(s.store.overrides, userID)
+		return reserve.Override{}, false
+	}
+
+	return override, true
+}
+
+func (s *Service) List() []reserve.Override {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	now := time.Now()
+	overrides := []reserve.Override{}
+	for userID, override := range s.store.overrides {
+		if override.Expired(now) {
+			delete(s.store.overrides, userID)
+			continue
+		}
+		overrides = append(overrides, override)
+	}
+	sort.Slice(overrides, func(i, j int) bool {
+		return overrides[i].UserID < overrides[j].UserID
+	})
+
+	return overrides
+}
+
+func (s *Service) HandleSet(c *gin.Context) {
+	var uri reserve.CreateURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid uri!",
+			"code":    "invalid_uri",
+		})
+		return
+	}
+
+	var body Body
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid override!",
+			"code":    "invalid_override",
+		})
+		return
+	}
+
+	var errors []interface{}
+	if !body.Mode.Valid() {
+		errors = append(errors, reserve.NewValidationError("invalid_mode", "mode"))
+	}
+	if body.Reason == "" {
+		errors = append(errors, reserve.NewValidationError("required", "reason"))
+	}
+	now := time.Now()
+	if body.ExpiresAt != nil && !body.ExpiresAt.After(now) {
+		errors = append(errors, reserve.NewValidationError("invalid_expiry", "expires_at"))
+	}
+	if len(errors) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid override!",
+			"code":    "invalid_override",
+			"errors":  errors,
+		})
+		return
+	}
+
+	override := reserve.Override{
+		UserID:      uri.UserID,
+		Mode:        body.Mode,
+		Reason:      body.Reason,
+		ExpiresAt:   body.ExpiresAt,
+		DateCreated: now,
+	}
+
+	s.store.mu.Lock()
+	s.store.overrides[uri.UserID] = override
+	s.store.mu.Unlock()
+
+	c.JSON(http.StatusOK, override)
+	return
+}
+
+func (s *Service) HandleGet(c *gin.Context) {
+	var uri reserve.CreateURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid uri!",
+			"code":    "invalid_uri",
+		})
+		return
+	}
+
+	override, ok := s.Lookup(uri.UserID)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"message": "Override not found",
+			"code":    "override_not_found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, override)
+	return
+}
+
+func (s *Service) HandleClear(c *gin.Context) {
+	var uri reserve.CreateURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid uri!",
+			"code":    "invalid_uri",
+		})
+		return
+	}
+
+	s.store.mu.Lock()
+	delete(s.store.overrides, uri.UserID)
+	s.store.mu.Unlock()
+
+	c.Status(http.StatusNoContent)
+	return
+}
+
+func (s *Service) HandleList(c *gin.Context) {
+	c.JSON(http.StatusOK, s.List())
+	return
+}
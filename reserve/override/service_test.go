@@ -0,0 +1,114 @@
+package override
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"reserve/reserve"
+	"testing"
+	"time"
+)
+
+func newRouter(s Service) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/overrides", s.HandleList)
+	router.GET("/overrides/:user_id", s.HandleGet)
+	router.PUT("/overrides/:user_id", s.HandleSet)
+	router.DELETE("/overrides/:user_id", s.HandleClear)
+
+	return router
+}
+
+func serve(router *gin.Engine, method, path string, body interface{}) *httptest.ResponseRecorder {
+	var bodyBytes []byte
+	if body != nil {
+		bodyBytes, _ = json.Marshal(body)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(bodyBytes)))
+
+	return w
+}
+
+func TestSetAndClear(t *testing.T) {
+	s := NewService()
+	router := newRouter(s)
+
+	if w := serve(router, http.MethodPut, "/overrides/1", gin.H{"mode": "bucket", "reason": "incident"}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 setting the override, got %d: %s", w.Code, w.Body.String())
+	}
+	override, ok := s.Lookup(1)
+	if !ok || override.Mode != reserve.AllocationModes.Bucket || override.Reason != "incident" {
+		t.Fatalf("expected the override to be kept, got %+v", override)
+	}
+	if w := serve(router, http.MethodGet, "/overrides/1", nil); w.Code != http.StatusOK {
+		t.Errorf("expected 200 getting the override, got %d", w.Code)
+	}
+
+	if w := serve(router, http.MethodDelete, "/overrides/1", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 clearing the override, got %d", w.Code)
+	}
+	if _, ok := s.Lookup(1); ok {
+		t.Error("expected the override to be cleared")
+	}
+	if w := serve(router, http.MethodGet, "/overrides/1", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 once cleared, got %d", w.Code)
+	}
+}
+
+func TestSetValidation(t *testing.T) {
+	router := newRouter(NewService())
+
+	past := time.Now().Add(-time.Minute)
+	cases := map[string]gin.H{
+		"invalid_mode":   {"mode": "hot", "reason": "incident"},
+		"required":       {"mode": "bucket"},
+		"invalid_expiry": {"mode": "bucket", "reason": "incident", "expires_at": past},
+	}
+	for code, body := range cases {
+		w := serve(router, http.MethodPut, "/overrides/1", body)
+
+		var response struct {
+			Errors []struct {
+				Code string `json:"code"`
+			} `json:"errors"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		if w.Code != http.StatusBadRequest || len(response.Errors) != 1 || response.Errors[0].Code != code {
+			t.Errorf("%s: expected a 400 listing it, got %d: %s", code, w.Code, w.Body.String())
+		}
+	}
+
+	if w := serve(router, http.MethodPut, "/overrides/abc", gin.H{"mode": "bucket", "reason": "incident"}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid user ID, got %d", w.Code)
+	}
+}
+
+func TestExpiredOverridesAreDropped(t *testing.T) {
+	s := NewService()
+	router := newRouter(s)
+
+	expiresAt := time.Now().Add(20 * time.Millisecond)
+	serve(router, http.MethodPut, "/overrides/1", gin.H{"mode": "standalone", "reason": "incident", "expires_at": expiresAt})
+	serve(router, http.MethodPut, "/overrides/2", gin.H{"mode": "bucket", "reason": "merchant"})
+
+	if overrides := s.List(); len(overrides) != 2 || overrides[0].UserID != 1 || overrides[1].UserID != 2 {
+		t.Fatalf("expected both overrides by user, got %+v", overrides)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if _, ok := s.Lookup(1); ok {
+		t.Error("expected the expired override not to be found")
+	}
+	if overrides := s.List(); len(overrides) != 1 || overrides[0].UserID != 2 {
+		t.Errorf("expected only the override without expiry to be listed, got %+v", overrides)
+	}
+	if len(s.store.overrides) != 1 {
+		t.Errorf("expected the expired override to be dropped, %d kept", len(s.store.overrides))
+	}
+}
@@ -0,0 +1,433 @@
+package ratelimit
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"math"
+	"net/http"
+	"reserve/reserve"
+	"reserve/reserve/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	InvalidClientLimitsError = errors.New("client limits must be listed as client_id:requests_per_second:burst:daily_requests:daily_amount")
+)
+
+var rejectionReasons = struct {
+	RateLimit     string
+	DailyRequests string
+	DailyAmount   string
+}{
+	"rate_limit",
+	"daily_requests",
+	"daily_amount",
+}
+
+var rejected = metrics.NewCounterVec(
+	"reserve_client_requests_rejected_total",
+	"Reserve requests refused by the client rate limits and quotas, by reason.",
+	"reason",
+)
+
+// Limits bound the reserve requests of a client: a token bucket refilled at
+// RequestsPerSecond holding up to Burst requests, and the number of requests
+// and total amount, in cents, requested per UTC day. Zero means unlimited.
+type Limits struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+	DailyRequests     int64   `json:"daily_requests"`
+	DailyAmount       int64   `json:"daily_amount"`
+}
+
+type limits struct {
+	defaults Limits
+	clients  map[string]Limits
+}
+
+func (l limits) of(clientID string) Limits {
+	if clientLimits, ok := l.clients[clientID]; ok {
+		return clientLimits
+	}
+
+	return l.defaults
+}
+
+// usage is what a client consumed of its limits.
+type usage struct {
+	tokens        float64
+	refilled      time.Time
+	day           string
+	dailyRequests int64
+	dailyAmount   int64
+	// keys holds the idempotency keys counted today, when the client has
+	// daily quotas
+	keys map[string]bool
+}
+
+type Usage struct {
+	ClientID      string  `json:"client_id"`
+	Limits        Limits  `json:"limits"`
+	Tokens        float64 `json:"tokens"`
+	Day           string  `json:"day"`
+	DailyRequests int64   `json:"daily_requests"`
+	DailyAmount   int64   `json:"daily_amount"`
+}
+
+type state struct {
+	mu     sync.Mutex
+	day    string
+	usages map[string]*usage
+}
+
+// Service enforces the per-client limits before reserves are allocated.
+// Every instance keeps its own counters, so in cluster mode a client gets
+// the limits on each of them.
+type Service struct {
+	enabled bool
+	limits  *atomic.Value
+	state   *state
+}
+
+func NewService(config reserve.RateLimitConfig) (Service, error) {
+	s := Service{
+		enabled: config.Enabled,
+		limits:  &atomic.Value{},
+		state:   &state{usages: map[string]*usage{}},
+	}
+	if err := s.Reload(config); err != nil {
+		return Service{}, err
+	}
+
+	return s, nil
+}
+
+// Reload swaps in the limits of config. Usage is kept, so a client does not
+// get a fresh quota when its limits change.
+func (s *Service) Reload(config reserve.RateLimitConfig) error {
+	l, err := newLimits(config)
+	if err != nil {
+		return err
+	}
+	s.limits.Store(l)
+
+	return nil
+}
+
+// Check reports why Reload would refuse config.
+func (s *Service) Check(config reserve.RateLimitConfig) error {
+	_, err := newLimits(config)
+
+	return err
+}
+
+func newLimits(config reserve.RateLimitConfig) (limits, error) {
+	l := limits{
+		defaults: Limits{
+			RequestsPerSecond: config.RequestsPerSecond,
+			Burst:             config.Burst,
+			DailyRequests:     config.DailyRequests,
+			DailyAmount:       config.DailyAmount,
+		},
+		clients: map[string]Limits{},
+	}
+	for _, entry := range config.Clients {
+		clientID, clientLimits, err := ParseClientLimits(entry)
+		if err != nil {
+			return limits{}, err
+		}
+		l.clients[clientID] = clientLimits
+	}
+
+	return l, nil
+}
+
+// ParseClientLimits reads an entry of the Clients setting.
+func ParseClientLimits(entry string) (string, Limits, error) {
+	parts := strings.Split(entry, ":")
+	if len(parts) != 5 || parts[0] == "" {
+		return "", Limits{}, InvalidClientLimitsError
+	}
+
+	requestsPerSecond, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || requestsPerSecond < 0 {
+		return "", Limits{}, InvalidClientLimitsError
+	}
+	burst, err := strconv.Atoi(parts[2])
+	if err != nil || burst < 0 || (requestsPerSecond > 0 && burst < 1) {
+		return "", Limits{}, InvalidClientLimitsError
+	}
+	dailyRequests, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil || dailyRequests < 0 {
+		return "", Limits{}, InvalidClientLimitsError
+	}
+	dailyAmount, err := strconv.ParseInt(parts[4], 10, 64)
+	if err != nil || dailyAmount < 0 {
+		return "", Limits{}, InvalidClientLimitsError
+	}
+
+	return parts[0], Limits{requestsPerSecond, burst, dailyRequests, dailyAmount}, nil
+}
+
+// Admission is the outcome of Admit. Replays of a request already counted
+// today, by idempotency key, are admitted without being counted again.
+type Admission struct {
+	Admitted   bool
+	Replay     bool
+	Reason     string
+	RetryAfter time.Duration
+}
+
+// Admit counts a request of clientID for amount, unless it exceeds one of
+// the client's limits. It then tells why and how long to wait before
+// retrying.
+func (s *Service) Admit(clientID, idempotencyKey string, amount int64, now time.Time) Admission {
+	l := s.limits.Load().(limits).of(clientID)
+
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	u := s.usage(clientID, l, now)
+	replay := idempotencyKey != "" && u.keys[idempotencyKey]
+
+	if !replay && l.DailyRequests > 0 && u.dailyRequests+1 > l.DailyRequests {
+		return Admission{Reason: rejectionReasons.DailyRequests, RetryAfter: untilTomorrow(now)}
+	}
+	if !replay && l.DailyAmount > 0 && u.dailyAmount+amount > l.DailyAmount {
+		return Admission{Reason: rejectionReasons.DailyAmount, RetryAfter: untilTomorrow(now)}
+	}
+	// replays still take a token, they do load the upstream
+	if l.RequestsPerSecond > 0 {
+		if u.tokens < 1 {
+			wait := time.Duration((1 - u.tokens) / l.RequestsPerSecond * float64(time.Second))
+			return Admission{Reason: rejectionReasons.RateLimit, RetryAfter: wait}
+		}
+		u.tokens--
+	}
+	if replay {
+		return Admission{Admitted: true, Replay: true}
+	}
+
+	u.dailyRequests++
+	u.dailyAmount += amount
+	if idempotencyKey != "" && (l.DailyRequests > 0 || l.DailyAmount > 0) {
+		u.keys[idempotencyKey] = true
+	}
+
+	return Admission{Admitted: true}
+}
+
+// Refund gives back a request admitted for amount that did not reserve
+// anything, so that it is counted when retried. Its token is not given
+// back, as it did load the upstream.
+func (s *Service) Refund(clientID, idempotencyKey string, amount int64, now time.Time) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	u, ok := s.state.usages[clientID]
+	if !ok || u.day != day(now) {
+		return
+	}
+
+	u.dailyRequests--
+	u.dailyAmount -= amount
+	delete(u.keys, idempotencyKey)
+}
+
+// RefundAmount gives back the part of the amount of a request that was not
+// reserved, as when a partial reserve is capped by the user's balance.
+func (s *Service) RefundAmount(clientID string, amount int64, now time.Time) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	u, ok := s.state.usages[clientID]
+	if !ok || u.day != day(now) {
+		return
+	}
+
+	u.dailyAmount -= amount
+}
+
+// Settle refunds a counted request once its allocation completed after the
+// response, as async reserves do: all of it when it failed, or the part of
+// its amount that was not reserved.
+func (s *Service) Settle(request reserve.ReserveRequest, reserved int64, err error) {
+	if !request.Counted {
+		return
+	}
+
+	now := time.Now()
+	if err != nil {
+		s.Refund(request.ClientID, request.IdempotencyKey, request.Body.Amount, now)
+		return
+	}
+	if reserved < request.Body.Amount {
+		s.RefundAmount(request.ClientID, request.Body.Amount-reserved, now)
+	}
+}
+
+// usage returns the usage of clientID, refilled up to now, and starts
+// tracking it. The usage of idle clients is forgotten once a day.
+func (s *Service) usage(clientID string, l Limits, now time.Time) *usage {
+	today := day(now)
+	if s.state.day != today {
+		for id, u := range s.state.usages {
+			if u.day != today && now.Sub(u.refilled) > time.Hour {
+				delete(s.state.usages, id)
+			}
+		}
+		s.state.day = today
+	}
+
+	u, ok := s.state.usages[clientID]
+	if !ok {
+		u = newUsage(l, now)
+		s.state.usages[clientID] = u
+	}
+	u.refresh(l, now)
+
+	return u
+}
+
+func newUsage(l Limits, now time.Time) *usage {
+	return &usage{
+		tokens:   float64(l.Burst),
+		refilled: now,
+		day:      day(now),
+		keys:     map[string]bool{},
+	}
+}
+
+// refresh refills the tokens of u up to now and resets its daily counters
+// on a new day.
+func (u *usage) refresh(l Limits, now time.Time) {
+	if elapsed := now.Sub(u.refilled).Seconds(); elapsed > 0 {
+		u.tokens = math.Min(float64(l.Burst), u.tokens+elapsed*l.RequestsPerSecond)
+		u.refilled = now
+	}
+	if today := day(now); u.day != today {
+		u.day = today
+		u.dailyRequests = 0
+		u.dailyAmount = 0
+		u.keys = map[string]bool{}
+	}
+}
+
+// Usage is what clientID used of its limits; clients not seen today get the
+// usage of a fresh client, without being tracked.
+func (s *Service) Usage(clientID string) Usage {
+	l := s.limits.Load().(limits).of(clientID)
+	now := time.Now()
+
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	u := *newUsage(l, now)
+	if tracked, ok := s.state.usages[clientID]; ok {
+		u = *tracked
+		u.refresh(l, now)
+	}
+
+	return Usage{
+		ClientID:      clientID,
+		Limits:        l,
+		Tokens:        u.tokens,
+		Day:           u.day,
+		DailyRequests: u.dailyRequests,
+		DailyAmount:   u.dailyAmount,
+	}
+}
+
+// List is the usage of every client seen today or configured.
+func (s *Service) List() []Usage {
+	l := s.limits.Load().(limits)
+
+	s.state.mu.Lock()
+	clientIDs := map[string]bool{}
+	for clientID := range s.state.usages {
+		clientIDs[clientID] = true
+	}
+	s.state.mu.Unlock()
+	for clientID := range l.clients {
+		clientIDs[clientID] = true
+	}
+
+	usages := []Usage{}
+	for clientID := range clientIDs {
+		usages = append(usages, s.Usage(clientID))
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].ClientID < usages[j].ClientID
+	})
+
+	return usages
+}
+
+func day(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+func untilTomorrow(now time.Time) time.Duration {
+	now = now.UTC()
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+
+	return tomorrow.Sub(now)
+}
+
+// RegisterMiddleware refuses, with 429 and Retry-After, the reserve requests
+// of clients over their limits. Requests count against the daily quotas for
+// the amount they reserved: nothing when they fail, less than requested for
+// partial reserves. Queued reserves count for the amount requested.
+func (s *Service) RegisterMiddleware(c *gin.Context) {
+	if !s.enabled {
+		c.Next()
+		return
+	}
+
+	clientID := reserve.PeekClientID(c)
+	idempotencyKey := c.GetHeader("X-Idempotency-Key")
+	body, _ := reserve.PeekBody(c)
+
+	admission := s.Admit(clientID, idempotencyKey, body.Amount, time.Now())
+	if !admission.Admitted {
+		rejected.With(admission.Reason).Inc()
+		c.Header("Retry-After", strconv.FormatInt(int64(math.Ceil(admission.RetryAfter.Seconds())), 10))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+			"message": "Too many requests!",
+			"code":    admission.Reason + "_exceeded",
+		})
+		return
+	}
+
+	if !admission.Replay {
+		c.Set(reserve.CountedKey, true)
+	}
+	c.Next()
+
+	// async reserves are settled once they complete, see Settle
+	if admission.Replay || c.Writer.Status() == http.StatusAccepted {
+		return
+	}
+	if status := c.Writer.Status(); status >= http.StatusBadRequest {
+		s.Refund(clientID, idempotencyKey, body.Amount, time.Now())
+		return
+	}
+	if reserved, ok := c.Get(reserve.ReservedAmountKey); ok && reserved.(int64) < body.Amount {
+		s.RefundAmount(clientID, body.Amount-reserved.(int64), time.Now())
+	}
+}
+
+func (s *Service) HandleList(c *gin.Context) {
+	c.JSON(http.StatusOK, s.List())
+	return
+}
+
+func (s *Service) HandleGet(c *gin.Context) {
+	c.JSON(http.StatusOK, s.Usage(c.Param("client_id")))
+	return
+}
@@ -0,0 +1,203 @@
+package ratelimit
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"reserve/reserve"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestService(t *testing.T, configure func(config *reserve.RateLimitConfig)) Service {
+	config := reserve.NewConfig().RateLimit
+	config.Enabled = true
+	configure(&config)
+
+	s, err := NewService(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestRateLimit(t *testing.T) {
+	s := newTestService(t, func(config *reserve.RateLimitConfig) {
+		config.RequestsPerSecond = 2
+		config.Burst = 3
+	})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !s.Admit("1234", "", 100, now).Admitted {
+			t.Fatalf("expected request %d of the burst to be admitted", i)
+		}
+	}
+
+	admission := s.Admit("1234", "", 100, now)
+	if admission.Admitted || admission.Reason != rejectionReasons.RateLimit || admission.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms for a token, got %+v", admission)
+	}
+
+	if !s.Admit("5678", "", 100, now).Admitted {
+		t.Error("expected other clients to have their own bucket")
+	}
+	if !s.Admit("1234", "", 100, now.Add(500*time.Millisecond)).Admitted {
+		t.Error("expected a token to be refilled")
+	}
+}
+
+func TestDailyQuotas(t *testing.T) {
+	s := newTestService(t, func(config *reserve.RateLimitConfig) {
+		config.RequestsPerSecond = 0
+		config.Clients = []string{"1234:0:0:2:1000", "5678:0:0:0:500"}
+	})
+	now := time.Date(2026, 10, 19, 23, 0, 0, 0, time.UTC)
+
+	s.Admit("1234", "a", 100, now)
+	s.Admit("1234", "b", 100, now)
+	admission := s.Admit("1234", "c", 100, now)
+	if admission.Admitted || admission.Reason != rejectionReasons.DailyRequests || admission.RetryAfter != time.Hour {
+		t.Fatalf("expected the daily requests to run out until midnight, got %+v", admission)
+	}
+	if admission := s.Admit("1234", "a", 100, now); !admission.Admitted || !admission.Replay {
+		t.Errorf("expected a replay to be admitted without being counted, got %+v", admission)
+	}
+
+	s.Refund("1234", "b", 100, now)
+	if admission := s.Admit("1234", "b", 100, now); !admission.Admitted || admission.Replay {
+		t.Errorf("expected a refunded request to be counted again when retried, got %+v", admission)
+	}
+
+	if admission := s.Admit("5678", "", 600, now); admission.Admitted || admission.Reason != rejectionReasons.DailyAmount {
+		t.Errorf("expected the daily amount to be exceeded, got %+v", admission)
+	}
+
+	if !s.Admit("1234", "a", 100, now.Add(2*time.Hour)).Admitted {
+		t.Error("expected the quotas to reset the next day")
+	}
+	if u := s.state.usages["1234"]; u.day != "2026-10-20" || u.dailyRequests != 1 || u.dailyAmount != 100 {
+		t.Errorf("unexpected usage %+v", u)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, func(config *reserve.RateLimitConfig) {
+		config.RequestsPerSecond = 0.5
+		config.Burst = 1
+		config.DailyAmount = 5000
+	})
+
+	router := gin.New()
+	router.POST("/api/users/:user_id/reserve", s.RegisterMiddleware, func(c *gin.Context) {
+		if c.Query("fail") != "" {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		c.Set(reserve.ReservedAmountKey, int64(1000))
+		c.Status(http.StatusOK)
+	})
+
+	serve := func(query, idempotencyKey string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/api/users/1/reserve"+query, strings.NewReader(`{"amount": 25}`))
+		request.Header.Set("X-Client-Id", "1234")
+		request.Header.Set("X-Idempotency-Key", idempotencyKey)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, request)
+
+		return w
+	}
+
+	if w := serve("?fail=1", "a"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if usage := s.Usage("1234"); usage.DailyAmount != 0 {
+		t.Errorf("expected a failed request not to count against the quota, got %+v", usage)
+	}
+
+	w := serve("", "a")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("expected 429 with Retry-After 2, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// a partial reserve of 1000 of the 2500 requested counts for 1000
+	s.state.usages["1234"].tokens = 1
+	if w := serve("", "b"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if usage := s.Usage("1234"); usage.DailyRequests != 1 || usage.DailyAmount != 1000 {
+		t.Errorf("expected the reserved amount to be counted, got %+v", usage)
+	}
+
+	s.state.usages["1234"].tokens = 1
+	if w := serve("", "b"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a replay, got %d", w.Code)
+	}
+	if usage := s.Usage("1234"); usage.DailyRequests != 1 || usage.DailyAmount != 1000 {
+		t.Errorf("expected a replay not to be counted again, got %+v", usage)
+	}
+}
+
+func TestAsyncReservesAreSettledOnCompletion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := newTestService(t, func(config *reserve.RateLimitConfig) {
+		config.RequestsPerSecond = 0
+		config.DailyAmount = 5000
+	})
+
+	var submitted []reserve.ReserveRequest
+	router := gin.New()
+	router.POST("/api/users/:user_id/reserve", s.RegisterMiddleware, func(c *gin.Context) {
+		submitted = append(submitted, reserve.ReserveRequest{
+			ClientID:       "1234",
+			IdempotencyKey: c.GetHeader("X-Idempotency-Key"),
+			Body:           reserve.Body{Amount: 2500},
+			Counted:        c.GetBool(reserve.CountedKey),
+		})
+		c.Status(http.StatusAccepted)
+	})
+	serve := func(idempotencyKey string) {
+		request := httptest.NewRequest(http.MethodPost, "/api/users/1/reserve", strings.NewReader(`{"amount": 25}`))
+		request.Header.Set("X-Client-Id", "1234")
+		request.Header.Set("X-Idempotency-Key", idempotencyKey)
+		router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	serve("a")
+	serve("a")
+	serve("b")
+	if usage := s.Usage("1234"); usage.DailyRequests != 2 || usage.DailyAmount != 5000 {
+		t.Fatalf("expected pending reserves to be counted in full, got %+v", usage)
+	}
+
+	// the replay of a completes too, and must not be refunded again
+	s.Settle(submitted[0], 1000, nil)
+	s.Settle(submitted[1], 1000, nil)
+	s.Settle(submitted[2], 0, errors.New("generic error"))
+	if usage := s.Usage("1234"); usage.DailyRequests != 1 || usage.DailyAmount != 1000 {
+		t.Errorf("expected the reserved amount only to be counted, got %+v", usage)
+	}
+}
+
+func TestUsageDoesNotTrackUnknownClients(t *testing.T) {
+	s := newTestService(t, func(config *reserve.RateLimitConfig) {
+		config.Burst = 3
+		config.Clients = []string{"1234:1:5:10:1000"}
+	})
+
+	if usage := s.Usage("unknown"); usage.Tokens != 3 || usage.DailyRequests != 0 || usage.Day == "" {
+		t.Errorf("expected the usage of a fresh client, got %+v", usage)
+	}
+	if len(s.state.usages) != 0 {
+		t.Errorf("expected reading usage not to track clients, got %d", len(s.state.usages))
+	}
+	if usages := s.List(); len(usages) != 1 || usages[0].ClientID != "1234" || usages[0].Tokens != 5 {
+		t.Errorf("expected only the configured client to be listed, got %+v", usages)
+	}
+}
@@ -0,0 +1,167 @@
+package reload
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"os/signal"
+	"reserve/reserve"
+	"reserve/reserve/logger"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+type state struct {
+	mu      sync.Mutex
+	current reserve.Config
+}
+
+// Service reloads the configuration on SIGHUP or through the admin API and
+// hands it to every applier, which swap in the settings they can change at
+// runtime.
+type Service struct {
+	state    *state
+	load     func() (reserve.Config, error)
+	appliers []Applier
+	logger   *logger.Logger
+}
+
+// Applier swaps in the settings of a service that can change at runtime.
+// Check reports why Apply would refuse a configuration, without applying
+// anything; either may be nil.
+type Applier struct {
+	Check func(reserve.Config) error
+	Apply func(reserve.Config) error
+}
+
+type Result struct {
+	Changes []reserve.ConfigChange `json:"changes"`
+}
+
+func NewService(
+	config reserve.Config,
+	load func() (reserve.Config, error),
+	logger *logger.Logger,
+	appliers ...Applier,
+) Service {
+	return Service{
+		state:    &state{current: config},
+		load:     load,
+		appliers: appliers,
+		logger:   logger,
+	}
+}
+
+// Reload loads the configuration again and applies it, returning what
+// changed. A configuration that fails to load, or that any applier refuses,
+// is not applied at all.
+func (s *Service) Reload() ([]reserve.ConfigChange, error) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	next, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, applier := range s.appliers {
+		if applier.Check == nil {
+			continue
+		}
+		if err := applier.Check(next); err != nil {
+			return nil, err
+		}
+	}
+
+	// every applier accepted the configuration, one failing now still lets
+	// the others apply it so that they agree with each other
+	var applyErr error
+	for _, applier := range s.appliers {
+		if applier.Apply == nil {
+			continue
+		}
+		if err := applier.Apply(next); err != nil && applyErr == nil {
+			applyErr = err
+		}
+	}
+	if applyErr != nil {
+		return nil, applyErr
+	}
+
+	changes := reserve.DiffConfig(s.state.current, next)
+	s.state.current = next
+
+	if len(changes) == 0 {
+		s.logger.Info("config reloaded without changes")
+	}
+	for _, change := range changes {
+		s.logger.Info("config reloaded", "key", change.Key, "from", change.From, "to", change.To, "live", change.Live)
+	}
+
+	return changes, nil
+}
+
+// WatchSignals reloads the configuration on every SIGHUP.
+func (s *Service) WatchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			if _, err := s.Reload(); err != nil {
+				s.logger.Error("config reload failed", "trigger", "signal", "error", err)
+			}
+		}
+	}()
+}
+
+func (s *Service) token() string {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	return s.state.current.Admin.Token
+}
+
+// RegisterAuthMiddleware requires the admin bearer token. Without a token
+// configured every request is refused.
+func (s *Service) RegisterAuthMiddleware(c *gin.Context) {
+	token := s.token()
+	if token == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"message": "Admin token not configured!",
+			"code":    "admin_disabled",
+		})
+		return
+	}
+
+	authorization := c.GetHeader("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, "Bearer ")), []byte(token)) != 1 {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"message": "Invalid admin token!",
+			"code":    "unauthorized",
+		})
+		return
+	}
+
+	c.Next()
+	return
+}
+
+func (s *Service) HandleReload(c *gin.Context) {
+	changes, err := s.Reload()
+	if err != nil {
+		s.logger.Error("config reload failed", "trigger", "api", "request_id", logger.RequestID(c), "error", err)
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+			"message": err.Error(),
+			"code":    "invalid_config",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Result{changes})
+	return
+}
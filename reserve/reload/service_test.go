@@ -0,0 +1,84 @@
+package reload
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"reserve/reserve"
+	"reserve/reserve/logger"
+	"testing"
+)
+
+func TestReloadAppliesNothingWhenACheckFails(t *testing.T) {
+	config := reserve.NewConfig()
+	next := config
+	next.Allocator.OvershootFactor = 20
+
+	var applied []string
+	apply := func(name string) func(reserve.Config) error {
+		return func(reserve.Config) error {
+			applied = append(applied, name)
+			return nil
+		}
+	}
+	refused := errors.New("refused")
+	s := NewService(
+		config,
+		func() (reserve.Config, error) { return next, nil },
+		logger.Discard(),
+		Applier{Apply: apply("first")},
+		Applier{Check: func(reserve.Config) error { return refused }, Apply: apply("second")},
+	)
+
+	if _, err := s.Reload(); err != refused {
+		t.Fatalf("expected the check error, got %v", err)
+	}
+	if len(applied) != 0 {
+		t.Fatalf("expected nothing to be applied, got %v", applied)
+	}
+	if s.state.current.Allocator.OvershootFactor != 10 {
+		t.Error("expected the current configuration to be kept")
+	}
+}
+
+func TestAdminTokenIsReloaded(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	config := reserve.NewConfig()
+	config.Admin.Token = "old-secret"
+	next := config
+	next.Admin.Token = "new-secret"
+	s := NewService(config, func() (reserve.Config, error) { return next, nil }, logger.Discard())
+
+	router := gin.New()
+	router.GET("/admin", s.RegisterAuthMiddleware, func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	serve := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	if code := serve("old-secret"); code != http.StatusNoContent {
+		t.Fatalf("expected the startup token to be accepted, got %d", code)
+	}
+
+	changes, err := s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Key != "admin.token" || !changes[0].Live {
+		t.Errorf("expected the token to be reported as changed live, got %+v", changes)
+	}
+	if code := serve("old-secret"); code != http.StatusUnauthorized {
+		t.Errorf("expected the old token to be refused, got %d", code)
+	}
+	if code := serve("new-secret"); code != http.StatusNoContent {
+		t.Errorf("expected the reloaded token to be accepted, got %d", code)
+	}
+}
@@ -0,0 +1,40 @@
+package reserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+)
+
+// PeekBody decodes the reserve body of the request without consuming it, so
+// middlewares can look at it before the handler binds it.
+func PeekBody(c *gin.Context) (Body, error) {
+	var body Body
+	if c.Request.Body == nil {
+		return body, nil
+	}
+
+	raw, err := ioutil.ReadAll(c.Request.Body)
+	c.Request.Body.Close()
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(raw))
+	if err != nil {
+		return body, err
+	}
+
+	err = json.Unmarshal(raw, &body)
+	return body, err
+}
+
+// PeekClientID returns the authenticated client ID or else the one sent
+// either as header or as query parameter, preferring the header.
+func PeekClientID(c *gin.Context) string {
+	if clientID := c.GetString(AuthenticatedClientIDKey); clientID != "" {
+		return clientID
+	}
+	if clientID := c.GetHeader("X-Client-Id"); clientID != "" {
+		return clientID
+	}
+
+	return c.Query("client.id")
+}
@@ -1,32 +1,100 @@
 package reserve
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"gopkg.in/go-playground/validator.v9"
 	"net/http"
+	"reserve/reserve/logger"
+	"reserve/reserve/tracing"
+	"strings"
 )
 
 type Service struct {
-	checkConcurrency     func(uint64) bool
+	lookupOverride       func(uint64) (Override, bool)
+	checkConcurrency     func(ReserveRequest) bool
+	bucketModePaused     func() bool
 	allocateReserve      func(ReserveRequest, bool) (Reserve, error)
+	submitReserve        func(ReserveRequest, bool) (PendingReserve, error)
+	loadPendingReserve   func(uint64, string) (PendingReserve, bool)
 	listUserFromDB       func(uint64) []Reserve
 	listUserFromRegistry func(uint64) []Reserve
+	logger               *logger.Logger
 }
 
 func NewService(
-	checkConcurrency func(uint64) bool,
+	lookupOverride func(uint64) (Override, bool),
+	checkConcurrency func(ReserveRequest) bool,
+	bucketModePaused func() bool,
 	allocateReserve func(ReserveRequest, bool) (Reserve, error),
+	submitReserve func(ReserveRequest, bool) (PendingReserve, error),
+	loadPendingReserve func(uint64, string) (PendingReserve, bool),
 	listUserFromDB func(uint64) []Reserve,
 	listUserFromRegistry func(uint64) []Reserve,
+	logger *logger.Logger,
 ) Service {
 	return Service{
+		lookupOverride,
 		checkConcurrency,
+		bucketModePaused,
 		allocateReserve,
+		submitReserve,
+		loadPendingReserve,
 		listUserFromDB,
 		listUserFromRegistry,
+		logger,
 	}
 }
 
+// allocationMode picks between bucket and standalone allocation, letting a
+// manual override win over the concurrency check and a pause of bucket mode
+// win over both. The concurrency check still runs while paused so that the
+// heat of every key is current once bucket mode resumes.
+func (s *Service) allocationMode(request ReserveRequest) (bool, Diagnostics) {
+	if s.bucketModePaused() {
+		s.checkConcurrency(request)
+
+		return false, Diagnostics{
+			AllocationMode: AllocationModes.Standalone,
+			Source:         DiagnosticSources.Paused,
+		}
+	}
+
+	if override, ok := s.lookupOverride(request.UserID); ok {
+		return override.Mode == AllocationModes.Bucket, Diagnostics{
+			AllocationMode: override.Mode,
+			Source:         DiagnosticSources.Override,
+			Override:       &override,
+		}
+	}
+
+	diagnostics := Diagnostics{
+		AllocationMode: AllocationModes.Standalone,
+		Source:         DiagnosticSources.Concurrency,
+	}
+
+	isConcurrent := s.checkConcurrency(request)
+	if isConcurrent {
+		diagnostics.AllocationMode = AllocationModes.Bucket
+	}
+
+	return isConcurrent, diagnostics
+}
+
+// prefersAsync reports whether the client asked for the RFC 7240
+// respond-async preference.
+func prefersAsync(c *gin.Context) bool {
+	for _, prefer := range c.Request.Header["Prefer"] {
+		for _, preference := range strings.Split(prefer, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), "respond-async") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func (s *Service) HandleDBRequest(c *gin.Context) {
 	var uri CreateURI
 	if err := c.ShouldBindUri(&uri); err != nil {
@@ -67,6 +135,35 @@ func (s *Service) HandleRegistryRequest(c *gin.Context) {
 	return
 }
 
+func (s *Service) HandlePendingRequest(c *gin.Context) {
+	var uri ReserveURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		var errors []validationError
+		for _, err := range err.(validator.ValidationErrors) {
+			errors = append(errors, NewValidationError(err.Tag(), err.Field()))
+		}
+
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid uri!",
+			"code":    "invalid_uri",
+			"errors":  errors,
+		})
+		return
+	}
+
+	pending, ok := s.loadPendingReserve(uri.UserID, uri.ReserveID)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"message": "Reserve not found",
+			"code":    "reserve_not_found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, pending)
+	return
+}
+
 func (s *Service) HandleCreation(c *gin.Context) {
 	var uri CreateURI
 	if err := c.ShouldBindUri(&uri); err != nil {
@@ -128,6 +225,22 @@ func (s *Service) HandleCreation(c *gin.Context) {
 		return
 	}
 
+	// an authenticated client reserves for itself only
+	if authenticated := c.GetString(AuthenticatedClientIDKey); authenticated != "" {
+		queryClientID := c.Query("client.id")
+		if (headers.ClientID != "" && headers.ClientID != authenticated) ||
+			(queryClientID != "" && queryClientID != authenticated) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"message": "clientID does not match the authenticated client",
+				"code":    "forbidden_client_id",
+			})
+			return
+		}
+
+		headers.ClientID = authenticated
+		query.ClientID = ""
+	}
+
 	if headers.ClientID == "" && query.ClientID == "" {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 			"message": "Should provide clientID",
@@ -149,20 +262,70 @@ func (s *Service) HandleCreation(c *gin.Context) {
 		clientID = query.ClientID
 	}
 
-	reserve, allocErr := s.allocateReserve(
-		ReserveRequest{
-			Body:           body,
-			UserID:         uri.UserID,
-			ClientID:       clientID,
-			IdempotencyKey: headers.IdempotencyKey,
-		},
-		s.checkConcurrency(uri.UserID),
-	)
+	request := ReserveRequest{
+		Body:           body,
+		UserID:         uri.UserID,
+		ClientID:       clientID,
+		IdempotencyKey: headers.IdempotencyKey,
+		RequestID:      logger.RequestID(c),
+		Counted:        c.GetBool(CountedKey),
+		Trace:          tracing.FromContext(c).StartChild("reserve.create"),
+	}
+	log := s.logger.With(request.LogFields()...)
+	span := request.Trace
+	defer span.Finish()
+	span.SetAttribute("user_id", request.UserID)
+	span.SetAttribute("client_id", request.ClientID)
+	span.SetAttribute("amount", request.Body.Amount)
+
+	modeSpan := span.StartChild("reserve.allocation_mode")
+	isConcurrent, diagnostics := s.allocationMode(request)
+	modeSpan.SetAttribute("allocation_mode", diagnostics.AllocationMode)
+	modeSpan.SetAttribute("source", diagnostics.Source)
+	modeSpan.Finish()
+	span.SetAttribute("allocation_mode", diagnostics.AllocationMode)
+
+	if prefersAsync(c) {
+		pending, err := s.submitReserve(request, isConcurrent)
+		if err != nil {
+			span.SetError(err)
+			log.Warn("could not queue reserve", "error", err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"message": err.Error(),
+				"code":    "async_unavailable",
+			})
+			return
+		}
+
+		pending.Diagnostics = &diagnostics
+		c.Header("Preference-Applied", "respond-async")
+		c.Header("Location", fmt.Sprintf("/api/users/%d/reserve/%s", uri.UserID, pending.ID))
+		c.JSON(http.StatusAccepted, pending)
+		return
+	}
+
+	reserve, allocErr := s.allocateReserve(request, isConcurrent)
+	span.SetError(allocErr)
+	if allocErr == InsufficientFundsError {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "Insufficient funds!",
+			"code":    "insufficient_funds",
+		})
+		return
+	}
 	if allocErr != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, allocErr)
+		log.Error("could not allocate reserve", "allocation_mode", diagnostics.AllocationMode, "error", allocErr)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": allocErr.Error(),
+			"code":    "allocation_failed",
+		})
 		return
 	}
 
+	log.Debug("reserve allocated", "reserve_id", reserve.ID, "allocation_mode", diagnostics.AllocationMode)
+	span.SetAttribute("reserve_id", reserve.ID)
+	reserve.Diagnostics = &diagnostics
+	c.Set(ReservedAmountKey, reserve.Amount)
 	c.JSON(http.StatusOK, reserve)
 	return
 }
@@ -0,0 +1,71 @@
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	UnknownExporterError = errors.New("unknown trace exporter")
+)
+
+// Record is a finished span as handed to exporters.
+type Record struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_id,omitempty"`
+	Name       string                 `json:"name"`
+	Start      time.Time              `json:"start"`
+	DurationMs float64                `json:"duration_ms"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// Exporter ships finished spans; it is called by every goroutine finishing a
+// span and must be safe for concurrent use.
+type Exporter interface {
+	Export(record Record)
+}
+
+// JSONExporter writes one JSON object per span.
+type JSONExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{w: w}
+}
+
+func (e *JSONExporter) Export(record Record) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	e.mu.Lock()
+	e.w.Write(append(line, '\n'))
+	e.mu.Unlock()
+}
+
+// NewExporter builds the built-in exporter called name: "stdout", or "file"
+// appending to path.
+func NewExporter(name, path string) (Exporter, error) {
+	switch name {
+	case "stdout":
+		return NewJSONExporter(os.Stdout), nil
+	case "file":
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewJSONExporter(f), nil
+	default:
+		return nil, UnknownExporterError
+	}
+}
@@ -0,0 +1,44 @@
+package tracing
+
+import (
+	"github.com/gin-gonic/gin"
+	"reserve/reserve/logger"
+)
+
+const (
+	TraceParentHeader = "traceparent"
+	// SpanKey holds the span of the request in the gin context.
+	SpanKey = "span"
+)
+
+// FromContext is the span of the request being served, nil when it is not
+// traced.
+func FromContext(c *gin.Context) *Span {
+	span, _ := c.Get(SpanKey)
+	s, _ := span.(*Span)
+
+	return s
+}
+
+// RegisterMiddleware starts the root span of the request, continuing the
+// trace of its traceparent header, and finishes it once the request is
+// served.
+func (t *Tracer) RegisterMiddleware(c *gin.Context) {
+	span := t.StartSpan(c.Request.Method+" "+c.FullPath(), c.GetHeader(TraceParentHeader))
+	if span == nil {
+		c.Next()
+		return
+	}
+
+	span.SetAttribute("http.method", c.Request.Method)
+	span.SetAttribute("http.path", c.Request.URL.Path)
+	if requestID := logger.RequestID(c); requestID != "" {
+		span.SetAttribute("request_id", requestID)
+	}
+	c.Set(SpanKey, span)
+
+	c.Next()
+
+	span.SetAttribute("http.status", c.Writer.Status())
+	span.Finish()
+}
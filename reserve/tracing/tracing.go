@@ -0,0 +1,191 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	mathrand "math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracer starts the root span of every sampled request and hands finished
+// spans to its exporter. A nil Tracer traces nothing.
+type Tracer struct {
+	exporter   Exporter
+	sampleRate float64
+}
+
+func NewTracer(exporter Exporter, sampleRate float64) *Tracer {
+	return &Tracer{exporter, sampleRate}
+}
+
+// Span times one step of a request. Children are started from their parent
+// and every span is exported on Finish; all methods of a nil Span are
+// no-ops, so code can trace unconditionally.
+type Span struct {
+	tracer   *Tracer
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	start    time.Time
+
+	mu         sync.Mutex
+	attributes map[string]interface{}
+	err        string
+	finished   bool
+}
+
+// StartSpan starts a root span, continuing the trace of traceparent when it
+// is a valid W3C header. Traces the caller sampled are always kept; the
+// others, and new traces, are kept with probability sampleRate.
+func (t *Tracer) StartSpan(name, traceparent string) *Span {
+	if t == nil {
+		return nil
+	}
+
+	traceID, parentID, sampled, ok := parseTraceParent(traceparent)
+	if !ok {
+		traceID = newID(16)
+		parentID = ""
+	}
+	if !sampled && (t.sampleRate <= 0 || mathrand.Float64() >= t.sampleRate) {
+		return nil
+	}
+
+	return t.newSpan(name, traceID, parentID)
+}
+
+func (t *Tracer) newSpan(name, traceID, parentID string) *Span {
+	return &Span{
+		tracer:   t,
+		traceID:  traceID,
+		spanID:   newID(8),
+		parentID: parentID,
+		name:     name,
+		start:    time.Now(),
+	}
+}
+
+// StartChild starts a span for a step of s.
+func (s *Span) StartChild(name string) *Span {
+	if s == nil {
+		return nil
+	}
+
+	return s.tracer.newSpan(name, s.traceID, s.spanID)
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.attributes == nil {
+		s.attributes = map[string]interface{}{}
+	}
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks s as failed with err; a nil err is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// Finish ends s and exports it. Only the first call has an effect.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+
+	end := time.Now()
+
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	record := Record{
+		TraceID:    s.traceID,
+		SpanID:     s.spanID,
+		ParentID:   s.parentID,
+		Name:       s.name,
+		Start:      s.start,
+		DurationMs: float64(end.Sub(s.start).Microseconds()) / 1000,
+		Attributes: s.attributes,
+		Error:      s.err,
+	}
+	s.mu.Unlock()
+
+	s.tracer.exporter.Export(record)
+}
+
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+
+	return s.traceID
+}
+
+// TraceParent is the W3C traceparent header making a downstream span a
+// child of s.
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+
+	return "00-" + s.traceID + "-" + s.spanID + "-01"
+}
+
+// parseTraceParent reads a version 00 traceparent header. Later versions are
+// read the same way, as the specification asks, ignoring extra fields.
+func parseTraceParent(header string) (traceID, parentID string, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || (parts[0] == "00" && len(parts) != 4) {
+		return "", "", false, false
+	}
+
+	version, traceID, parentID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isHex(version, 2) || version == "ff" ||
+		!isHex(traceID, 32) || traceID == strings.Repeat("0", 32) ||
+		!isHex(parentID, 16) || parentID == strings.Repeat("0", 16) ||
+		!isHex(flags, 2) {
+		return "", "", false, false
+	}
+
+	flagBits, _ := hex.DecodeString(flags)
+
+	return traceID, parentID, flagBits[0]&0x01 == 1, true
+}
+
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newID(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+type recorder struct {
+	mu      sync.Mutex
+	records []Record
+}
+
+func (r *recorder) Export(record Record) {
+	r.mu.Lock()
+	r.records = append(r.records, record)
+	r.mu.Unlock()
+}
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		header   string
+		sampled  bool
+		accepted bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", false, true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	}
+
+	for _, test := range tests {
+		traceID, parentID, sampled, ok := parseTraceParent(test.header)
+		if ok != test.accepted || sampled != test.sampled {
+			t.Errorf("%q: expected accepted=%v sampled=%v, got %v %v", test.header, test.accepted, test.sampled, ok, sampled)
+			continue
+		}
+		if ok && (traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || parentID != "00f067aa0ba902b7") {
+			t.Errorf("%q: unexpected ids %s %s", test.header, traceID, parentID)
+		}
+	}
+}
+
+func TestSpansShareTheTrace(t *testing.T) {
+	r := &recorder{}
+	tracer := NewTracer(r, 1)
+
+	root := tracer.StartSpan("request", "")
+	child := root.StartChild("upstream.post")
+	child.SetAttribute("amount", 25)
+	child.SetError(errors.New("generic error"))
+	child.Finish()
+	child.Finish()
+	root.Finish()
+
+	if len(r.records) != 2 {
+		t.Fatalf("expected 2 spans exported once each, got %d", len(r.records))
+	}
+
+	post, request := r.records[0], r.records[1]
+	if post.TraceID != request.TraceID || post.ParentID != request.SpanID || request.ParentID != "" {
+		t.Errorf("expected upstream.post to be a child of request, got %+v and %+v", post, request)
+	}
+	if post.Error != "generic error" || post.Attributes["amount"] != 25 {
+		t.Errorf("unexpected span %+v", post)
+	}
+	if root.TraceParent() != "00-"+request.TraceID+"-"+request.SpanID+"-01" {
+		t.Errorf("unexpected traceparent %s", root.TraceParent())
+	}
+}
+
+func TestSampling(t *testing.T) {
+	r := &recorder{}
+	tracer := NewTracer(r, 0)
+
+	if span := tracer.StartSpan("request", ""); span != nil {
+		t.Error("expected new traces to be sampled out")
+	}
+	if span := tracer.StartSpan("request", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"); span != nil {
+		t.Error("expected traces the caller did not sample to be sampled out")
+	}
+
+	span := tracer.StartSpan("request", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if span == nil {
+		t.Fatal("expected traces sampled by the caller to be kept")
+	}
+
+	var untraced *Span
+	untraced.StartChild("step").Finish()
+	if untraced.TraceParent() != "" {
+		t.Error("expected no traceparent for an untraced request")
+	}
+}
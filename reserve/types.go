@@ -3,22 +3,67 @@ package reserve
 import (
 	"encoding/json"
 	"gopkg.in/go-playground/validator.v9"
+	"reserve/reserve/tracing"
+	"time"
 )
 
 type Reserve struct {
-	ID                int64   `json:"id"`
-	Version           *string `json:"version"`
-	TTL               *int64  `json:"-"`
-	ExternalReference string  `json:"-"`
-	IdempotencyKey    string  `json:"-"`
-	Reason            Reason  `json:"-"`
-	Mode              Mode    `json:"-"`
-	Amount            int64   `json:"amount"`
-	ClientID          string  `json:"-"`
-	UserID            uint64  `json:"-"`
-	Status            string  `json:"status"`
-	DateCreated       string  `json:"-"`
-	LastModified      string  `json:"-"`
+	ID                int64        `json:"id"`
+	Version           *string      `json:"version"`
+	TTL               *int64       `json:"-"`
+	ExternalReference string       `json:"-"`
+	IdempotencyKey    string       `json:"-"`
+	Reason            Reason       `json:"-"`
+	Mode              Mode         `json:"-"`
+	Amount            int64        `json:"amount"`
+	ClientID          string       `json:"-"`
+	UserID            uint64       `json:"-"`
+	Status            string       `json:"status"`
+	DateCreated       string       `json:"-"`
+	LastModified      string       `json:"-"`
+	Diagnostics       *Diagnostics `json:"diagnostics,omitempty"`
+}
+
+// Diagnostics explains how the allocation mode of a reserve was chosen.
+type Diagnostics struct {
+	AllocationMode AllocationMode `json:"allocation_mode"`
+	Source         string         `json:"source"`
+	Override       *Override      `json:"override,omitempty"`
+}
+
+// AuthenticatedClientIDKey holds, in the gin context, the client ID the
+// caller authenticated as.
+const AuthenticatedClientIDKey = "authenticated_client_id"
+
+// ReservedAmountKey holds, in the gin context, the amount in cents of the
+// reserve allocated for the request.
+const ReservedAmountKey = "reserved_amount"
+
+// CountedKey is set, in the gin context, once the rate limiter counted the
+// request against the daily quotas of its client. Replays are not counted.
+const CountedKey = "rate_limit_counted"
+
+var DiagnosticSources = struct {
+	Concurrency string
+	Override    string
+	Paused      string
+}{
+	"concurrency",
+	"override",
+	"paused",
+}
+
+// Override forces the allocation mode of a user regardless of its heat.
+type Override struct {
+	UserID      uint64         `json:"user_id"`
+	Mode        AllocationMode `json:"mode"`
+	Reason      string         `json:"reason"`
+	ExpiresAt   *time.Time     `json:"expires_at,omitempty"`
+	DateCreated time.Time      `json:"date_created"`
+}
+
+func (o *Override) Expired(now time.Time) bool {
+	return o.ExpiresAt != nil && !now.Before(*o.ExpiresAt)
 }
 
 type ByAmount []Reserve
@@ -27,6 +72,8 @@ func (a ByAmount) Len() int           { return len(a) }
 func (a ByAmount) Less(i, j int) bool { return a[i].Amount > a[j].Amount }
 func (a ByAmount) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 
+// ByAmountComparator orders reserves by descending amount. Reserves with the
+// same amount are told apart by ID so a bidirectional map can hold both.
 func ByAmountComparator(a, b interface{}) int {
 	ra := a.(Reserve)
 	rb := b.(Reserve)
@@ -36,6 +83,10 @@ func ByAmountComparator(a, b interface{}) int {
 		return 1
 	case ra.Amount > rb.Amount:
 		return -1
+	case ra.ID < rb.ID:
+		return 1
+	case ra.ID > rb.ID:
+		return -1
 	default:
 		return 0
 	}
@@ -61,11 +112,31 @@ type Body struct {
 	ExternalReference string `json:"external_reference" binging:"required"`
 }
 
+type ReserveURI struct {
+	UserID    uint64 `uri:"user_id" binding:"required"`
+	ReserveID string `uri:"reserve_id" binding:"required"`
+}
+
 type ReserveRequest struct {
 	Body           Body
 	ClientID       string
 	UserID         uint64
 	IdempotencyKey string
+	RequestID      string
+	// Counted is set when the rate limiter counted the request, which it
+	// then refunds as far as the request reserves less than its amount.
+	Counted bool
+	// Trace is the span the steps serving the request are traced under.
+	Trace *tracing.Span
+}
+
+// LogFields identifies the request in log lines.
+func (r ReserveRequest) LogFields() []interface{} {
+	return []interface{}{
+		"request_id", r.RequestID,
+		"user_id", r.UserID,
+		"client_id", r.ClientID,
+	}
 }
 
 func BodyStructValidation(structLevel validator.StructLevel) {
@@ -115,6 +186,50 @@ func (rb *Body) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+type PendingReserve struct {
+	ID           string        `json:"id"`
+	UserID       uint64        `json:"-"`
+	Status       PendingStatus `json:"status"`
+	Reserve      *Reserve      `json:"reserve,omitempty"`
+	Error        string        `json:"error,omitempty"`
+	Diagnostics  *Diagnostics  `json:"diagnostics,omitempty"`
+	DateCreated  time.Time     `json:"date_created"`
+	LastModified time.Time     `json:"last_modified"`
+}
+
+type PendingStatus string
+
+var PendingStatuses = struct {
+	Pending  PendingStatus
+	Reserved PendingStatus
+	Failed   PendingStatus
+}{
+	"pending",
+	"reserved",
+	"failed",
+}
+
+type AllocationMode string
+
+var AllocationModes = struct {
+	Standalone AllocationMode
+	Bucket     AllocationMode
+}{
+	"standalone",
+	"bucket",
+}
+
+var PossibleAllocationModes = []AllocationMode{AllocationModes.Standalone, AllocationModes.Bucket}
+
+func (m *AllocationMode) Valid() bool {
+	for _, pm := range PossibleAllocationModes {
+		if *m == pm {
+			return true
+		}
+	}
+	return false
+}
+
 type Mode string
 
 var Modes = struct {